@@ -9,6 +9,7 @@ package ast
 
 import (
 	"github.com/rthornton128/gocalc/token"
+	"sort"
 )
 
 type (
@@ -19,6 +20,7 @@ type (
 	Identifier struct {
 		Id  token.Pos
 		Lit string
+		Obj *Object // set by the resolver
 	}
 	Number struct {
 		Num token.Pos
@@ -38,9 +40,31 @@ type (
 		RParen token.Pos
 		Nodes  []Node
 	}
+	// AssertExpr is (assert-type value type). It yields value, which must
+	// be of the named type.
+	AssertExpr struct {
+		Expression
+		Type string
+	}
+	// AssertEqualExpr is (assert-equal expected actual). It stops the
+	// program, or the test it is in, unless the two values are equal.
+	AssertEqualExpr struct {
+		Expression
+	}
 	CaseExpr struct {
 		Expression
 	}
+	// Comment is a single ';' comment, running to the end of the line.
+	Comment struct {
+		Semi token.Pos // position of ';'
+		Text string    // comment text, excluding the newline
+	}
+	// CommentGroup is a sequence of comments on adjacent lines, with no
+	// other tokens between them. A comment following code on the same line
+	// is always a group of its own.
+	CommentGroup struct {
+		List []*Comment
+	}
 	CompExpr struct {
 		Expression
 		CompLit string
@@ -48,11 +72,21 @@ type (
 	ConcatExpr struct {
 		Expression
 	}
+	// ConvExpr converts its argument with one of the int, float or str
+	// builtins.
+	ConvExpr struct {
+		Expression
+		ConvLit string
+	}
 	DefineExpr struct {
 		Expression
-		Scope *Scope
-		Name  string
-		Args  []string
+		Scope    *Scope
+		Name     string
+		Args     []string
+		ArgTypes []string // declared argument types, "" where omitted
+		Type     string   // declared return type, if any
+		Obj      *Object  // set by the resolver
+		NumSlots int      // number of arguments and local variables
 	}
 	IfExpr struct {
 		Expression
@@ -65,32 +99,71 @@ type (
 		Expression
 		OpLit string
 	}
+	// PredExpr tests the type of its argument with one of the type
+	// predicates, such as number?.
+	PredExpr struct {
+		Expression
+		PredLit string
+	}
 	PrintExpr struct {
 		Expression
 	}
 	SetExpr struct {
 		Expression
 		Name  string
+		Type  string // declared type, if any
 		Value Node
+		Obj   *Object // set by the resolver
 	}
 	SwitchExpr struct {
 		Expression
 		Pred Node
 	}
+	// TestExpr is (deftest name body...), a test run by gocalc test. Its
+	// body is evaluated like that of a function without arguments, but a
+	// test may not be called.
+	TestExpr struct {
+		Expression
+		Scope    *Scope
+		Name     string
+		NumSlots int // number of local variables
+	}
 	UserExpr struct {
 		Expression
 		Name string
+		Obj  *Object // set by the resolver
 	}
 	File struct {
-		pos   token.Pos
-		end   token.Pos
-		Nodes []Node
-		Scope *Scope
+		pos      token.Pos
+		end      token.Pos
+		Nodes    []Node
+		Comments []*CommentGroup // all comments in the file, in source order
+		Scope    *Scope
+		NumSlots int // number of global variables
 	}
 	Scope struct {
 		defs   map[string]interface{}
 		Parent *Scope
 	}
+	// Object is the binding of a name as determined by the resolver. A
+	// variable lives in slot Index of the frame belonging to the scope at
+	// depth Depth, where the file scope is depth 0 and each define adds one.
+	Object struct {
+		Kind  ObjKind
+		Name  string
+		Decl  Node // *DefineExpr for Arg and Fun, *SetExpr for Var
+		Depth int  // depth of the declaring scope
+		Index int  // slot of an Arg or Var in the declaring scope
+	}
+)
+
+type ObjKind int
+
+const (
+	Bad ObjKind = iota
+	Arg         // function argument
+	Fun         // function declared by define
+	Var         // variable declared by set
 )
 
 func (i *Identifier) Pos() token.Pos { return i.Id }
@@ -109,7 +182,8 @@ func (e *Expression) Pos() token.Pos { return e.LParen }
 func (e *Expression) End() token.Pos { return e.RParen }
 
 func NewFile(beg, end token.Pos) *File {
-	return &File{beg, end, make([]Node, 0), NewScope(nil)}
+	return &File{pos: beg, end: end, Nodes: make([]Node, 0),
+		Scope: NewScope(nil)}
 }
 
 func (f *File) Pos() token.Pos { return f.pos }
@@ -134,10 +208,28 @@ func (s *Scope) Lookup(ident string) interface{} {
 	return nil
 }
 
+// Names returns every name visible from s, including those of its parents,
+// in sorted order.
+func (s *Scope) Names() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for m := s; m != nil; m = m.Parent {
+		for k := range m.defs {
+			if !seen[k] {
+				seen[k] = true
+				names = append(names, k)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// String returns the names visible from s, as returned by Names, in
+// brackets.
 func (s *Scope) String() string {
-	tmp := s
 	var str string
-	for k, _ := range tmp.defs {
+	for _, k := range s.Names() {
 		str += k + " "
 	}
 	return "[ " + str + "]"
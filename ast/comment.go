@@ -0,0 +1,91 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+package ast
+
+import (
+	"github.com/rthornton128/gocalc/token"
+	"strings"
+)
+
+func (c *Comment) Pos() token.Pos { return c.Semi }
+func (c *Comment) End() token.Pos { return c.Semi + token.Pos(len(c.Text)) }
+
+func (g *CommentGroup) Pos() token.Pos { return g.List[0].Pos() }
+func (g *CommentGroup) End() token.Pos { return g.List[len(g.List)-1].End() }
+
+// Text returns the text of the comment group with the leading semicolons,
+// and a single space following them, removed from each line.
+func (g *CommentGroup) Text() string {
+	if g == nil {
+		return ""
+	}
+	lines := make([]string, len(g.List))
+	for i, c := range g.List {
+		s := strings.TrimLeft(c.Text, ";")
+		s = strings.TrimPrefix(s, " ")
+		lines[i] = strings.TrimRight(s, " \t\r")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// A CommentMap maps a node to the comment groups attached to it.
+type CommentMap map[Node][]*CommentGroup
+
+// NewCommentMap attaches each comment group to the nearest node within
+// node. A group following code on the same line is a trailing comment of
+// the outermost node ending there. Any other group is a leading comment of
+// the outermost node following it within the same expression, or, if there
+// is none, a trailing comment of the node it lies within.
+func NewCommentMap(f *token.File, node Node, comments []*CommentGroup) CommentMap {
+	var nodes []Node // in source order, outer nodes before inner ones
+	Inspect(node, func(n Node) bool {
+		switch n.(type) {
+		case nil, *Comment, *CommentGroup:
+			return false
+		case *File:
+			return true
+		}
+		nodes = append(nodes, n)
+		return true
+	})
+
+	cmap := make(CommentMap)
+	for _, g := range comments {
+		var enclosing, prev, next Node
+		for _, n := range nodes {
+			if n.Pos() < g.Pos() && g.End() < n.End() {
+				enclosing = n // the last found is the innermost
+			}
+		}
+		for _, n := range nodes {
+			if enclosing != nil && (n.Pos() <= enclosing.Pos() ||
+				n.End() >= enclosing.End()) {
+				continue // not within the same expression
+			}
+			if n.End() < g.Pos() && (prev == nil || n.End() > prev.End()) {
+				prev = n
+			}
+			if n.Pos() > g.End() && (next == nil || n.Pos() < next.Pos()) {
+				next = n
+			}
+		}
+		switch {
+		case prev != nil && f.Line(prev.End()) == f.Line(g.Pos()):
+			cmap[prev] = append(cmap[prev], g)
+		case next != nil:
+			cmap[next] = append(cmap[next], g)
+		case enclosing != nil:
+			cmap[enclosing] = append(cmap[enclosing], g)
+		case prev != nil:
+			cmap[prev] = append(cmap[prev], g)
+		default:
+			cmap[node] = append(cmap[node], g)
+		}
+	}
+	return cmap
+}
@@ -0,0 +1,40 @@
+package ast_test
+
+import (
+	"github.com/rthornton128/gocalc/ast"
+	"github.com/rthornton128/gocalc/parser"
+	"github.com/rthornton128/gocalc/token"
+	"testing"
+)
+
+func TestCommentMap(t *testing.T) {
+	src := "; doc for f\n(define (f x)\n\t; before body\n\t(+ x 1)) ; after f\n" +
+		"(print (f 1)) ; after print\n; end"
+	f := token.NewFile("", src, 1)
+	n := parser.ParseFile(f, src)
+	if f.NumErrors() > 0 {
+		t.Fatal(f.Err())
+	}
+	cmap := ast.NewCommentMap(f, n, n.Comments)
+	def := n.Nodes[0].(*ast.DefineExpr)
+	var tests = []struct {
+		node ast.Node
+		text []string
+	}{
+		{def, []string{"doc for f", "after f"}},
+		{def.Nodes[0], []string{"before body"}},
+		{n.Nodes[1], []string{"after print", "end"}},
+	}
+	for i, test := range tests {
+		groups := cmap[test.node]
+		if len(groups) != len(test.text) {
+			t.Fatal(i, "- Expected:", test.text, "Got:", len(groups), "groups")
+		}
+		for j, g := range groups {
+			if g.Text() != test.text[j] {
+				t.Log(i, "- Expected:", test.text[j])
+				t.Fatal(i, "- Got:", g.Text())
+			}
+		}
+	}
+}
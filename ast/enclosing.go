@@ -0,0 +1,44 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+package ast
+
+import "github.com/rthornton128/gocalc/token"
+
+// Enclosing returns the nodes beneath root which enclose p, beginning with
+// root and ending with the innermost. An expression encloses its parens and
+// everything between them. It returns nil if root does not enclose p.
+func Enclosing(root Node, p token.Pos) []Node {
+	var path []Node
+	Inspect(root, func(n Node) bool {
+		if n == nil || !encloses(n, p) {
+			return false
+		}
+		path = append(path, n)
+		return true
+	})
+	return path
+}
+
+// NodeAt returns the innermost node beneath root enclosing p, or nil if
+// there is none.
+func NodeAt(root Node, p token.Pos) Node {
+	if path := Enclosing(root, p); len(path) > 0 {
+		return path[len(path)-1]
+	}
+	return nil
+}
+
+func encloses(n Node, p token.Pos) bool {
+	switch n.(type) {
+	case *Identifier, *Number, *String, *Operator, *Comment, *CommentGroup,
+		*File:
+		return n.Pos() <= p && p < n.End()
+	}
+	// the End of an expression is its closing paren
+	return n.Pos() <= p && p <= n.End()
+}
@@ -0,0 +1,45 @@
+package ast_test
+
+import (
+	"fmt"
+	"github.com/rthornton128/gocalc/ast"
+	"github.com/rthornton128/gocalc/token"
+	"testing"
+)
+
+func TestEnclosing(t *testing.T) {
+	var tests = []struct {
+		off  int // offset into walkSrc
+		path string
+	}{
+		{0, "File SetExpr"},
+		{5, "File SetExpr"},
+		{7, "File SetExpr Number"},
+		{8, "File SetExpr"},
+		{9, "File"},
+		{41, "File DefineExpr DefineExpr MathExpr Identifier"},
+		{42, "File DefineExpr DefineExpr MathExpr"},
+		{44, "File DefineExpr DefineExpr MathExpr"},
+		{45, "File DefineExpr DefineExpr"},
+		{46, "File DefineExpr"},
+		{len(walkSrc) - 1, "File IfExpr"},
+		{len(walkSrc), ""},
+	}
+	root := parse(t, walkSrc)
+	for i, test := range tests {
+		var path string
+		for _, n := range ast.Enclosing(root, token.Pos(test.off+1)) {
+			if path != "" {
+				path += " "
+			}
+			path += fmt.Sprintf("%T", n)[len("*ast."):]
+		}
+		if path != test.path {
+			t.Log(i, "- Expected:", test.path)
+			t.Fatal(i, "- Got:", path)
+		}
+	}
+	if n := ast.NodeAt(root, 8); n == nil || n.Pos() != 8 {
+		t.Fatal("Expected the Number at 8, got:", n)
+	}
+}
@@ -0,0 +1,611 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+package ast
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rthornton128/gocalc/token"
+)
+
+// Every node is encoded as a JSON object tagged with its kind, the name of
+// its type, and holding its positions as offsets into the file set it was
+// parsed with:
+//
+//	{"kind":"MathExpr","pos":1,"end":9,"lit":"+","nodes":[...]}
+//
+// The position of an expression is that of its left paren and its end that
+// of its right paren. The remaining members, each omitted if empty, are:
+//
+//	lit       the literal of an Identifier, Number, String or Operator, or
+//	          the operator of a CompExpr, ConvExpr, MathExpr or PredExpr
+//	val       the value of a Number
+//	text      the text of a Comment
+//	name      the name of a DefineExpr, SetExpr, TestExpr or UserExpr
+//	type      the type of an AssertExpr and the declared type of a
+//	          DefineExpr or SetExpr
+//	args      the arguments of a DefineExpr
+//	argTypes  the declared argument types of a DefineExpr
+//	import    the path of an ImportExpr
+//	value     the value of a SetExpr
+//	pred      the predicate of a SwitchExpr
+//	nodes     the nodes of an expression or File, null where one is missing
+//	list      the comments of a CommentGroup
+//	comments  the comment groups of a File
+//
+// Objects and the numbers of slots, which are set by the resolver, are not
+// encoded. The scopes built by the parser are rebuilt when a File is
+// decoded, and the tree is checked as the parser would have: decoding fails
+// if an expression holds the wrong number of nodes, a node lies outside the
+// one holding it or a call passes the wrong number of arguments.
+
+// jsonNode is the encoding of any node
+type jsonNode struct {
+	Kind     string      `json:"kind"`
+	Pos      token.Pos   `json:"pos"`
+	End      token.Pos   `json:"end,omitempty"`
+	Lit      string      `json:"lit,omitempty"`
+	Val      int         `json:"val,omitempty"`
+	Text     string      `json:"text,omitempty"`
+	Name     string      `json:"name,omitempty"`
+	Type     string      `json:"type,omitempty"`
+	Args     []string    `json:"args,omitempty"`
+	ArgTypes []string    `json:"argTypes,omitempty"`
+	Import   string      `json:"import,omitempty"`
+	Value    *jsonChild  `json:"value,omitempty"`
+	Pred     *jsonChild  `json:"pred,omitempty"`
+	Nodes    []jsonChild `json:"nodes,omitempty"`
+	List     []jsonChild `json:"list,omitempty"`
+	Comments []jsonChild `json:"comments,omitempty"`
+}
+
+// jsonChild is a node held by another, decoded according to its kind
+type jsonChild struct {
+	Node
+}
+
+func (c jsonChild) MarshalJSON() ([]byte, error) {
+	if c.Node == nil {
+		return []byte("null"), nil
+	}
+	return json.Marshal(c.Node)
+}
+
+func (c *jsonChild) UnmarshalJSON(data []byte) error {
+	var tag struct {
+		Kind string `json:"kind"`
+	}
+	if string(data) == "null" {
+		c.Node = nil
+		return nil
+	}
+	if err := json.Unmarshal(data, &tag); err != nil {
+		return err
+	}
+	var n Node
+	switch tag.Kind {
+	case "Identifier":
+		n = new(Identifier)
+	case "Number":
+		n = new(Number)
+	case "String":
+		n = new(String)
+	case "Operator":
+		n = new(Operator)
+	case "Comment":
+		n = new(Comment)
+	case "CommentGroup":
+		n = new(CommentGroup)
+	case "Expression":
+		n = new(Expression)
+	case "AssertEqualExpr":
+		n = new(AssertEqualExpr)
+	case "AssertExpr":
+		n = new(AssertExpr)
+	case "CaseExpr":
+		n = new(CaseExpr)
+	case "CompExpr":
+		n = new(CompExpr)
+	case "ConcatExpr":
+		n = new(ConcatExpr)
+	case "ConvExpr":
+		n = new(ConvExpr)
+	case "DefineExpr":
+		n = new(DefineExpr)
+	case "IfExpr":
+		n = new(IfExpr)
+	case "ImportExpr":
+		n = new(ImportExpr)
+	case "MathExpr":
+		n = new(MathExpr)
+	case "PredExpr":
+		n = new(PredExpr)
+	case "PrintExpr":
+		n = new(PrintExpr)
+	case "SetExpr":
+		n = new(SetExpr)
+	case "SwitchExpr":
+		n = new(SwitchExpr)
+	case "TestExpr":
+		n = new(TestExpr)
+	case "UserExpr":
+		n = new(UserExpr)
+	case "File":
+		n = new(File)
+	default:
+		return fmt.Errorf("ast: unknown node kind %q", tag.Kind)
+	}
+	if err := json.Unmarshal(data, n); err != nil {
+		return err
+	}
+	c.Node = n
+	return nil
+}
+
+func children(list []Node) []jsonChild {
+	if len(list) == 0 {
+		return nil
+	}
+	c := make([]jsonChild, len(list))
+	for i, n := range list {
+		c[i].Node = n
+	}
+	return c
+}
+
+func nodes(list []jsonChild) []Node {
+	l := make([]Node, len(list))
+	for i, c := range list {
+		l[i] = c.Node
+	}
+	return l
+}
+
+func child(n Node) *jsonChild {
+	if n == nil {
+		return nil
+	}
+	return &jsonChild{n}
+}
+
+func (c *jsonChild) node() Node {
+	if c == nil {
+		return nil
+	}
+	return c.Node
+}
+
+func expr(kind string, e *Expression) *jsonNode {
+	return &jsonNode{Kind: kind, Pos: e.LParen, End: e.RParen,
+		Nodes: children(e.Nodes)}
+}
+
+// encode returns the encoding of n, whose children are encoded in turn
+func encode(n Node) *jsonNode {
+	switch n := n.(type) {
+	case *Identifier:
+		return &jsonNode{Kind: "Identifier", Pos: n.Id, Lit: n.Lit}
+	case *Number:
+		return &jsonNode{Kind: "Number", Pos: n.Num, Lit: n.Lit, Val: n.Val}
+	case *String:
+		return &jsonNode{Kind: "String", Pos: n.Str, Lit: n.Lit}
+	case *Operator:
+		return &jsonNode{Kind: "Operator", Pos: n.Opr, Lit: n.Val}
+	case *Comment:
+		return &jsonNode{Kind: "Comment", Pos: n.Semi, Text: n.Text}
+	case *CommentGroup:
+		j := &jsonNode{Kind: "CommentGroup", Pos: n.Pos()}
+		for _, c := range n.List {
+			j.List = append(j.List, jsonChild{c})
+		}
+		return j
+	case *Expression:
+		return expr("Expression", n)
+	case *AssertEqualExpr:
+		return expr("AssertEqualExpr", &n.Expression)
+	case *AssertExpr:
+		j := expr("AssertExpr", &n.Expression)
+		j.Type = n.Type
+		return j
+	case *CaseExpr:
+		return expr("CaseExpr", &n.Expression)
+	case *CompExpr:
+		j := expr("CompExpr", &n.Expression)
+		j.Lit = n.CompLit
+		return j
+	case *ConcatExpr:
+		return expr("ConcatExpr", &n.Expression)
+	case *ConvExpr:
+		j := expr("ConvExpr", &n.Expression)
+		j.Lit = n.ConvLit
+		return j
+	case *DefineExpr:
+		j := expr("DefineExpr", &n.Expression)
+		j.Name, j.Type = n.Name, n.Type
+		j.Args, j.ArgTypes = n.Args, n.ArgTypes
+		return j
+	case *IfExpr:
+		return expr("IfExpr", &n.Expression)
+	case *ImportExpr:
+		j := expr("ImportExpr", &n.Expression)
+		j.Import = n.Import
+		return j
+	case *MathExpr:
+		j := expr("MathExpr", &n.Expression)
+		j.Lit = n.OpLit
+		return j
+	case *PredExpr:
+		j := expr("PredExpr", &n.Expression)
+		j.Lit = n.PredLit
+		return j
+	case *PrintExpr:
+		return expr("PrintExpr", &n.Expression)
+	case *SetExpr:
+		j := expr("SetExpr", &n.Expression)
+		j.Name, j.Type, j.Value = n.Name, n.Type, child(n.Value)
+		return j
+	case *SwitchExpr:
+		j := expr("SwitchExpr", &n.Expression)
+		j.Pred = child(n.Pred)
+		return j
+	case *TestExpr:
+		j := expr("TestExpr", &n.Expression)
+		j.Name = n.Name
+		return j
+	case *UserExpr:
+		j := expr("UserExpr", &n.Expression)
+		j.Name = n.Name
+		return j
+	case *File:
+		j := &jsonNode{Kind: "File", Pos: n.pos, End: n.end,
+			Nodes: children(n.Nodes)}
+		for _, g := range n.Comments {
+			j.Comments = append(j.Comments, jsonChild{g})
+		}
+		return j
+	}
+	panic(fmt.Sprintf("ast: unexpected node type %T", n))
+}
+
+func marshal(n Node) ([]byte, error) {
+	return json.Marshal(encode(n))
+}
+
+// unmarshal decodes data into n, which must be of the kind encoded
+func unmarshal(data []byte, n Node) error {
+	var j jsonNode
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	kind := kindOf(n)
+	if j.Kind != kind {
+		return fmt.Errorf("ast: cannot decode %s as %s", j.Kind, kind)
+	}
+	e := Expression{LParen: j.Pos, RParen: j.End, Nodes: nodes(j.Nodes)}
+	switch n := n.(type) {
+	case *Identifier:
+		*n = Identifier{Id: j.Pos, Lit: j.Lit}
+	case *Number:
+		*n = Number{Num: j.Pos, Lit: j.Lit, Val: j.Val}
+	case *String:
+		*n = String{Str: j.Pos, Lit: j.Lit}
+	case *Operator:
+		*n = Operator{Opr: j.Pos, Val: j.Lit}
+	case *Comment:
+		*n = Comment{Semi: j.Pos, Text: j.Text}
+	case *CommentGroup:
+		*n = CommentGroup{}
+		for _, c := range j.List {
+			cmt, ok := c.Node.(*Comment)
+			if !ok {
+				return fmt.Errorf("ast: comment group holds %T", c.Node)
+			}
+			n.List = append(n.List, cmt)
+		}
+	case *Expression:
+		*n = e
+	case *AssertEqualExpr:
+		*n = AssertEqualExpr{Expression: e}
+	case *AssertExpr:
+		*n = AssertExpr{Expression: e, Type: j.Type}
+	case *CaseExpr:
+		*n = CaseExpr{Expression: e}
+	case *CompExpr:
+		*n = CompExpr{Expression: e, CompLit: j.Lit}
+	case *ConcatExpr:
+		*n = ConcatExpr{Expression: e}
+	case *ConvExpr:
+		*n = ConvExpr{Expression: e, ConvLit: j.Lit}
+	case *DefineExpr:
+		*n = DefineExpr{Expression: e, Name: j.Name, Args: j.Args,
+			ArgTypes: j.ArgTypes, Type: j.Type}
+		if n.Args == nil {
+			n.Args = make([]string, 0)
+		}
+	case *IfExpr:
+		*n = IfExpr{Expression: e}
+	case *ImportExpr:
+		*n = ImportExpr{Expression: e, Import: j.Import}
+	case *MathExpr:
+		*n = MathExpr{Expression: e, OpLit: j.Lit}
+	case *PredExpr:
+		*n = PredExpr{Expression: e, PredLit: j.Lit}
+	case *PrintExpr:
+		*n = PrintExpr{Expression: e}
+	case *SetExpr:
+		*n = SetExpr{Expression: e, Name: j.Name, Type: j.Type,
+			Value: j.Value.node()}
+	case *SwitchExpr:
+		*n = SwitchExpr{Expression: e, Pred: j.Pred.node()}
+	case *TestExpr:
+		*n = TestExpr{Expression: e, Name: j.Name}
+	case *UserExpr:
+		*n = UserExpr{Expression: e, Name: j.Name}
+	case *File:
+		*n = File{pos: j.Pos, end: j.End, Nodes: e.Nodes,
+			Scope: NewScope(nil)}
+		for _, c := range j.Comments {
+			g, ok := c.Node.(*CommentGroup)
+			if !ok {
+				return fmt.Errorf("ast: file comments hold %T", c.Node)
+			}
+			n.Comments = append(n.Comments, g)
+		}
+		for _, node := range n.Nodes {
+			declare(n.Scope, node)
+		}
+		return validate(n)
+	}
+	return nil
+}
+
+// validate returns an error describing the first fault found in the decoded
+// tree n which the parser would not have let by: an expression with the
+// wrong number of nodes, a node lying outside the one holding it or a call
+// with the wrong number of arguments. Evaluating or translating such a tree
+// would panic.
+func validate(n *File) error {
+	if n.end < n.pos {
+		return fmt.Errorf("ast: File ends at %d before it begins at %d",
+			n.end, n.pos)
+	}
+	for _, g := range n.Comments {
+		if len(g.List) == 0 {
+			return fmt.Errorf("ast: empty CommentGroup")
+		}
+		for _, c := range g.List {
+			if err := within(c, n.pos, n.end); err != nil {
+				return err
+			}
+		}
+	}
+	for _, c := range n.Nodes {
+		if c == nil {
+			return fmt.Errorf("ast: File holds a null node")
+		}
+		if err := valid(c, n.Scope, n.pos, n.end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// within returns an error unless n lies between pos and end
+func within(n Node, pos, end token.Pos) error {
+	if n.Pos() < pos || n.End() > end || n.End() < n.Pos() {
+		return fmt.Errorf("ast: %s at %d-%d lies outside %d-%d", kindOf(n),
+			n.Pos(), n.End(), pos, end)
+	}
+	return nil
+}
+
+func kindOf(n Node) string {
+	return fmt.Sprintf("%T", n)[len("*ast."):]
+}
+
+// arity returns the least and the most number of nodes held by the
+// expression n, the most being -1 if there is no limit. The else of an
+// IfExpr is counted even if it is null.
+func arity(n Node) (int, int) {
+	switch n.(type) {
+	case *ImportExpr, *SetExpr:
+		return 0, 0
+	case *AssertExpr, *ConvExpr, *PredExpr:
+		return 1, 1
+	case *CaseExpr, *DefineExpr, *TestExpr:
+		return 1, -1
+	case *AssertEqualExpr, *CompExpr:
+		return 2, 2
+	case *ConcatExpr, *MathExpr:
+		return 2, -1
+	case *IfExpr:
+		return 3, 3
+	}
+	return 0, -1
+}
+
+// valid returns an error describing the first fault in the node n, which
+// is held by a node lying between pos and end and is within scope s
+func valid(n Node, s *Scope, pos, end token.Pos) error {
+	if err := within(n, pos, end); err != nil {
+		return err
+	}
+	var e *Expression
+	switch n := n.(type) {
+	case *Identifier, *Number, *String, *Operator:
+		return nil
+	case *Expression:
+		e = n
+	case *AssertEqualExpr:
+		e = &n.Expression
+	case *AssertExpr:
+		e = &n.Expression
+	case *CaseExpr:
+		e = &n.Expression
+	case *CompExpr:
+		e = &n.Expression
+	case *ConcatExpr:
+		e = &n.Expression
+	case *ConvExpr:
+		e = &n.Expression
+	case *DefineExpr:
+		e, s = &n.Expression, n.Scope
+		if n.Name == "" {
+			return fmt.Errorf("ast: DefineExpr at %d has no name", n.Pos())
+		}
+		if len(n.ArgTypes) != 0 && len(n.ArgTypes) != len(n.Args) {
+			return fmt.Errorf("ast: DefineExpr %s has %d arguments but %d "+
+				"argument types", n.Name, len(n.Args), len(n.ArgTypes))
+		}
+	case *IfExpr:
+		e = &n.Expression
+	case *ImportExpr:
+		e = &n.Expression
+	case *MathExpr:
+		e = &n.Expression
+	case *PredExpr:
+		e = &n.Expression
+	case *PrintExpr:
+		e = &n.Expression
+	case *SetExpr:
+		e = &n.Expression
+		if n.Name == "" || n.Value == nil {
+			return fmt.Errorf("ast: SetExpr at %d lacks a name or value",
+				n.Pos())
+		}
+		if err := valid(n.Value, s, n.Pos(), n.End()); err != nil {
+			return err
+		}
+	case *SwitchExpr:
+		e = &n.Expression
+		if n.Pred != nil {
+			if err := valid(n.Pred, s, n.Pos(), n.End()); err != nil {
+				return err
+			}
+		}
+		for _, c := range n.Nodes {
+			if _, ok := c.(*CaseExpr); !ok {
+				return fmt.Errorf("ast: SwitchExpr at %d holds a node other "+
+					"than a CaseExpr", n.Pos())
+			}
+		}
+	case *TestExpr:
+		e, s = &n.Expression, n.Scope
+	case *UserExpr:
+		e = &n.Expression
+		d, ok := s.Lookup(n.Name).(*DefineExpr)
+		if !ok {
+			return fmt.Errorf("ast: UserExpr at %d calls undeclared function %s",
+				n.Pos(), n.Name)
+		}
+		if len(n.Nodes) != len(d.Args) {
+			return fmt.Errorf("ast: UserExpr at %d passes %d arguments to %s, "+
+				"which takes %d", n.Pos(), len(n.Nodes), n.Name, len(d.Args))
+		}
+	default:
+		return fmt.Errorf("ast: unexpected %s at %d", kindOf(n), n.Pos())
+	}
+	if min, max := arity(n); len(e.Nodes) < min ||
+		max >= 0 && len(e.Nodes) > max {
+		return fmt.Errorf("ast: %s at %d holds %d nodes", kindOf(n), n.Pos(),
+			len(e.Nodes))
+	}
+	for i, c := range e.Nodes {
+		if c == nil {
+			if _, ok := n.(*IfExpr); ok && i == 2 {
+				continue // an if without an else
+			}
+			return fmt.Errorf("ast: %s at %d holds a null node", kindOf(n),
+				n.Pos())
+		}
+		if err := valid(c, s, n.Pos(), n.End()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// declare adds the names declared by n to s, and builds the scopes of any
+// defines within it, as the parser does.
+func declare(s *Scope, n Node) {
+	switch n := n.(type) {
+	case nil:
+		return
+	case *DefineExpr:
+		n.Scope = NewScope(s)
+		for _, a := range n.Args {
+			n.Scope.Insert(a, n)
+		}
+		s.Insert(n.Name, n)
+		s = n.Scope
+	case *TestExpr:
+		n.Scope = NewScope(s)
+		s = n.Scope
+	case *SetExpr:
+		declare(s, n.Value)
+		s.Insert(n.Name, n.Value)
+		return
+	}
+	Inspect(n, func(c Node) bool {
+		if c != nil && c != n {
+			declare(s, c)
+			return false
+		}
+		return c == n
+	})
+}
+
+func (n *Identifier) MarshalJSON() ([]byte, error)      { return marshal(n) }
+func (n *Number) MarshalJSON() ([]byte, error)          { return marshal(n) }
+func (n *String) MarshalJSON() ([]byte, error)          { return marshal(n) }
+func (n *Operator) MarshalJSON() ([]byte, error)        { return marshal(n) }
+func (n *Comment) MarshalJSON() ([]byte, error)         { return marshal(n) }
+func (n *CommentGroup) MarshalJSON() ([]byte, error)    { return marshal(n) }
+func (n *Expression) MarshalJSON() ([]byte, error)      { return marshal(n) }
+func (n *AssertEqualExpr) MarshalJSON() ([]byte, error) { return marshal(n) }
+func (n *AssertExpr) MarshalJSON() ([]byte, error)      { return marshal(n) }
+func (n *CaseExpr) MarshalJSON() ([]byte, error)        { return marshal(n) }
+func (n *CompExpr) MarshalJSON() ([]byte, error)        { return marshal(n) }
+func (n *ConcatExpr) MarshalJSON() ([]byte, error)      { return marshal(n) }
+func (n *ConvExpr) MarshalJSON() ([]byte, error)        { return marshal(n) }
+func (n *DefineExpr) MarshalJSON() ([]byte, error)      { return marshal(n) }
+func (n *IfExpr) MarshalJSON() ([]byte, error)          { return marshal(n) }
+func (n *ImportExpr) MarshalJSON() ([]byte, error)      { return marshal(n) }
+func (n *MathExpr) MarshalJSON() ([]byte, error)        { return marshal(n) }
+func (n *PredExpr) MarshalJSON() ([]byte, error)        { return marshal(n) }
+func (n *PrintExpr) MarshalJSON() ([]byte, error)       { return marshal(n) }
+func (n *SetExpr) MarshalJSON() ([]byte, error)         { return marshal(n) }
+func (n *SwitchExpr) MarshalJSON() ([]byte, error)      { return marshal(n) }
+func (n *TestExpr) MarshalJSON() ([]byte, error)        { return marshal(n) }
+func (n *UserExpr) MarshalJSON() ([]byte, error)        { return marshal(n) }
+func (n *File) MarshalJSON() ([]byte, error)            { return marshal(n) }
+
+func (n *Identifier) UnmarshalJSON(data []byte) error      { return unmarshal(data, n) }
+func (n *Number) UnmarshalJSON(data []byte) error          { return unmarshal(data, n) }
+func (n *String) UnmarshalJSON(data []byte) error          { return unmarshal(data, n) }
+func (n *Operator) UnmarshalJSON(data []byte) error        { return unmarshal(data, n) }
+func (n *Comment) UnmarshalJSON(data []byte) error         { return unmarshal(data, n) }
+func (n *CommentGroup) UnmarshalJSON(data []byte) error    { return unmarshal(data, n) }
+func (n *Expression) UnmarshalJSON(data []byte) error      { return unmarshal(data, n) }
+func (n *AssertEqualExpr) UnmarshalJSON(data []byte) error { return unmarshal(data, n) }
+func (n *AssertExpr) UnmarshalJSON(data []byte) error      { return unmarshal(data, n) }
+func (n *CaseExpr) UnmarshalJSON(data []byte) error        { return unmarshal(data, n) }
+func (n *CompExpr) UnmarshalJSON(data []byte) error        { return unmarshal(data, n) }
+func (n *ConcatExpr) UnmarshalJSON(data []byte) error      { return unmarshal(data, n) }
+func (n *ConvExpr) UnmarshalJSON(data []byte) error        { return unmarshal(data, n) }
+func (n *DefineExpr) UnmarshalJSON(data []byte) error      { return unmarshal(data, n) }
+func (n *IfExpr) UnmarshalJSON(data []byte) error          { return unmarshal(data, n) }
+func (n *ImportExpr) UnmarshalJSON(data []byte) error      { return unmarshal(data, n) }
+func (n *MathExpr) UnmarshalJSON(data []byte) error        { return unmarshal(data, n) }
+func (n *PredExpr) UnmarshalJSON(data []byte) error        { return unmarshal(data, n) }
+func (n *PrintExpr) UnmarshalJSON(data []byte) error       { return unmarshal(data, n) }
+func (n *SetExpr) UnmarshalJSON(data []byte) error         { return unmarshal(data, n) }
+func (n *SwitchExpr) UnmarshalJSON(data []byte) error      { return unmarshal(data, n) }
+func (n *TestExpr) UnmarshalJSON(data []byte) error        { return unmarshal(data, n) }
+func (n *UserExpr) UnmarshalJSON(data []byte) error        { return unmarshal(data, n) }
+func (n *File) UnmarshalJSON(data []byte) error            { return unmarshal(data, n) }
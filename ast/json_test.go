@@ -0,0 +1,176 @@
+package ast_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rthornton128/gocalc/ast"
+	"github.com/rthornton128/gocalc/eval"
+	"github.com/rthornton128/gocalc/internal/testutil"
+	"github.com/rthornton128/gocalc/parser"
+	"github.com/rthornton128/gocalc/token"
+	"github.com/rthornton128/gocalc/trans"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// run evaluates and translates n, returning the output of each
+func run(t *testing.T, name, src string, n *ast.File) (string, string) {
+	evalOut := testutil.CaptureStdout(t, func() {
+		f := token.NewFile(name, src, 1)
+		res, err := eval.EvalTree(context.Background(), f, n, eval.Options{})
+		fmt.Println(res, err)
+	})
+	var c bytes.Buffer
+	transOut := testutil.CaptureStdout(t, func() {
+		trans.TransTree(&c, token.NewFile(name, src, 1), n)
+	})
+	return evalOut, c.String() + transOut
+}
+
+func TestJSONScripts(t *testing.T) {
+	names, err := filepath.Glob(filepath.Join("..", "scripts", "*.calc"))
+	if err != nil || len(names) == 0 {
+		t.Fatal("No scripts found:", err)
+	}
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src := string(data)
+		fset := token.NewFileSet()
+		f := fset.AddFile(name, src)
+		n := parser.ParseFile(f, src)
+		if f.NumErrors() > 0 {
+			t.Fatal(name, "- Unexpected errors:", f.Err())
+		}
+		enc, err := json.Marshal(n)
+		if err != nil {
+			t.Fatal(name, "- Marshal:", err)
+		}
+		d := new(ast.File)
+		if err := json.Unmarshal(enc, d); err != nil {
+			t.Fatal(name, "- Unmarshal:", err)
+		}
+		if again, _ := json.Marshal(d); !bytes.Equal(enc, again) {
+			t.Fatal(name, "- Encoding changed by a round trip")
+		}
+		var want, got bytes.Buffer
+		ast.Fprint(&want, fset, n)
+		ast.Fprint(&got, fset, d)
+		if got.String() != want.String() {
+			t.Log(name, "- Expected:", want.String())
+			t.Fatal(name, "- Got:", got.String())
+		}
+		wantEval, wantC := run(t, name, src, n)
+		gotEval, gotC := run(t, name, src, d)
+		if gotEval != wantEval || gotC != wantC {
+			t.Log(name, "- Expected:", wantEval, wantC)
+			t.Fatal(name, "- Got:", gotEval, gotC)
+		}
+	}
+}
+
+func TestJSONNodes(t *testing.T) {
+	var tests = []struct {
+		n    ast.Node // to decode into
+		data string
+		err  bool
+	}{
+		{new(ast.Number), `{"kind":"Number","pos":3,"lit":"42","val":42}`,
+			false},
+		{new(ast.SwitchExpr), `{"kind":"SwitchExpr","pos":1,"end":20,` +
+			`"pred":{"kind":"Identifier","pos":9,"lit":"a"},"nodes":[null]}`,
+			false},
+		{new(ast.TestExpr), `{"kind":"TestExpr","pos":1,"end":30,` +
+			`"name":"t","nodes":[{"kind":"AssertEqualExpr","pos":12,` +
+			`"end":29,"nodes":[{"kind":"Number","pos":26,"lit":"1",` +
+			`"val":1},{"kind":"Number","pos":28,"lit":"1","val":1}]}]}`,
+			false},
+		{new(ast.File), `{"kind":"Widget","pos":1}`, true},
+		{new(ast.File), `{"kind":"Number","pos":1,"lit":"1","val":1}`, true},
+		{new(ast.File), `{"kind":"File","pos":1,"end":4,` +
+			`"nodes":[{"kind":"Bogus"}]}`, true},
+		// trees the parser could not have produced
+		{new(ast.File), `{"kind":"File","pos":1,"end":6,` +
+			`"nodes":[{"kind":"CompExpr","pos":1,"end":5,"lit":"<"}]}`, true},
+		{new(ast.File), `{"kind":"File","pos":1,"end":9,` +
+			`"nodes":[{"kind":"IfExpr","pos":1,"end":8,` +
+			`"nodes":[{"kind":"Number","pos":5,"lit":"1","val":1}]}]}`, true},
+		{new(ast.File), `{"kind":"File","pos":1,"end":10,` +
+			`"nodes":[{"kind":"Number","pos":50,"lit":"1","val":1}]}`, true},
+		{new(ast.File), `{"kind":"File","pos":1,"end":12,` +
+			`"nodes":[{"kind":"PrintExpr","pos":1,"end":11,` +
+			`"nodes":[{"kind":"Number","pos":9,"lit":"123","val":123}]}]}`,
+			true},
+		{new(ast.File), `{"kind":"File","pos":1,"end":22,"nodes":[` +
+			`{"kind":"DefineExpr","pos":1,"end":15,"name":"f",` +
+			`"args":["x"],"nodes":[{"kind":"Identifier","pos":14,` +
+			`"lit":"x"}]},{"kind":"UserExpr","pos":17,"end":19,` +
+			`"name":"f"}]}`, true},
+		{new(ast.File), `{"kind":"File","pos":1,"end":22,"nodes":[` +
+			`{"kind":"DefineExpr","pos":1,"end":15,"name":"f",` +
+			`"args":["x"],"nodes":[{"kind":"Identifier","pos":14,` +
+			`"lit":"x"}]},{"kind":"UserExpr","pos":17,"end":21,` +
+			`"name":"f","nodes":[{"kind":"Number","pos":19,"lit":"1",` +
+			`"val":1}]}]}`, false},
+	}
+	for i, test := range tests {
+		err := json.Unmarshal([]byte(test.data), test.n)
+		if (err != nil) != test.err {
+			t.Fatal(i, "- Unexpected result:", err)
+		}
+		if err != nil {
+			continue
+		}
+		data, _ := json.Marshal(test.n)
+		if string(data) != test.data {
+			t.Log(i, "- Expected:", test.data)
+			t.Fatal(i, "- Got:", string(data))
+		}
+	}
+}
+
+func TestJSONSandbox(t *testing.T) {
+	src := "(print 1)"
+	f := token.NewFile("", src, 1)
+	n := parser.ParseFile(f, src)
+	data, _ := json.Marshal(n)
+	d := new(ast.File)
+	json.Unmarshal(data, d)
+	_, err := eval.EvalTree(context.Background(), token.NewFile("", src, 1),
+		d, eval.Options{Sandbox: true})
+	want := "Line: 1 Column: 1 - 'print' is not permitted: requires capability io"
+	if err == nil || err.Error() != want {
+		t.Log("Expected:", want)
+		t.Fatal("Got:", err)
+	}
+}
+
+func TestJSONOutsideFile(t *testing.T) {
+	src := "(print 1)"
+	data := `{"kind":"File","pos":1,"end":40,"nodes":[{"kind":"PrintExpr",` +
+		`"pos":30,"end":38,"nodes":[{"kind":"Number","pos":37,"lit":"1",` +
+		`"val":1}]}]}`
+	d := new(ast.File)
+	if err := json.Unmarshal([]byte(data), d); err != nil {
+		t.Fatal(err)
+	}
+	_, err := eval.EvalTree(context.Background(), token.NewFile("p.calc", src,
+		1), d, eval.Options{})
+	want := "positions of the tree lie outside p.calc"
+	if err == nil || err.Error() != want {
+		t.Log("Expected:", want)
+		t.Fatal("Got:", err)
+	}
+	var c bytes.Buffer
+	out := testutil.CaptureStdout(t, func() {
+		trans.TransTree(&c, token.NewFile("p.calc", src, 1), d)
+	})
+	if out != "Positions of the tree lie outside p.calc\n" || c.Len() != 0 {
+		t.Fatal("Unexpected translation:", out, c.String())
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+package ast
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/rthornton128/gocalc/token"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Fprint prints the tree rooted at n to w, one field to a line and indented
+// by depth. Each node is printed with its type and position, followed by
+// those of its fields which are set. Positions are printed as line:col if
+// fset contains them, or as offsets otherwise.
+//
+// Nodes which are referred to rather than contained, such as the Decl of an
+// Object or the entries of a Scope, are printed as their type and position.
+func Fprint(w io.Writer, fset *token.FileSet, n Node) error {
+	p := &printer{fset: fset}
+	p.text(p.node(n), 0)
+	_, err := w.Write(p.buf.Bytes())
+	return err
+}
+
+// FprintJSON prints the tree rooted at n to w as JSON, in the form of
+// Fprint. Each node is an object holding its type, position and fields, and
+// each reference an object holding the type and position of the node it
+// refers to.
+func FprintJSON(w io.Writer, fset *token.FileSet, n Node) error {
+	p := &printer{fset: fset}
+	p.json(p.node(n))
+	var out bytes.Buffer
+	if err := json.Indent(&out, p.buf.Bytes(), "", "  "); err != nil {
+		return err
+	}
+	out.WriteByte('\n')
+	_, err := out.WriteTo(w)
+	return err
+}
+
+var objKindNames = [...]string{
+	Bad: "Bad",
+	Arg: "Arg",
+	Fun: "Fun",
+	Var: "Var",
+}
+
+func (k ObjKind) String() string {
+	if k < 0 || int(k) >= len(objKindNames) {
+		return "ObjKind(" + strconv.Itoa(int(k)) + ")"
+	}
+	return objKindNames[k]
+}
+
+// A tree is a node, Object or Scope ready for printing. The values of its
+// fields are strings, ints, Stringers, positions, references, trees or lists
+// of them.
+// Only nodes have a position.
+type tree struct {
+	typ    string
+	pos    pos
+	fields []field
+}
+
+type field struct {
+	name string
+	val  interface{}
+}
+
+type pos string
+
+type ref struct {
+	typ string
+	pos pos
+}
+
+var posType = reflect.TypeOf(token.NoPos)
+
+type printer struct {
+	fset *token.FileSet
+	buf  bytes.Buffer
+}
+
+func (p *printer) pos(x token.Pos) pos {
+	if p.fset != nil {
+		if pp := p.fset.Position(x); pp.IsValid() {
+			return pos(fmt.Sprintf("%d:%d", pp.Line, pp.Column))
+		}
+	}
+	return pos(strconv.Itoa(int(x)))
+}
+
+func (p *printer) ref(n Node) interface{} {
+	if n == nil || reflect.ValueOf(n).IsNil() {
+		return nil
+	}
+	return ref{reflect.TypeOf(n).Elem().Name(), p.pos(n.Pos())}
+}
+
+func (p *printer) node(n Node) *tree {
+	v := reflect.ValueOf(n).Elem()
+	t := &tree{typ: v.Type().Name(), pos: p.pos(n.Pos())}
+	p.fields(t, v)
+	return t
+}
+
+// fields adds the exported fields of the struct v which are set to t,
+// including those of any embedded Expression. The position of the node
+// itself is not repeated.
+func (p *printer) fields(t *tree, v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		switch {
+		case f.Anonymous:
+			p.fields(t, v.Field(i))
+		case f.PkgPath == "": // exported
+			val := p.value(v.Field(i))
+			if val != nil && val != t.pos {
+				t.fields = append(t.fields, field{f.Name, val})
+			}
+		}
+	}
+}
+
+// value returns v ready for printing, or nil if it is not set
+func (p *printer) value(v reflect.Value) interface{} {
+	if v.Type() == posType {
+		return p.pos(token.Pos(v.Int()))
+	}
+	switch x := v.Interface().(type) {
+	case *Object:
+		if x == nil {
+			return nil
+		}
+		t := &tree{typ: "Object", fields: []field{
+			{"Kind", x.Kind}, {"Name", x.Name}}}
+		if r := p.ref(x.Decl); r != nil {
+			t.fields = append(t.fields, field{"Decl", r})
+		}
+		t.fields = append(t.fields, field{"Depth", x.Depth},
+			field{"Index", x.Index})
+		return t
+	case *Scope:
+		if x == nil {
+			return nil
+		}
+		return p.scope(x)
+	case Node:
+		if v.IsNil() {
+			return nil
+		}
+		return p.node(x)
+	}
+	switch v.Kind() {
+	case reflect.String:
+		if v.Len() == 0 {
+			return nil
+		}
+		return v.String()
+	case reflect.Int:
+		return int(v.Int())
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return nil
+		}
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			if e := v.Index(i); e.Kind() == reflect.String {
+				list[i] = e.String() // even if empty
+			} else {
+				list[i] = p.value(e)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// scope returns the names defined in s, each with the node it is bound to
+func (p *printer) scope(s *Scope) *tree {
+	t := &tree{typ: "Scope"}
+	names := make([]string, 0, len(s.defs))
+	for k := range s.defs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		var val interface{}
+		if n, ok := s.defs[k].(Node); ok {
+			val = p.ref(n)
+		}
+		t.fields = append(t.fields, field{k, val})
+	}
+	return t
+}
+
+/* Text */
+func (p *printer) text(x interface{}, depth int) {
+	switch x := x.(type) {
+	case *tree:
+		p.buf.WriteString(x.typ)
+		if x.pos != "" {
+			p.buf.WriteString(" " + string(x.pos))
+		}
+		if len(x.fields) == 0 {
+			p.buf.WriteString(" {}")
+			break
+		}
+		p.buf.WriteString(" {\n")
+		for _, f := range x.fields {
+			p.indent(depth + 1)
+			p.buf.WriteString(f.name + ": ")
+			p.text(f.val, depth+1)
+			p.buf.WriteByte('\n')
+		}
+		p.indent(depth)
+		p.buf.WriteByte('}')
+	case []interface{}:
+		if !containsTree(x) {
+			strs := make([]string, len(x))
+			for i, v := range x {
+				strs[i] = strconv.Quote(v.(string))
+			}
+			p.buf.WriteString("[" + strings.Join(strs, ", ") + "]")
+			break
+		}
+		p.buf.WriteString("[\n")
+		for _, v := range x {
+			p.indent(depth + 1)
+			p.text(v, depth+1)
+			p.buf.WriteByte('\n')
+		}
+		p.indent(depth)
+		p.buf.WriteByte(']')
+	case ref:
+		p.buf.WriteString(x.typ + " " + string(x.pos))
+	case pos:
+		p.buf.WriteString(string(x))
+	case fmt.Stringer:
+		p.buf.WriteString(x.String())
+	case string:
+		p.buf.WriteString(strconv.Quote(x))
+	case int:
+		p.buf.WriteString(strconv.Itoa(x))
+	case nil:
+		p.buf.WriteString("nil")
+	}
+	if depth == 0 {
+		p.buf.WriteByte('\n')
+	}
+}
+
+func containsTree(list []interface{}) bool {
+	for _, v := range list {
+		if _, ok := v.(string); !ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *printer) indent(depth int) {
+	p.buf.WriteString(strings.Repeat("  ", depth))
+}
+
+/* JSON */
+func (p *printer) json(x interface{}) {
+	switch x := x.(type) {
+	case *tree:
+		p.buf.WriteString(`{"type":`)
+		p.json(x.typ)
+		if x.pos != "" {
+			p.buf.WriteString(`,"pos":`)
+			p.json(string(x.pos))
+		}
+		for _, f := range x.fields {
+			p.buf.WriteByte(',')
+			p.json(f.name)
+			p.buf.WriteByte(':')
+			p.json(f.val)
+		}
+		p.buf.WriteByte('}')
+	case []interface{}:
+		p.buf.WriteByte('[')
+		for i, v := range x {
+			if i > 0 {
+				p.buf.WriteByte(',')
+			}
+			p.json(v)
+		}
+		p.buf.WriteByte(']')
+	case ref:
+		p.buf.WriteString(`{"ref":`)
+		p.json(x.typ)
+		p.buf.WriteString(`,"pos":`)
+		p.json(string(x.pos))
+		p.buf.WriteByte('}')
+	case pos:
+		p.json(string(x))
+	case fmt.Stringer:
+		p.json(x.String())
+	case nil:
+		p.buf.WriteString("null")
+	default: // string or int
+		data, _ := json.Marshal(x)
+		p.buf.Write(data)
+	}
+}
@@ -0,0 +1,124 @@
+package ast_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/rthornton128/gocalc/ast"
+	"github.com/rthornton128/gocalc/parser"
+	"github.com/rthornton128/gocalc/resolve"
+	"github.com/rthornton128/gocalc/token"
+	"testing"
+)
+
+func TestFprint(t *testing.T) {
+	var tests = []struct {
+		src, want string
+	}{
+		{"(print \"hi\")", `File 1:1 {
+  Nodes: [
+    PrintExpr 1:1 {
+      RParen: 1:12
+      Nodes: [
+        String 1:8 {
+          Lit: "\"hi\""
+        }
+      ]
+    }
+  ]
+  Scope: Scope {}
+  NumSlots: 0
+}
+`},
+		{"(define (f x)\n  (set y x))", `File 1:1 {
+  Nodes: [
+    DefineExpr 1:1 {
+      RParen: 2:12
+      Nodes: [
+        SetExpr 2:3 {
+          RParen: 2:11
+          Name: "y"
+          Value: Identifier 2:10 {
+            Lit: "x"
+            Obj: Object {
+              Kind: Arg
+              Name: "x"
+              Decl: DefineExpr 1:1
+              Depth: 1
+              Index: 0
+            }
+          }
+          Obj: Object {
+            Kind: Var
+            Name: "y"
+            Decl: SetExpr 2:3
+            Depth: 1
+            Index: 1
+          }
+        }
+      ]
+      Scope: Scope {
+        x: DefineExpr 1:1
+        y: Identifier 2:10
+      }
+      Name: "f"
+      Args: ["x"]
+      ArgTypes: [""]
+      Obj: Object {
+        Kind: Fun
+        Name: "f"
+        Decl: DefineExpr 1:1
+        Depth: 0
+        Index: 0
+      }
+      NumSlots: 2
+    }
+  ]
+  Scope: Scope {
+    f: DefineExpr 1:1
+  }
+  NumSlots: 0
+}
+`},
+	}
+	for i, test := range tests {
+		fset := token.NewFileSet()
+		f := fset.AddFile("", test.src)
+		n := parser.ParseFile(f, test.src)
+		resolve.File(f, n)
+		var buf bytes.Buffer
+		ast.Fprint(&buf, fset, n)
+		if buf.String() != test.want {
+			t.Log(i, "- Expected:", test.want)
+			t.Fatal(i, "- Got:", buf.String())
+		}
+	}
+}
+
+func TestFprintJSON(t *testing.T) {
+	fset := token.NewFileSet()
+	f := fset.AddFile("", walkSrc)
+	n := parser.ParseFile(f, walkSrc)
+	var buf bytes.Buffer
+	if err := ast.FprintJSON(&buf, fset, n); err != nil {
+		t.Fatal(err)
+	}
+	var tree struct {
+		Type  string
+		Pos   string
+		Nodes []struct {
+			Type   string
+			Pos    string
+			RParen string
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &tree); err != nil {
+		t.Fatal(err)
+	}
+	if tree.Type != "File" || len(tree.Nodes) != 4 {
+		t.Fatal("Unexpected tree:", buf.String())
+	}
+	s := tree.Nodes[2]
+	if s.Type != "SwitchExpr" || s.Pos != "1:55" || s.RParen != "1:87" {
+		t.Fatal("Unexpected switch:", s)
+	}
+}
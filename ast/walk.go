@@ -0,0 +1,106 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+package ast
+
+import "fmt"
+
+// A Visitor's Visit method is invoked for each node encountered by Walk.
+// If the result visitor w is not nil, Walk visits each of the children of
+// node with the visitor w, followed by a call of w.Visit(nil).
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+func walkList(v Visitor, list []Node) {
+	for _, n := range list {
+		if n != nil { // such as the missing else clause of an if
+			Walk(v, n)
+		}
+	}
+}
+
+// Walk traverses an AST in depth-first order: It starts by calling
+// v.Visit(node); node must not be nil. If the visitor w returned by
+// v.Visit(node) is not nil, Walk is invoked recursively with visitor w for
+// each of the non-nil children of node, followed by a call of w.Visit(nil).
+func Walk(v Visitor, node Node) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+
+	switch n := node.(type) {
+	case *Identifier, *Number, *String, *Operator, *Comment:
+		// nothing to do
+	case *CommentGroup:
+		for _, c := range n.List {
+			Walk(v, c)
+		}
+	case *Expression:
+		walkList(v, n.Nodes)
+	case *AssertEqualExpr:
+		walkList(v, n.Nodes)
+	case *AssertExpr:
+		walkList(v, n.Nodes)
+	case *CaseExpr:
+		walkList(v, n.Nodes)
+	case *CompExpr:
+		walkList(v, n.Nodes)
+	case *ConcatExpr:
+		walkList(v, n.Nodes)
+	case *ConvExpr:
+		walkList(v, n.Nodes)
+	case *DefineExpr:
+		walkList(v, n.Nodes)
+	case *IfExpr:
+		walkList(v, n.Nodes)
+	case *ImportExpr:
+		walkList(v, n.Nodes)
+	case *MathExpr:
+		walkList(v, n.Nodes)
+	case *PredExpr:
+		walkList(v, n.Nodes)
+	case *PrintExpr:
+		walkList(v, n.Nodes)
+	case *SetExpr:
+		if n.Value != nil {
+			Walk(v, n.Value)
+		}
+	case *SwitchExpr:
+		if n.Pred != nil {
+			Walk(v, n.Pred)
+		}
+		walkList(v, n.Nodes)
+	case *TestExpr:
+		walkList(v, n.Nodes)
+	case *UserExpr:
+		walkList(v, n.Nodes)
+	case *File:
+		walkList(v, n.Nodes)
+	default:
+		panic(fmt.Sprintf("ast.Walk: unexpected node type %T", n))
+	}
+
+	v.Visit(nil)
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses an AST in depth-first order: It starts by calling
+// f(node); node must not be nil. If f returns true, Inspect invokes f
+// recursively for each of the non-nil children of node, followed by a call
+// of f(nil).
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
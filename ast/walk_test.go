@@ -0,0 +1,77 @@
+package ast_test
+
+import (
+	"fmt"
+	"github.com/rthornton128/gocalc/ast"
+	"github.com/rthornton128/gocalc/parser"
+	"github.com/rthornton128/gocalc/token"
+	"testing"
+)
+
+const walkSrc = "(set a 1) (define (f x) (define (g y) (+ x y)) (g 2)) " +
+	"(switch a (case 1 (print \"one\"))) (if (< a 2) (f a))"
+
+func parse(t *testing.T, src string) *ast.File {
+	f := token.NewFile("", src, 1)
+	n := parser.ParseFile(f, src)
+	if f.NumErrors() > 0 {
+		t.Fatal(f.Err())
+	}
+	return n
+}
+
+func TestInspect(t *testing.T) {
+	want := []string{"File", "SetExpr", "Number", "DefineExpr", "DefineExpr",
+		"MathExpr", "Identifier", "Identifier", "UserExpr", "Number",
+		"SwitchExpr", "Identifier", "CaseExpr", "Number", "PrintExpr", "String",
+		"IfExpr", "CompExpr", "Identifier", "Number", "UserExpr", "Identifier"}
+	var got []string
+	ast.Inspect(parse(t, walkSrc), func(n ast.Node) bool {
+		if n != nil {
+			got = append(got, fmt.Sprintf("%T", n)[len("*ast."):])
+		}
+		return true
+	})
+	if len(got) != len(want) {
+		t.Fatal("Expected:", want, "Got:", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Log(i, "- Expected:", want[i])
+			t.Fatal(i, "- Got:", got[i])
+		}
+	}
+}
+
+func TestInspectPrune(t *testing.T) {
+	defines := 0
+	ast.Inspect(parse(t, walkSrc), func(n ast.Node) bool {
+		if _, ok := n.(*ast.DefineExpr); ok {
+			defines++
+			return false
+		}
+		return true
+	})
+	if defines != 1 {
+		t.Fatal("Expected nested define to be skipped, got defines:", defines)
+	}
+}
+
+type counter struct{ nodes, nils int }
+
+func (c *counter) Visit(n ast.Node) ast.Visitor {
+	if n == nil {
+		c.nils++
+	} else {
+		c.nodes++
+	}
+	return c
+}
+
+func TestWalk(t *testing.T) {
+	c := new(counter)
+	ast.Walk(c, parse(t, walkSrc))
+	if c.nodes != 22 || c.nils != c.nodes {
+		t.Fatal("Expected 22 nodes each followed by nil, got:", c.nodes, c.nils)
+	}
+}
@@ -0,0 +1,438 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+// Package compile lowers a parsed Calc file to bytecode for the vm package.
+//
+// Every name is accessed through the slot assigned to it by the resolve
+// package. Arguments and variables set inside a function live in the local
+// slots of that function's frame, top level variables live in global slots
+// and variables of an enclosing function are reached by following static
+// links.
+package compile
+
+import (
+	"fmt"
+	"github.com/rthornton128/gocalc/ast"
+	"github.com/rthornton128/gocalc/resolve"
+	"github.com/rthornton128/gocalc/token"
+	"github.com/rthornton128/gocalc/types"
+)
+
+// Program is a compiled Calc file.
+type Program struct {
+	File      *token.File
+	Main      *Function   // top level code
+	Functions []*Function // user defined functions, indexed by OpCall
+	Globals   []string    // names of the global slots
+}
+
+// Function is the bytecode for a single user defined function or for the
+// top level code of a file.
+type Function struct {
+	Name      string
+	Level     int // lexical nesting depth; 0 for top level code
+	NumArgs   int
+	NumLocals int           // including arguments
+	Code      []byte        // instructions
+	Pos       []token.Pos   // source position of each byte of Code
+	Consts    []interface{} // constant pool of int and string values
+}
+
+// Compile resolves, type checks and compiles a file produced by the parser
+// without errors. Errors are recorded in f and also returned as a
+// token.ErrorList.
+func Compile(f *token.File, n *ast.File) (*Program, error) {
+	resolve.File(f, n)
+	var info *types.Info
+	if f.NumErrors() == 0 {
+		info = types.Check(f, n)
+	}
+	if f.NumErrors() > 0 {
+		return nil, f.Err()
+	}
+	main := &Function{Name: "main"}
+	c := &compiler{file: f, info: info, prog: &Program{File: f, Main: main},
+		fn: main, funcs: make(map[*ast.DefineExpr]int)}
+	c.prog.Globals = make([]string, n.NumSlots)
+	for i, node := range n.Nodes {
+		c.compile(node)
+		if i < len(n.Nodes)-1 {
+			c.emit(OpPop, n.Pos())
+		}
+	}
+	if len(n.Nodes) == 0 {
+		c.emit(OpNil, n.Pos())
+	}
+	c.emit(OpReturn, n.Pos())
+	if f.NumErrors() > 0 {
+		return nil, f.Err()
+	}
+	return c.prog, nil
+}
+
+type compiler struct {
+	file  *token.File
+	info  *types.Info
+	prog  *Program
+	fn    *Function // function being compiled
+	funcs map[*ast.DefineExpr]int
+}
+
+func (c *compiler) error(p token.Pos, args ...interface{}) {
+	c.file.AddError(p, args...)
+}
+
+/* Emitting */
+func (c *compiler) emit(op Opcode, p token.Pos, operands ...int) int {
+	off := len(c.fn.Code)
+	c.fn.Code = append(c.fn.Code, byte(op))
+	for _, o := range operands {
+		if o < 0 || o > 0xffff {
+			c.error(p, "Operand out of range: ", o)
+		}
+		c.fn.Code = append(c.fn.Code, byte(o>>8), byte(o))
+	}
+	for len(c.fn.Pos) < len(c.fn.Code) {
+		c.fn.Pos = append(c.fn.Pos, p)
+	}
+	return off
+}
+
+func (c *compiler) emitConst(v interface{}, p token.Pos) {
+	for i, k := range c.fn.Consts {
+		if k == v {
+			c.emit(OpConst, p, i)
+			return
+		}
+	}
+	c.fn.Consts = append(c.fn.Consts, v)
+	c.emit(OpConst, p, len(c.fn.Consts)-1)
+}
+
+// localConstOps maps the binary operators which have a form taking a local
+// and a constant, the commonest operands of a test or a step of recursion,
+// to that form
+var localConstOps = map[Opcode]Opcode{
+	OpAdd: OpAddLK, OpSub: OpSubLK, OpEq: OpEqLK, OpNeq: OpNeqLK,
+	OpLt: OpLtLK, OpLte: OpLteLK, OpGt: OpGtLK, OpGte: OpGteLK,
+}
+
+// emitLocalConst emits op applied to x and y as a single instruction if x
+// is a local and y a number small enough to be an operand, as in (- n 1),
+// reporting whether it did so
+func (c *compiler) emitLocalConst(op Opcode, x, y ast.Node,
+	p token.Pos) bool {
+	lk, ok := localConstOps[op]
+	i, isLocal := x.(*ast.Identifier)
+	num, isNum := y.(*ast.Number)
+	if !ok || !isLocal || !isNum || num.Val < 0 || num.Val > 0xffff ||
+		i.Obj == nil || i.Obj.Kind == ast.Fun || i.Obj.Depth == 0 ||
+		i.Obj.Depth != c.fn.Level {
+		return false
+	}
+	c.emit(lk, p, i.Obj.Index, num.Val)
+	return true
+}
+
+// emitJump emits a jump with a target to be filled in later by patch
+func (c *compiler) emitJump(op Opcode, p token.Pos) int {
+	return c.emit(op, p, 0)
+}
+
+func (c *compiler) patch(off int) {
+	target := len(c.fn.Code)
+	c.fn.Code[off+1] = byte(target >> 8)
+	c.fn.Code[off+2] = byte(target)
+}
+
+/* Compilation */
+func (c *compiler) compile(n ast.Node) {
+	if n == nil {
+		c.emit(OpNil, token.NoPos)
+		return
+	}
+	switch node := n.(type) {
+	case *ast.AssertEqualExpr:
+		c.compile(node.Nodes[0])
+		c.compile(node.Nodes[1])
+		c.emit(OpAssertEqual, node.Pos())
+	case *ast.AssertExpr:
+		t, _ := types.Lookup(node.Type)
+		c.compile(node.Nodes[0])
+		c.emit(OpAssert, node.Pos(), int(t))
+	case *ast.CaseExpr:
+		// only reached for a case outside of a switch, which the parser
+		// does not produce
+		c.emit(OpNil, node.Pos())
+	case *ast.CompExpr:
+		c.compileCompExpr(node)
+	case *ast.ConcatExpr:
+		c.compileConcatExpr(node)
+	case *ast.ConvExpr:
+		c.compile(node.Nodes[0])
+		c.emit(OpConv, node.Pos(), int(types.Conversion(node.ConvLit)))
+	case *ast.DefineExpr:
+		c.compileDefineExpr(node)
+		c.emit(OpNil, node.Pos())
+	case *ast.TestExpr:
+		// tests are only run by the evaluator
+		c.emit(OpNil, node.Pos())
+	case *ast.Identifier:
+		c.compileIdentifier(node)
+	case *ast.IfExpr:
+		c.compileIfExpr(node)
+	case *ast.MathExpr:
+		c.compileMathExpr(node)
+	case *ast.Number:
+		c.emitConst(node.Val, node.Pos())
+	case *ast.PredExpr:
+		c.compilePredExpr(node)
+	case *ast.PrintExpr:
+		for _, v := range node.Nodes {
+			c.compile(v)
+		}
+		c.emit(OpPrint, node.Pos(), len(node.Nodes))
+	case *ast.SetExpr:
+		c.compile(node.Value)
+		c.compileStore(node.Obj, node.Pos())
+		c.emit(OpNil, node.Pos())
+	case *ast.String:
+		c.emitConst(node.Lit[1:len(node.Lit)-1], node.Pos())
+	case *ast.SwitchExpr:
+		c.compileSwitchExpr(node)
+	case *ast.UserExpr:
+		c.compileUserExpr(node)
+	default:
+		c.error(n.Pos(), "Unable to compile node: ", n)
+	}
+}
+
+func (c *compiler) compileCompExpr(ce *ast.CompExpr) {
+	var op Opcode
+	switch ce.CompLit {
+	case "<":
+		op = OpLt
+	case "<=":
+		op = OpLte
+	case "<>":
+		op = OpNeq
+	case ">":
+		op = OpGt
+	case ">=":
+		op = OpGte
+	default:
+		op = OpEq
+	}
+	if c.emitLocalConst(op, ce.Nodes[0], ce.Nodes[1], ce.Pos()) {
+		return
+	}
+	c.compile(ce.Nodes[0])
+	c.compile(ce.Nodes[1])
+	c.emit(op, ce.Pos())
+}
+
+func (c *compiler) compileConcatExpr(ce *ast.ConcatExpr) {
+	for _, n := range ce.Nodes {
+		if num, ok := n.(*ast.Number); ok {
+			c.emitConst(num.Lit, num.Pos())
+			continue
+		}
+		c.compile(n)
+	}
+	c.emit(OpConcat, ce.Pos(), len(ce.Nodes))
+}
+
+func (c *compiler) compileDefineExpr(d *ast.DefineExpr) {
+	fn := &Function{
+		Name:      d.Name,
+		Level:     d.Obj.Depth + 1,
+		NumArgs:   len(d.Args),
+		NumLocals: d.NumSlots,
+	}
+	c.funcs[d] = len(c.prog.Functions)
+	c.prog.Functions = append(c.prog.Functions, fn)
+
+	outer := c.fn
+	c.fn = fn
+	// The first expression to produce a value is the function's result
+	for i, n := range d.Nodes {
+		c.compile(n)
+		if i < len(d.Nodes)-1 {
+			c.emit(OpReturnValue, n.Pos())
+		}
+	}
+	if len(d.Nodes) == 0 {
+		c.emit(OpNil, d.Pos())
+	}
+	c.emit(OpReturn, d.End())
+	c.fn = outer
+}
+
+func (c *compiler) compileIdentifier(i *ast.Identifier) {
+	obj := i.Obj
+	switch {
+	case obj == nil:
+		c.error(i.Pos(), "Unknown identifier: ", i.Lit)
+	case obj.Kind == ast.Fun:
+		c.emit(OpNil, i.Pos())
+	case obj.Depth == 0:
+		c.emit(OpGetGlobal, i.Pos(), obj.Index)
+	case obj.Depth == c.fn.Level:
+		c.emit(OpGetLocal, i.Pos(), obj.Index)
+	default:
+		c.emit(OpGetOuter, i.Pos(), c.fn.Level-obj.Depth, obj.Index)
+	}
+}
+
+func (c *compiler) compileIfExpr(ie *ast.IfExpr) {
+	c.compile(ie.Nodes[0])
+	jf := c.emitJump(OpJumpFalse, ie.Pos())
+	c.compile(ie.Nodes[1])
+	j := c.emitJump(OpJump, ie.Pos())
+	c.patch(jf)
+	c.compile(ie.Nodes[2]) // emits nil if there is no else clause
+	c.patch(j)
+}
+
+func (c *compiler) compileMathExpr(me *ast.MathExpr) {
+	var op Opcode
+	switch me.OpLit {
+	case "+":
+		op = OpAdd
+	case "-":
+		op = OpSub
+	case "*":
+		op = OpMul
+	case "/":
+		op = OpDiv
+	case "%":
+		op = OpMod
+	case "and":
+		op = OpAnd
+	case "or":
+		op = OpOr
+	default:
+		c.error(me.Pos(), "Unknown operator: ", me.OpLit)
+		return
+	}
+	if len(me.Nodes) == 2 &&
+		c.emitLocalConst(op, me.Nodes[0], me.Nodes[1], me.Pos()) {
+		return
+	}
+	for _, n := range me.Nodes {
+		c.compile(n)
+	}
+	c.emit(op, me.Pos(), len(me.Nodes))
+}
+
+var predTests = map[string]int{
+	"number?":   IsNumber,
+	"string?":   IsString,
+	"list?":     IsList,
+	"function?": IsFunction,
+}
+
+func (c *compiler) compilePredExpr(pe *ast.PredExpr) {
+	// functions are not values, so function? can only be given a name
+	if i, ok := pe.Nodes[0].(*ast.Identifier); ok && i.Obj != nil &&
+		i.Obj.Kind == ast.Fun {
+		if pe.PredLit == "function?" {
+			c.emitConst(1, pe.Pos())
+		} else {
+			c.emitConst(0, pe.Pos())
+		}
+		return
+	}
+	c.compile(pe.Nodes[0])
+	// a bool is an int at run time, so only its static type tells them apart
+	if pe.PredLit == "bool?" {
+		c.emit(OpPop, pe.Pos())
+		if c.info.TypeOf(pe.Nodes[0]) == types.Bool {
+			c.emitConst(1, pe.Pos())
+		} else {
+			c.emitConst(0, pe.Pos())
+		}
+		return
+	}
+	c.emit(OpIs, pe.Pos(), predTests[pe.PredLit])
+}
+
+func (c *compiler) compileStore(obj *ast.Object, p token.Pos) {
+	if obj.Depth == 0 {
+		c.prog.Globals[obj.Index] = obj.Name
+		c.emit(OpSetGlobal, p, obj.Index)
+	} else {
+		c.emit(OpSetLocal, p, obj.Index)
+	}
+}
+
+func (c *compiler) compileSwitchExpr(s *ast.SwitchExpr) {
+	var ends []int
+	if s.Pred != nil {
+		c.compile(s.Pred)
+	}
+	for _, n := range s.Nodes {
+		ce := n.(*ast.CaseExpr)
+		if s.Pred != nil {
+			c.emit(OpDup, ce.Pos())
+			c.compile(ce.Nodes[0])
+			c.emit(OpSame, ce.Pos())
+		} else {
+			c.compile(ce.Nodes[0])
+		}
+		next := c.emitJump(OpJumpFalse, ce.Pos())
+		for _, v := range ce.Nodes[1:] {
+			c.compile(v)
+			c.emit(OpPop, v.Pos())
+		}
+		ends = append(ends, c.emitJump(OpJump, ce.Pos()))
+		c.patch(next)
+	}
+	for _, j := range ends {
+		c.patch(j)
+	}
+	if s.Pred != nil {
+		c.emit(OpPop, s.Pos())
+	}
+	c.emit(OpNil, s.Pos())
+}
+
+func (c *compiler) compileUserExpr(u *ast.UserExpr) {
+	index, ok := c.funcs[u.Obj.Decl.(*ast.DefineExpr)]
+	if !ok {
+		c.error(u.Pos(), "Undeclared function: ", u.Name)
+		return
+	}
+	for _, n := range u.Nodes {
+		c.compile(n)
+	}
+	// number of static links to follow from the caller's frame to reach the
+	// frame of the function enclosing the callee
+	hops := c.fn.Level - u.Obj.Depth
+	c.emit(OpCall, u.Pos(), index, hops)
+}
+
+// Disassemble returns a human readable listing of fn's instructions.
+func Disassemble(fn *Function) string {
+	s := fmt.Sprintf("%s (args: %d, locals: %d)\n", fn.Name, fn.NumArgs,
+		fn.NumLocals)
+	for off := 0; off < len(fn.Code); {
+		op := Opcode(fn.Code[off])
+		s += fmt.Sprintf("%04d %s", off, op)
+		off++
+		for i := 0; i < op.Operands(); i++ {
+			s += fmt.Sprintf(" %d", int(fn.Code[off])<<8|int(fn.Code[off+1]))
+			off += 2
+		}
+		if op == OpConst {
+			s += fmt.Sprintf(" (%#v)", fn.Consts[int(fn.Code[off-2])<<8|
+				int(fn.Code[off-1])])
+		}
+		s += "\n"
+	}
+	return s
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+package compile
+
+// Opcode is a single bytecode instruction. Each opcode is followed in the
+// code by zero or more 16 bit, big endian operands.
+type Opcode byte
+
+const (
+	OpNil         Opcode = iota // push nil
+	OpConst                     // push Consts[a]
+	OpPop                       // discard the top of the stack
+	OpDup                       // duplicate the top of the stack
+	OpGetGlobal                 // push global a
+	OpSetGlobal                 // pop into global a
+	OpGetLocal                  // push local a
+	OpSetLocal                  // pop into local a
+	OpGetOuter                  // push local b of the frame a links out
+	OpAdd                       // pop a values, push their sum
+	OpSub                       // pop a values, push their difference
+	OpMul                       // pop a values, push their product
+	OpDiv                       // pop a values, push their quotient
+	OpMod                       // pop a values, push their remainder
+	OpAnd                       // pop a values, push their logical and
+	OpOr                        // pop a values, push their logical or
+	OpConcat                    // pop a values, push their concatenation
+	OpEq                        // pop two numbers, push a = b
+	OpNeq                       // pop two numbers, push a <> b
+	OpLt                        // pop two numbers, push a < b
+	OpLte                       // pop two numbers, push a <= b
+	OpGt                        // pop two numbers, push a > b
+	OpGte                       // pop two numbers, push a >= b
+	OpSame                      // pop two values, push 1 if equal else 0
+	OpJump                      // continue at a
+	OpJumpFalse                 // pop a value, continue at a if not true
+	OpCall                      // call function a with static link b hops out
+	OpReturn                    // return the top of the stack
+	OpReturnValue               // return the top of the stack if not nil
+	OpPrint                     // pop a values and print them
+	OpIs                        // pop a value, push 1 if it passes test a
+	OpConv                      // pop a value, push it converted to type a
+	OpAssert                    // fail unless the top of stack is of type a
+	OpAssertEqual               // pop two values, fail unless equal, push nil
+	OpAddLK                     // push local a + b
+	OpSubLK                     // push local a - b
+	OpEqLK                      // push local a = b
+	OpNeqLK                     // push local a <> b
+	OpLtLK                      // push local a < b
+	OpLteLK                     // push local a <= b
+	OpGtLK                      // push local a > b
+	OpGteLK                     // push local a >= b
+	op_end
+)
+
+// Type tests performed by OpIs
+const (
+	IsNumber = iota
+	IsString
+	IsList
+	IsFunction
+)
+
+var opNames = [...]string{
+	OpNil:         "NIL",
+	OpConst:       "CONST",
+	OpPop:         "POP",
+	OpDup:         "DUP",
+	OpGetGlobal:   "GETGLOBAL",
+	OpSetGlobal:   "SETGLOBAL",
+	OpGetLocal:    "GETLOCAL",
+	OpSetLocal:    "SETLOCAL",
+	OpGetOuter:    "GETOUTER",
+	OpAdd:         "ADD",
+	OpSub:         "SUB",
+	OpMul:         "MUL",
+	OpDiv:         "DIV",
+	OpMod:         "MOD",
+	OpAnd:         "AND",
+	OpOr:          "OR",
+	OpConcat:      "CONCAT",
+	OpEq:          "EQ",
+	OpNeq:         "NEQ",
+	OpLt:          "LT",
+	OpLte:         "LTE",
+	OpGt:          "GT",
+	OpGte:         "GTE",
+	OpSame:        "SAME",
+	OpJump:        "JUMP",
+	OpJumpFalse:   "JUMPFALSE",
+	OpCall:        "CALL",
+	OpReturn:      "RETURN",
+	OpReturnValue: "RETURNVALUE",
+	OpPrint:       "PRINT",
+	OpIs:          "IS",
+	OpConv:        "CONV",
+	OpAssert:      "ASSERT",
+	OpAssertEqual: "ASSERTEQUAL",
+	OpAddLK:       "ADDLK",
+	OpSubLK:       "SUBLK",
+	OpEqLK:        "EQLK",
+	OpNeqLK:       "NEQLK",
+	OpLtLK:        "LTLK",
+	OpLteLK:       "LTELK",
+	OpGtLK:        "GTLK",
+	OpGteLK:       "GTELK",
+}
+
+func (op Opcode) String() string {
+	if op < op_end {
+		return opNames[op]
+	}
+	return "UNKNOWN"
+}
+
+// Operands returns the number of 16 bit operands following op.
+func (op Opcode) Operands() int {
+	switch op {
+	case OpConst, OpGetGlobal, OpSetGlobal, OpGetLocal, OpSetLocal,
+		OpAdd, OpSub, OpMul, OpDiv, OpMod, OpAnd, OpOr, OpConcat,
+		OpJump, OpJumpFalse, OpPrint, OpIs, OpConv, OpAssert:
+		return 1
+	case OpGetOuter, OpCall, OpAddLK, OpSubLK, OpEqLK, OpNeqLK, OpLtLK,
+		OpLteLK, OpGtLK, OpGteLK:
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,253 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+// Package cover measures which parts of a Calc program are evaluated.
+//
+// Every node evaluated is counted, but coverage is reported in terms of the
+// expressions which may or may not be reached: those in the body of the
+// file or of a function, the then and else branches of an if, and the
+// expressions of a case. Tests declared with deftest are not counted, as
+// they are not run. An expression is covered once it has been evaluated at
+// least once. The results may be printed as a report of each function and
+// line, written as a profile for other tools to read, or written as a page
+// of HTML showing the source.
+package cover
+
+import (
+	"context"
+	"fmt"
+	"github.com/rthornton128/gocalc/ast"
+	"github.com/rthornton128/gocalc/eval"
+	"github.com/rthornton128/gocalc/parser"
+	"github.com/rthornton128/gocalc/token"
+	"io"
+	"sort"
+)
+
+// Func holds the coverage of a user function, or of the file itself.
+type Func struct {
+	Name    string         // "<file>" for the file
+	Pos     token.Position // of the definition
+	Exprs   int            // number of expressions which may be covered
+	Covered int            // number of those evaluated
+}
+
+// Percent returns the percentage of the expressions of f covered.
+func (f *Func) Percent() float64 {
+	return percent(f.Covered, f.Exprs)
+}
+
+// Line holds the coverage of the expressions beginning on a line of source.
+type Line struct {
+	Line    int
+	Exprs   int
+	Covered int
+}
+
+// Percent returns the percentage of the expressions of l covered.
+func (l *Line) Percent() float64 {
+	return percent(l.Covered, l.Exprs)
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 100
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+// expr is an expression which may be covered
+type expr struct {
+	node ast.Node
+	fn   *Func
+}
+
+// Profile records the nodes of a file evaluated.
+type Profile struct {
+	name   string
+	src    string
+	file   *token.File
+	root   *ast.File
+	funcs  []*Func // the file, then each function in source order
+	exprs  []expr  // in source order
+	counts map[ast.Node]int
+}
+
+// New returns a Profile for the program src, read from the file name. It
+// returns any parse errors as a token.ErrorList.
+func New(name, src string) (*Profile, error) {
+	f := token.NewFile(name, src, 1)
+	n := parser.ParseFile(f, src)
+	if f.NumErrors() > 0 {
+		return nil, f.Err()
+	}
+	p := &Profile{name: name, src: src, file: f, root: n,
+		counts: make(map[ast.Node]int)}
+	file := &Func{Name: "<file>",
+		Pos: token.Position{Filename: name, Line: 1}}
+	p.funcs = []*Func{file}
+	ast.Walk(collector{p, file}, n)
+	sort.SliceStable(p.exprs, func(i, j int) bool {
+		return p.exprs[i].node.Pos() < p.exprs[j].node.Pos()
+	})
+	return p, nil
+}
+
+// collector finds the expressions which may be covered, fn being the
+// function enclosing them
+type collector struct {
+	p  *Profile
+	fn *Func
+}
+
+func (c collector) Visit(n ast.Node) ast.Visitor {
+	switch n := n.(type) {
+	case *ast.File:
+		c.add(n.Nodes)
+	case *ast.DefineExpr:
+		c.fn = &Func{Name: n.Name, Pos: c.p.file.Position(n.Pos())}
+		c.p.funcs = append(c.p.funcs, c.fn)
+		c.add(n.Nodes)
+	case *ast.IfExpr:
+		c.add(n.Nodes[1:])
+	case *ast.CaseExpr:
+		c.add(n.Nodes)
+	case *ast.ImportExpr, *ast.TestExpr:
+		return nil
+	}
+	return c
+}
+
+func (c collector) add(list []ast.Node) {
+	for _, n := range list {
+		switch n.(type) {
+		case nil, *ast.DefineExpr, *ast.ImportExpr, *ast.TestExpr:
+			continue
+		}
+		c.p.exprs = append(c.p.exprs, expr{n, c.fn})
+		c.fn.Exprs++
+	}
+}
+
+// Eval evaluates the program within the limits of opt, recording the nodes
+// evaluated. It may be called again to add to the coverage. Any hooks set
+// in opt are called after the profile's.
+func (p *Profile) Eval(ctx context.Context, opt eval.Options) (interface{},
+	error) {
+	debug := opt.Debug
+	opt.Debug = func(n ast.Node, st *eval.State) {
+		p.counts[n]++
+		if debug != nil {
+			debug(n, st)
+		}
+	}
+	return eval.EvalTree(ctx, p.file, p.root, opt)
+}
+
+// Count returns the number of times n has been evaluated.
+func (p *Profile) Count(n ast.Node) int {
+	return p.counts[n]
+}
+
+// Root returns the syntax tree of the program.
+func (p *Profile) Root() *ast.File {
+	return p.root
+}
+
+// Funcs returns the coverage of the file and of each function, in source
+// order.
+func (p *Profile) Funcs() []*Func {
+	for _, f := range p.funcs {
+		f.Covered = 0
+	}
+	for _, x := range p.exprs {
+		if p.counts[x.node] > 0 {
+			x.fn.Covered++
+		}
+	}
+	return p.funcs
+}
+
+// Lines returns the coverage of each line on which an expression which may
+// be covered begins, in source order.
+func (p *Profile) Lines() []*Line {
+	var list []*Line
+	for _, x := range p.exprs {
+		n := p.file.Line(x.node.Pos())
+		if len(list) == 0 || list[len(list)-1].Line != n {
+			list = append(list, &Line{Line: n})
+		}
+		l := list[len(list)-1]
+		l.Exprs++
+		if p.counts[x.node] > 0 {
+			l.Covered++
+		}
+	}
+	return list
+}
+
+// Percent returns the percentage of all expressions covered.
+func (p *Profile) Percent() float64 {
+	covered := 0
+	for _, x := range p.exprs {
+		if p.counts[x.node] > 0 {
+			covered++
+		}
+	}
+	return percent(covered, len(p.exprs))
+}
+
+// WriteReport writes a table of the coverage of the functions and lines to
+// w.
+func (p *Profile) WriteReport(w io.Writer) {
+	fmt.Fprintf(w, "Coverage: %.1f%% of %d expressions\n\n", p.Percent(),
+		len(p.exprs))
+	fmt.Fprintf(w, "%6s %8s %7s  %s\n", "exprs", "covered", "cover",
+		"function")
+	for _, f := range p.Funcs() {
+		fmt.Fprintf(w, "%6d %8d %6.1f%%  %s (%s:%d)\n", f.Exprs, f.Covered,
+			f.Percent(), f.Name, f.Pos.Filename, f.Pos.Line)
+	}
+	fmt.Fprintf(w, "\n%6s %8s %7s  %s\n", "exprs", "covered", "cover", "line")
+	for _, l := range p.Lines() {
+		fmt.Fprintf(w, "%6d %8d %6.1f%%  %s:%d\n", l.Exprs, l.Covered,
+			l.Percent(), p.name, l.Line)
+	}
+}
+
+// end returns the position following n
+func end(n ast.Node) token.Pos {
+	switch n.(type) {
+	case *ast.Identifier, *ast.Number, *ast.String, *ast.Operator:
+		return n.End()
+	}
+	return n.End() + 1 // the End of an expression is its closing paren
+}
+
+// WriteProfile writes the coverage to w in the text format of go test
+// -coverprofile. After a "mode: count" line, each expression which may be
+// covered is written on a line of its own as
+//
+//	name:line.column,line.column 1 count
+//
+// giving the positions of its first character and of that following it,
+// and the number of times it was evaluated.
+func (p *Profile) WriteProfile(w io.Writer) error {
+	if _, err := fmt.Fprintln(w, "mode: count"); err != nil {
+		return err
+	}
+	for _, x := range p.exprs {
+		beg := p.file.Position(x.node.Pos())
+		last := p.file.Position(end(x.node) - 1)
+		_, err := fmt.Fprintf(w, "%s:%d.%d,%d.%d 1 %d\n", p.name, beg.Line,
+			beg.Column, last.Line, last.Column+1, p.counts[x.node])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package cover_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/rthornton128/gocalc/cover"
+	"github.com/rthornton128/gocalc/eval"
+	"strings"
+	"testing"
+)
+
+const src = `(define (sign x)
+	(if (< x 0) -1 1))
+(define (name n)
+	(switch
+		(case (= n 1) (print "one"))
+		(case (= n 2) (print "two"))))
+(define (unused)
+	(print "never"))
+(print (sign 3))
+(name 2)
+`
+
+func run(t *testing.T) *cover.Profile {
+	p, err := cover.New("c.calc", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	_, err = p.Eval(context.Background(), eval.Options{Stdout: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "1\ntwo\n" {
+		t.Fatal("Unexpected output:", out.String())
+	}
+	return p
+}
+
+func TestCoverage(t *testing.T) {
+	p := run(t)
+	var tests = []struct {
+		name                 string
+		line, exprs, covered int
+	}{
+		{"<file>", 1, 2, 2},
+		{"sign", 1, 3, 2},
+		{"name", 3, 5, 4},
+		{"unused", 7, 1, 0},
+	}
+	funcs := p.Funcs()
+	if len(funcs) != len(tests) {
+		t.Fatal("Expected", len(tests), "functions, got:", len(funcs))
+	}
+	for i, test := range tests {
+		f := funcs[i]
+		if f.Name != test.name || f.Pos.Line != test.line ||
+			f.Exprs != test.exprs || f.Covered != test.covered {
+			t.Log(i, "- Expected:", test)
+			t.Fatal(i, "- Got:", f)
+		}
+	}
+	if got := p.Percent(); got != 800.0/11 {
+		t.Fatal("Expected 8 of 11 expressions covered, got:", got)
+	}
+
+	covered := make(map[int]float64)
+	for _, l := range p.Lines() {
+		covered[l.Line] = l.Percent()
+	}
+	if len(covered) != 7 || covered[2] != 200.0/3 || covered[4] != 100 ||
+		covered[5] != 50 || covered[6] != 100 || covered[8] != 0 ||
+		covered[9] != 100 || covered[10] != 100 {
+		t.Fatal("Unexpected coverage by line:", covered)
+	}
+
+	var buf bytes.Buffer
+	p.WriteReport(&buf)
+	if !strings.Contains(buf.String(), "Coverage: 72.7% of 11 expressions") ||
+		!strings.Contains(buf.String(), "0.0%  unused (c.calc:7)") {
+		t.Fatal("Unexpected report:", buf.String())
+	}
+}
+
+func TestWriteProfile(t *testing.T) {
+	var buf bytes.Buffer
+	if err := run(t).WriteProfile(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(buf.String(), "\n")
+	want := []string{
+		"mode: count",
+		"c.calc:2.2,2.19 1 1",
+		"c.calc:2.14,2.16 1 0",
+		"c.calc:2.17,2.18 1 1",
+		"c.calc:4.2,6.32 1 1",
+	}
+	for i, w := range want {
+		if i >= len(lines) || lines[i] != w {
+			t.Log(i, "- Expected:", w)
+			t.Fatal(i, "- Got:", lines)
+		}
+	}
+	if len(lines) != 13 || lines[10] != "c.calc:9.1,9.17 1 1" ||
+		lines[11] != "c.calc:10.1,10.9 1 1" {
+		t.Fatal("Unexpected profile:", buf.String())
+	}
+}
+
+func TestWriteHTML(t *testing.T) {
+	var buf bytes.Buffer
+	if err := run(t).WriteHTML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		`<span class="uncov" title="0">-1</span>`,
+		`<span class="uncov" title="0">(print &#34;one&#34;)</span>`,
+		`<span class="uncov" title="0">(print &#34;never&#34;)</span>`,
+		`<span class="lineno">   9</span>  <span class="cov" title="1">`,
+		"72.7% of 11 expressions covered",
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Fatal("Missing from HTML:", s, "\n", buf.String())
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+package cover
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+)
+
+const htmlHead = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+body { background: #fff; color: #000; font-family: sans-serif; }
+pre { font-family: monospace; }
+.lineno { color: #999; user-select: none; }
+.cov { background: #c8f0c8; }
+.uncov { background: #f8c8c8; }
+</style>
+</head>
+<body>
+<h1>%s</h1>
+<p>%.1f%% of %d expressions covered.
+<span class="cov">Evaluated</span> <span class="uncov">Not evaluated</span></p>
+<pre>
+`
+
+// WriteHTML writes the source of the program to w as a page of HTML, with
+// each expression which may be covered shaded according to whether it was
+// evaluated. Hovering over an expression shows the number of times.
+func (p *Profile) WriteHTML(w io.Writer) error {
+	// owner holds, for each byte of the source, one more than the index of
+	// the innermost expression enclosing it, or 0 if there is none. The
+	// expressions are in source order, so an outer one precedes those
+	// within it.
+	owner := make([]int, len(p.src))
+	base := int(p.file.Base())
+	for i, x := range p.exprs {
+		for off := int(x.node.Pos()) - base; off < int(end(x.node))-base &&
+			off < len(owner); off++ {
+			owner[off] = i + 1
+		}
+	}
+
+	b := bufio.NewWriter(w)
+	name := html.EscapeString(p.name)
+	fmt.Fprintf(b, htmlHead, name, name, p.Percent(), len(p.exprs))
+	line := 1
+	fmt.Fprintf(b, `<span class="lineno">%4d</span>  `, line)
+	for off := 0; off < len(p.src); {
+		// spans end with each line, so that line numbers may go between
+		next := off + 1
+		for p.src[off] != '\n' && next < len(p.src) &&
+			owner[next] == owner[off] && p.src[next] != '\n' {
+			next++
+		}
+		text := html.EscapeString(p.src[off:next])
+		if i := owner[off]; i > 0 && p.src[off] != '\n' {
+			n := p.counts[p.exprs[i-1].node]
+			class := "cov"
+			if n == 0 {
+				class = "uncov"
+			}
+			fmt.Fprintf(b, `<span class="%s" title="%d">%s</span>`, class, n,
+				text)
+		} else {
+			b.WriteString(text)
+		}
+		if p.src[next-1] == '\n' && next < len(p.src) {
+			line++
+			fmt.Fprintf(b, `<span class="lineno">%4d</span>  `, line)
+		}
+		off = next
+	}
+	b.WriteString("</pre>\n</body>\n</html>\n")
+	return b.Flush()
+}
@@ -0,0 +1,189 @@
+package dap_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/rthornton128/gocalc/dap"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const src = `(define (sq x)
+	(* x x))
+(set a 3)
+(print (sq a))
+(print (sq 4))
+`
+
+type message struct {
+	Type       string          `json:"type"`
+	RequestSeq int             `json:"request_seq"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message"`
+	Event      string          `json:"event"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// client drives a server, keeping the events it has yet to wait for
+type client struct {
+	t      *testing.T
+	w      io.Writer
+	r      *bufio.Reader
+	seq    int
+	events []message
+	output string
+}
+
+func (c *client) read() message {
+	line, err := c.r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "Content-Length: ") {
+		c.t.Fatal("Bad header:", line, err)
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[16:]))
+	c.r.ReadString('\n')
+	data := make([]byte, n)
+	io.ReadFull(c.r, data)
+	var m message
+	if err := json.Unmarshal(data, &m); err != nil {
+		c.t.Fatal(err)
+	}
+	if m.Event == "output" {
+		var o struct{ Output string }
+		json.Unmarshal(m.Body, &o)
+		c.output += o.Output
+	}
+	return m
+}
+
+// request sends a request and returns the response to it
+func (c *client) request(command, args string) message {
+	c.seq++
+	data := fmt.Sprintf(`{"seq":%d,"type":"request","command":%q,`+
+		`"arguments":%s}`, c.seq, command, args)
+	fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	for {
+		m := c.read()
+		if m.Type == "response" && m.RequestSeq == c.seq {
+			return m
+		}
+		c.events = append(c.events, m)
+	}
+}
+
+// event waits for an event called name, discarding any before it
+func (c *client) event(name string) message {
+	for len(c.events) > 0 {
+		m := c.events[0]
+		c.events = c.events[1:]
+		if m.Event == name {
+			return m
+		}
+	}
+	for {
+		if m := c.read(); m.Event == name {
+			return m
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prog := filepath.Join(dir, "sq.calc")
+	ioutil.WriteFile(prog, []byte(src), 0644)
+
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	served := make(chan error)
+	go func() {
+		served <- dap.Serve(inR, outW)
+		outW.Close()
+	}()
+	c := &client{t: t, w: inW, r: bufio.NewReader(outR)}
+
+	var tests = []struct {
+		command, args string
+		event         string // to wait for after the response
+		want          string // body of the response, or of the event
+	}{
+		{"initialize", `{"adapterID":"gocalc"}`, "",
+			`{"supportsConfigurationDoneRequest":true,` +
+				`"supportsEvaluateForHovers":true}`},
+		{"setBreakpoints", `{"source":{"path":"sq.calc"},` +
+			`"breakpoints":[{"line":2}]}`, "", ""},
+		{"launch", fmt.Sprintf(`{"program":%q}`, prog), "initialized", ``},
+		{"setBreakpoints", `{"source":{"path":"sq.calc"},` +
+			`"breakpoints":[{"line":1},{"line":2}]}`, "",
+			`{"breakpoints":[{"verified":false,"line":1,` +
+				`"message":"No expression on this line"},` +
+				`{"verified":true,"line":2}]}`},
+		{"configurationDone", `{}`, "stopped",
+			`{"reason":"breakpoint","threadId":1,"allThreadsStopped":true}`},
+		{"threads", `{}`, "", `{"threads":[{"id":1,"name":"main"}]}`},
+		{"stackTrace", `{"threadId":1}`, "",
+			`{"stackFrames":[{"id":0,"name":"sq",` +
+				`"source":{"name":"sq.calc","path":` + strconv.Quote(prog) +
+				`},"line":2,"column":2},{"id":1,"name":"sq.calc",` +
+				`"source":{"name":"sq.calc","path":` + strconv.Quote(prog) +
+				`},"line":4,"column":8}],"totalFrames":2}`},
+		{"scopes", `{"frameId":0}`, "",
+			`{"scopes":[{"name":"Locals","variablesReference":1,` +
+				`"expensive":false},{"name":"Globals",` +
+				`"variablesReference":2,"expensive":false}]}`},
+		{"variables", `{"variablesReference":1}`, "",
+			`{"variables":[{"name":"x","value":"3","variablesReference":0}]}`},
+		{"variables", `{"variablesReference":2}`, "",
+			`{"variables":[{"name":"a","value":"3","variablesReference":0}]}`},
+		{"evaluate", `{"expression":"a","frameId":0}`, "",
+			`{"result":"3","variablesReference":0}`},
+		{"evaluate", `{"expression":"y"}`, "", ""},
+		{"stepOut", `{"threadId":1}`, "stopped",
+			`{"reason":"step","threadId":1,"allThreadsStopped":true}`},
+		{"stackTrace", `{"threadId":1}`, "",
+			`{"stackFrames":[{"id":0,"name":"sq.calc",` +
+				`"source":{"name":"sq.calc","path":` + strconv.Quote(prog) +
+				`},"line":5,"column":1}],"totalFrames":1}`},
+		{"continue", `{"threadId":1}`, "stopped",
+			`{"reason":"breakpoint","threadId":1,"allThreadsStopped":true}`},
+		{"evaluate", `{"expression":"x"}`, "",
+			`{"result":"4","variablesReference":0}`},
+		{"continue", `{"threadId":1}`, "exited", `{"exitCode":0}`},
+		{"stackTrace", `{"threadId":1}`, "", ""},
+		{"disconnect", `{}`, "", ``},
+	}
+	for i, test := range tests {
+		r := c.request(test.command, test.args)
+		if test.want == "" && test.event == "" && test.command != "disconnect" {
+			if r.Success {
+				t.Fatal(i, "- Expected an error, got:", string(r.Body))
+			}
+			continue
+		}
+		got := string(r.Body)
+		if !r.Success {
+			t.Fatal(i, "- Unexpected error:", r.Message)
+		}
+		if test.event != "" {
+			got = string(c.event(test.event).Body)
+		}
+		if got != test.want {
+			t.Log(i, "- Expected:", test.want)
+			t.Fatal(i, "- Got:", got)
+		}
+	}
+	if err := <-served; err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if c.output != "9\n16\n" {
+		t.Fatal("Unexpected output:", c.output)
+	}
+}
@@ -0,0 +1,437 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+// Package dap implements a Debug Adapter Protocol server for Calc.
+//
+// The server speaks the protocol over a pair of streams, normally standard
+// input and output, and debugs a single program given by the launch
+// request. It has a single thread, whose stack frames are the active calls
+// of user defined functions. What the program prints is sent to the client
+// as output events.
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rthornton128/gocalc/debug"
+	"github.com/rthornton128/gocalc/eval"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const threadID = 1 // of the only thread
+
+type handler func(s *server, args json.RawMessage) (interface{}, error)
+
+var handlers = map[string]handler{
+	"initialize":        (*server).initialize,
+	"launch":            (*server).launch,
+	"setBreakpoints":    (*server).setBreakpoints,
+	"configurationDone": (*server).configurationDone,
+	"threads":           (*server).threads,
+	"stackTrace":        (*server).stackTrace,
+	"scopes":            (*server).scopes,
+	"variables":         (*server).variables,
+	"evaluate":          (*server).evaluate,
+	"continue":          resumeWith((*debug.Debugger).Continue),
+	"next":              resumeWith((*debug.Debugger).StepOver),
+	"stepIn":            resumeWith((*debug.Debugger).StepIn),
+	"stepOut":           resumeWith((*debug.Debugger).StepOut),
+	"pause":             (*server).pause,
+	"disconnect":        (*server).disconnect,
+}
+
+type server struct {
+	out   io.Writer
+	wmu   sync.Mutex // guards out and seq, written to by both goroutines
+	seq   int
+	after func() // to run once the response to a request is sent
+
+	line, column int // numbers of the first line and column, 0 or 1
+	d            *debug.Debugger
+	entry        bool // stop on entry
+	configured   bool
+	done         bool // the client has disconnected
+	wg           sync.WaitGroup
+
+	mu      sync.Mutex // guards the fields below
+	stop    *debug.Stop
+	running bool
+	quit    bool
+}
+
+// Serve reads requests from r and writes responses and events to w until
+// the client disconnects or closes r. A program still running is stopped.
+func Serve(r io.Reader, w io.Writer) error {
+	s := &server{out: w, line: 1, column: 1}
+	in := bufio.NewReader(r)
+	var err error
+	for !s.done {
+		var data []byte
+		data, err = readMessage(in)
+		if err != nil {
+			break
+		}
+		var m message
+		if json.Unmarshal(data, &m) != nil || m.Type != "request" {
+			continue
+		}
+		if err = s.handle(&m); err != nil {
+			break
+		}
+	}
+	if s.d != nil {
+		s.mu.Lock()
+		s.quit = true
+		s.mu.Unlock()
+		s.d.Quit()
+	}
+	s.wg.Wait()
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// handle executes a request, returning any error writing the response
+func (s *server) handle(m *message) error {
+	h, ok := handlers[m.Command]
+	if !ok {
+		return s.respond(m, nil, errors.New("unsupported request: "+m.Command))
+	}
+	res, err := h(s, m.Arguments)
+	if err := s.respond(m, res, err); err != nil {
+		return err
+	}
+	if f := s.after; f != nil {
+		s.after = nil
+		f()
+	}
+	return nil
+}
+
+func (s *server) send(m *message) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.seq++
+	m.Seq = s.seq
+	return writeMessage(s.out, m)
+}
+
+func (s *server) respond(req *message, body interface{}, err error) error {
+	ok := err == nil
+	m := &message{Type: "response", RequestSeq: req.Seq, Command: req.Command,
+		Success: &ok, Body: body}
+	if err != nil {
+		m.Message = err.Error()
+	}
+	return s.send(m)
+}
+
+func (s *server) event(name string, body interface{}) error {
+	return s.send(&message{Type: "event", Event: name, Body: body})
+}
+
+// output sends what is written to it to the client as output events
+type output struct {
+	s        *server
+	category string
+}
+
+func (o output) Write(p []byte) (int, error) {
+	if err := o.s.event("output", outputEvent{o.category, string(p)}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+/* Lifecycle */
+func (s *server) initialize(args json.RawMessage) (interface{}, error) {
+	var a initializeArguments
+	json.Unmarshal(args, &a)
+	if a.LinesStartAt1 != nil && !*a.LinesStartAt1 {
+		s.line = 0
+	}
+	if a.ColumnsStartAt1 != nil && !*a.ColumnsStartAt1 {
+		s.column = 0
+	}
+	return map[string]interface{}{
+		"supportsConfigurationDoneRequest": true,
+		"supportsEvaluateForHovers":        true,
+	}, nil
+}
+
+// launch loads the program, which starts once the client has set its
+// breakpoints and sent configurationDone
+func (s *server) launch(args json.RawMessage) (interface{}, error) {
+	var a launchArguments
+	if err := json.Unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	if s.d != nil {
+		return nil, errors.New("a program has already been launched")
+	}
+	data, err := ioutil.ReadFile(a.Program)
+	if err != nil {
+		return nil, err
+	}
+	opt := eval.Options{MaxDepth: eval.DefaultMaxDepth,
+		Stdout: output{s, "stdout"}}
+	s.d, err = debug.New(a.Program, string(data), opt)
+	if err != nil {
+		return nil, err
+	}
+	s.entry = a.StopOnEntry
+	s.after = func() { s.event("initialized", nil) }
+	return nil, nil
+}
+
+func (s *server) configurationDone(args json.RawMessage) (interface{}, error) {
+	if s.d == nil {
+		return nil, errors.New("no program has been launched")
+	}
+	if s.configured {
+		return nil, errors.New("the program has already started")
+	}
+	s.configured = true
+	s.after = s.start
+	return nil, nil
+}
+
+func (s *server) disconnect(args json.RawMessage) (interface{}, error) {
+	s.done = true
+	return nil, nil
+}
+
+/* Execution */
+
+// start starts the program, stopping at entry only if asked to
+func (s *server) start() {
+	stop := s.d.Start()
+	if stop != nil && !s.entry {
+		s.resume(s.d.Continue)
+		return
+	}
+	s.stopped(stop)
+}
+
+// resume resumes the stopped program with fn, in a goroutine so that the
+// client may pause it
+func (s *server) resume(fn func() *debug.Stop) {
+	s.mu.Lock()
+	s.stop, s.running = nil, true
+	s.mu.Unlock()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.stopped(fn())
+	}()
+}
+
+// stopped reports that the program has stopped, or finished if stop is nil
+func (s *server) stopped(stop *debug.Stop) {
+	s.mu.Lock()
+	s.stop, s.running = stop, false
+	quit := s.quit
+	s.mu.Unlock()
+	if quit {
+		return
+	}
+	if stop != nil {
+		s.event("stopped", stoppedEvent{stop.Reason, threadID, true})
+		return
+	}
+	code := 0
+	if _, err := s.d.Result(); err != nil {
+		code = 1
+		fmt.Fprintln(output{s, "stderr"}, err)
+	}
+	s.event("exited", exitedEvent{code})
+	s.event("terminated", nil)
+}
+
+// current returns where the program is stopped
+func (s *server) current() (*debug.Stop, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop == nil {
+		return nil, errors.New("the program is not stopped")
+	}
+	return s.stop, nil
+}
+
+// resumeWith returns a handler resuming the program with fn
+func resumeWith(fn func(*debug.Debugger) *debug.Stop) handler {
+	return func(s *server, args json.RawMessage) (interface{}, error) {
+		if _, err := s.current(); err != nil {
+			return nil, err
+		}
+		s.after = func() {
+			s.resume(func() *debug.Stop { return fn(s.d) })
+		}
+		return map[string]bool{"allThreadsContinued": true}, nil
+	}
+}
+
+func (s *server) pause(args json.RawMessage) (interface{}, error) {
+	s.mu.Lock()
+	running := s.running
+	s.mu.Unlock()
+	if running {
+		s.d.Pause()
+	}
+	return nil, nil
+}
+
+/* Breakpoints */
+func (s *server) setBreakpoints(args json.RawMessage) (interface{}, error) {
+	var a setBreakpointsArguments
+	if err := json.Unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	if s.d == nil {
+		return nil, errors.New("no program has been launched")
+	}
+	path := a.Source.Path
+	if path == "" {
+		path = a.Source.Name
+	}
+	for _, bp := range s.d.Breakpoints() {
+		s.d.ClearBreakpoint(bp.Filename, bp.Line)
+	}
+	list := []Breakpoint{}
+	for _, bp := range a.Breakpoints {
+		line := bp.Line - s.line + 1
+		b := Breakpoint{Verified: s.d.SetBreakpoint(path, line), Line: bp.Line}
+		if !b.Verified {
+			b.Message = "No expression on this line"
+		}
+		list = append(list, b)
+	}
+	return map[string]interface{}{"breakpoints": list}, nil
+}
+
+/* Inspection */
+func (s *server) threads(args json.RawMessage) (interface{}, error) {
+	return map[string]interface{}{
+		"threads": []Thread{{threadID, "main"}},
+	}, nil
+}
+
+func (s *server) stackTrace(args json.RawMessage) (interface{}, error) {
+	var a stackTraceArguments
+	json.Unmarshal(args, &a)
+	stop, err := s.current()
+	if err != nil {
+		return nil, err
+	}
+	frames := stop.Frames()
+	list := []StackFrame{}
+	for i, f := range frames {
+		if i < a.StartFrame || a.Levels > 0 && i >= a.StartFrame+a.Levels {
+			continue
+		}
+		src := Source{filepath.Base(f.Pos.Filename), f.Pos.Filename}
+		name := src.Name // of the file
+		if f.Call != nil {
+			name = f.Name
+		}
+		list = append(list, StackFrame{ID: i, Name: name, Source: src,
+			Line: f.Pos.Line - 1 + s.line, Column: f.Pos.Column - 1 + s.column})
+	}
+	return map[string]interface{}{
+		"stackFrames": list,
+		"totalFrames": len(frames),
+	}, nil
+}
+
+// The variables of frame i are referred to by i+1. The last frame is that
+// of the file, whose variables are the globals.
+func (s *server) scopes(args json.RawMessage) (interface{}, error) {
+	var a scopesArguments
+	json.Unmarshal(args, &a)
+	stop, err := s.current()
+	if err != nil {
+		return nil, err
+	}
+	frames := stop.Frames()
+	if a.FrameID < 0 || a.FrameID >= len(frames) {
+		return nil, fmt.Errorf("invalid frame: %d", a.FrameID)
+	}
+	list := []Scope{}
+	if frames[a.FrameID].Call != nil {
+		list = append(list, Scope{"Locals", a.FrameID + 1, false})
+	}
+	list = append(list, Scope{"Globals", len(frames), false})
+	return map[string]interface{}{"scopes": list}, nil
+}
+
+// vars returns the variables of frame i
+func vars(stop *debug.Stop, frames []debug.Frame, i int) []eval.Var {
+	if f := frames[i]; f.Call != nil {
+		return f.Call.Vars()
+	}
+	scopes := stop.State.Scopes()
+	return scopes[len(scopes)-1].Vars
+}
+
+func lookup(name string, list []eval.Var) (interface{}, bool) {
+	for _, v := range list {
+		if v.Name == name {
+			return v.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (s *server) variables(args json.RawMessage) (interface{}, error) {
+	var a variablesArguments
+	json.Unmarshal(args, &a)
+	stop, err := s.current()
+	if err != nil {
+		return nil, err
+	}
+	frames := stop.Frames()
+	if a.VariablesReference < 1 || a.VariablesReference > len(frames) {
+		return nil, fmt.Errorf("invalid reference: %d", a.VariablesReference)
+	}
+	list := []Variable{}
+	for _, v := range vars(stop, frames, a.VariablesReference-1) {
+		list = append(list, Variable{v.Name, debug.Format(v.Value), 0})
+	}
+	return map[string]interface{}{"variables": list}, nil
+}
+
+// evaluate returns the value of a variable, visible in the given frame or
+// where the program stopped
+func (s *server) evaluate(args json.RawMessage) (interface{}, error) {
+	var a evaluateArguments
+	json.Unmarshal(args, &a)
+	stop, err := s.current()
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSpace(a.Expression)
+	v, ok := stop.State.Lookup(name)
+	if frames := stop.Frames(); a.FrameID != nil && *a.FrameID > 0 &&
+		*a.FrameID < len(frames) {
+		v, ok = lookup(name, append(vars(stop, frames, *a.FrameID),
+			vars(stop, frames, len(frames)-1)...))
+	}
+	if !ok {
+		return nil, fmt.Errorf("no variable %s in scope", name)
+	}
+	return map[string]interface{}{
+		"result":             debug.Format(v),
+		"variablesReference": 0,
+	}, nil
+}
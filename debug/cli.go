@@ -0,0 +1,269 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+package debug
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/rthornton128/gocalc/eval"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// commands understood by Run, with their usage
+var commands = [][2]string{
+	{"break, b [file:]line", "Set a breakpoint, or list them without a line"},
+	{"delete, d [file:]line", "Delete a breakpoint, or all without a line"},
+	{"continue, c", "Run until a breakpoint is reached"},
+	{"step, s", "Step to the next line, entering functions"},
+	{"next, n", "Step to the next line, over functions"},
+	{"out, o", "Run until the current function returns"},
+	{"backtrace, bt", "Print the active calls"},
+	{"vars, v", "Print the variables in scope"},
+	{"print, p name", "Print the value of a variable"},
+	{"list, l [line]", "List the source around the current or given line"},
+	{"help, h", "Print this help"},
+	{"quit, q", "Stop the program and exit"},
+}
+
+var titles = map[string]string{
+	Entry:      "Entry",
+	Breakpoint: "Breakpoint",
+	Step:       "Stepped",
+	Pause:      "Paused",
+}
+
+// Run starts the program of d and debugs it interactively, reading commands
+// from in and writing to out until the program finishes or the user quits.
+// It returns the errors of the program as a token.ErrorList, once printed.
+func Run(d *Debugger, in io.Reader, out io.Writer) error {
+	s := &cli{d: d, out: out, stop: d.Start()}
+	r := bufio.NewScanner(in)
+	last := ""
+	for s.stop != nil {
+		s.where()
+		fmt.Fprint(out, "(debug) ")
+		if !r.Scan() {
+			fmt.Fprintln(out)
+			break
+		}
+		line := strings.TrimSpace(r.Text())
+		if line == "" {
+			line = last
+		}
+		last = line
+		if !s.command(line) {
+			break
+		}
+	}
+	if !d.Done() {
+		d.Quit()
+		return nil
+	}
+	res, err := d.Result()
+	if err != nil {
+		for _, e := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintln(out, e)
+		}
+		return err
+	}
+	if res != nil {
+		fmt.Fprintln(out, "Program finished:", Format(res))
+	} else {
+		fmt.Fprintln(out, "Program finished")
+	}
+	return nil
+}
+
+// cli is an interactive debugging session
+type cli struct {
+	d     *Debugger
+	out   io.Writer
+	stop  *Stop
+	shown bool // whether the current stop has been printed
+}
+
+// where prints the current stop, once
+func (s *cli) where() {
+	if s.shown {
+		return
+	}
+	s.shown = true
+	in := ""
+	if calls := s.stop.State.Calls(); len(calls) > 0 {
+		in = " in " + calls[len(calls)-1].Name
+	}
+	fmt.Fprintf(s.out, "%s at %s%s\n", titles[s.stop.Reason], s.stop.Pos, in)
+	s.list(s.stop.Pos.Line, 0)
+}
+
+// command executes line, reporting false once the user quits
+func (s *cli) command(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return true
+	}
+	arg := strings.TrimSpace(strings.TrimPrefix(line, fields[0]))
+	switch fields[0] {
+	case "break", "b":
+		s.breakpoint(arg, true)
+	case "delete", "d":
+		s.breakpoint(arg, false)
+	case "continue", "c":
+		s.resume(s.d.Continue())
+	case "step", "s":
+		s.resume(s.d.StepIn())
+	case "next", "n":
+		s.resume(s.d.StepOver())
+	case "out", "o":
+		s.resume(s.d.StepOut())
+	case "backtrace", "bt":
+		s.backtrace()
+	case "vars", "v":
+		s.vars()
+	case "print", "p":
+		if arg == "" {
+			fmt.Fprintln(s.out, "Usage: print name")
+		} else if v, ok := s.stop.State.Lookup(arg); ok {
+			fmt.Fprintln(s.out, arg, "=", Format(v))
+		} else {
+			fmt.Fprintln(s.out, "No variable", arg, "in scope")
+		}
+	case "list", "l":
+		n := s.stop.Pos.Line
+		if arg != "" {
+			var err error
+			if n, err = strconv.Atoi(arg); err != nil {
+				fmt.Fprintln(s.out, "Invalid line:", arg)
+				return true
+			}
+		}
+		s.list(n, 5)
+	case "help", "h":
+		for _, c := range commands {
+			fmt.Fprintf(s.out, "  %-22s %s\n", c[0], c[1])
+		}
+	case "quit", "q":
+		return false
+	default:
+		fmt.Fprintln(s.out, "Unknown command:", fields[0],
+			"(type help for a list)")
+	}
+	return true
+}
+
+func (s *cli) resume(stop *Stop) {
+	s.stop, s.shown = stop, false
+}
+
+// breakpoint sets or deletes the breakpoint at loc, of the form
+// [file:]line, or lists or deletes every breakpoint if loc is empty
+func (s *cli) breakpoint(loc string, set bool) {
+	if loc == "" {
+		if !set {
+			s.d.ClearBreakpoints()
+			fmt.Fprintln(s.out, "Deleted all breakpoints")
+			return
+		}
+		list := s.d.Breakpoints()
+		if len(list) == 0 {
+			fmt.Fprintln(s.out, "No breakpoints")
+		}
+		for _, bp := range list {
+			fmt.Fprintf(s.out, "%s:%d\n", bp.Filename, bp.Line)
+		}
+		return
+	}
+	file, line, err := location(loc)
+	switch {
+	case err != nil:
+		fmt.Fprintln(s.out, err)
+	case !set:
+		s.d.ClearBreakpoint(file, line)
+		fmt.Fprintln(s.out, "Deleted breakpoint at", loc)
+	case s.d.SetBreakpoint(file, line):
+		fmt.Fprintf(s.out, "Breakpoint set at %s:%d\n", s.d.Name(), line)
+	default:
+		fmt.Fprintln(s.out, "No expression at", loc)
+	}
+}
+
+// location splits loc, of the form [file:]line
+func location(loc string) (string, int, error) {
+	file := ""
+	if i := strings.LastIndex(loc, ":"); i >= 0 {
+		file, loc = loc[:i], loc[i+1:]
+	}
+	line, err := strconv.Atoi(loc)
+	if err != nil || line < 1 {
+		return "", 0, errors.New("Invalid line: " + loc)
+	}
+	return file, line, nil
+}
+
+// backtrace prints the active calls, innermost first, and where each is
+func (s *cli) backtrace() {
+	for i, f := range s.stop.Frames() {
+		name := "<file>"
+		if f.Call != nil {
+			name = call(*f.Call)
+		}
+		fmt.Fprintf(s.out, "#%d  %s at %s\n", i, name, f.Pos)
+	}
+}
+
+// vars prints the variables of each scope, innermost first
+func (s *cli) vars() {
+	for _, sc := range s.stop.State.Scopes() {
+		name := sc.Name
+		if name == "" {
+			name = "<file>"
+		}
+		fmt.Fprintln(s.out, name+":")
+		for _, v := range sc.Vars {
+			fmt.Fprintf(s.out, "  %s = %s\n", v.Name, Format(v.Value))
+		}
+	}
+}
+
+// list prints the lines of source within n lines of line, marking the one
+// the program stopped at
+func (s *cli) list(line, n int) {
+	for i := line - n; i <= line+n; i++ {
+		if i < 1 || i > s.d.NumLines() {
+			continue
+		}
+		mark := "  "
+		if i == s.stop.Pos.Line {
+			mark = "=>"
+		}
+		fmt.Fprintf(s.out, "%s %4d  %s\n", mark, i, s.d.Line(i))
+	}
+}
+
+// call formats c as the expression which made it
+func call(c eval.Call) string {
+	list := []string{c.Name}
+	for _, a := range c.Args {
+		list = append(list, Format(a))
+	}
+	return "(" + strings.Join(list, " ") + ")"
+}
+
+// value formats v as it would be written in Calc
+func Format(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "<unset>"
+	case string:
+		return strconv.Quote(v)
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,380 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+// Package debug runs a Calc program under the control of a debugger.
+//
+// The program is evaluated in a goroutine of its own, which stops before
+// evaluating an expression at a breakpoint or at the end of a step. While
+// it is stopped the active calls and the values of the variables in scope
+// may be inspected. Breakpoints are set by file and line, and the program
+// stops only at the first expression evaluated on a line each time the line
+// is reached.
+package debug
+
+import (
+	"context"
+	"github.com/rthornton128/gocalc/ast"
+	"github.com/rthornton128/gocalc/eval"
+	"github.com/rthornton128/gocalc/parser"
+	"github.com/rthornton128/gocalc/token"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Reasons for which the program stops
+const (
+	Entry      = "entry"
+	Breakpoint = "breakpoint"
+	Step       = "step"
+	Pause      = "pause"
+)
+
+// Stop describes where and why the program stopped. State is valid only
+// until the program is resumed.
+type Stop struct {
+	Reason string
+	Node   ast.Node
+	Pos    token.Position
+	State  *eval.State
+}
+
+// Frame is an active call, or the file, and where its evaluation has got
+// to.
+type Frame struct {
+	Name string     // of the function called, "" for the file
+	Call *eval.Call // nil for the file
+	Pos  token.Position
+}
+
+// Frames returns the active calls, innermost first, ending with the file.
+func (s *Stop) Frames() []Frame {
+	calls := s.State.Calls()
+	list := make([]Frame, 0, len(calls)+1)
+	pos := s.Pos
+	for i := len(calls) - 1; i >= 0; i-- {
+		list = append(list, Frame{calls[i].Name, &calls[i], pos})
+		pos = s.State.Position(calls[i].Pos)
+	}
+	return append(list, Frame{"", nil, pos})
+}
+
+type mode int
+
+const (
+	running mode = iota // stop only at breakpoints
+	stepIn
+	stepOver
+	stepOut
+)
+
+// Debugger controls the evaluation of a program.
+type Debugger struct {
+	name   string
+	lines  []string // of the source
+	file   *token.File
+	root   *ast.File
+	opt    eval.Options
+	cancel context.CancelFunc
+
+	mu     sync.Mutex // guards the fields below, used by both goroutines
+	breaks map[token.Position]bool
+	mode   mode
+	pause  bool
+	last   token.Position // where the program last stopped
+	depth  int            // call depth at the last stop
+	prev   token.Position // of the expression evaluated before
+	pdepth int            // call depth of prev
+
+	started bool
+	stops   chan *Stop
+	resume  chan struct{}
+	done    chan struct{}
+	res     interface{}
+	err     error
+}
+
+// New returns a Debugger for the program src, read from the file name,
+// which is evaluated within the limits of opt. It returns any parse errors
+// as a token.ErrorList.
+func New(name, src string, opt eval.Options) (*Debugger, error) {
+	f := token.NewFile(name, src, 1)
+	n := parser.ParseFile(f, src)
+	if f.NumErrors() > 0 {
+		return nil, f.Err()
+	}
+	d := &Debugger{name: name, lines: strings.Split(src, "\n"), file: f,
+		root: n, opt: opt, breaks: make(map[token.Position]bool),
+		stops: make(chan *Stop), resume: make(chan struct{}),
+		done: make(chan struct{})}
+	return d, nil
+}
+
+// Name returns the name of the file being debugged.
+func (d *Debugger) Name() string {
+	return d.name
+}
+
+// Line returns the text of line n of the source, or "" if there is none.
+func (d *Debugger) Line(n int) string {
+	if n < 1 || n > len(d.lines) {
+		return ""
+	}
+	return d.lines[n-1]
+}
+
+// NumLines returns the number of lines in the source.
+func (d *Debugger) NumLines() int {
+	return len(d.lines)
+}
+
+/* Breakpoints */
+
+// breakpoint returns the key for a breakpoint on line of the file, which
+// is the file being debugged if file is empty or names it
+func (d *Debugger) breakpoint(file string, line int) token.Position {
+	if file == "" || filepath.Base(file) == filepath.Base(d.name) {
+		file = d.name
+	}
+	return token.Position{Filename: file, Line: line}
+}
+
+// SetBreakpoint sets a breakpoint on line of file. It returns false if the
+// line has no expression on which the program could stop.
+func (d *Debugger) SetBreakpoint(file string, line int) bool {
+	bp := d.breakpoint(file, line)
+	if bp.Filename != d.name || !d.hasExpr(line) {
+		return false
+	}
+	d.mu.Lock()
+	d.breaks[bp] = true
+	d.mu.Unlock()
+	return true
+}
+
+// ClearBreakpoint removes the breakpoint on line of file, if any.
+func (d *Debugger) ClearBreakpoint(file string, line int) {
+	d.mu.Lock()
+	delete(d.breaks, d.breakpoint(file, line))
+	d.mu.Unlock()
+}
+
+// ClearBreakpoints removes every breakpoint.
+func (d *Debugger) ClearBreakpoints() {
+	d.mu.Lock()
+	d.breaks = make(map[token.Position]bool)
+	d.mu.Unlock()
+}
+
+// Breakpoints returns the breakpoints set, ordered by line.
+func (d *Debugger) Breakpoints() []token.Position {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var list []token.Position
+	for bp := range d.breaks {
+		list = append(list, bp)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Line < list[j].Line
+	})
+	return list
+}
+
+// hasExpr reports whether an expression the program may stop at starts on
+// line
+func (d *Debugger) hasExpr(line int) bool {
+	found := false
+	ast.Inspect(d.root, func(n ast.Node) bool {
+		if n == nil || found {
+			return false
+		}
+		if stoppable(n) && d.file.Position(n.Pos()).Line == line {
+			found = true
+		}
+		return true
+	})
+	return found
+}
+
+// stoppable reports whether the program may stop before evaluating n. The
+// program stops only at expressions which do something.
+func stoppable(n ast.Node) bool {
+	switch n.(type) {
+	case *ast.Identifier, *ast.Number, *ast.String, *ast.Operator,
+		*ast.DefineExpr, *ast.TestExpr, *ast.File:
+		return false
+	}
+	return true
+}
+
+/* Execution */
+
+// Start starts the program and stops it before its first expression. It
+// returns nil if the program finishes first.
+func (d *Debugger) Start() *Stop {
+	if d.started {
+		return nil
+	}
+	d.started = true
+	d.mode = stepIn
+	var ctx context.Context
+	ctx, d.cancel = context.WithCancel(context.Background())
+	opt := d.opt
+	opt.Debug = d.hook
+	go func() {
+		d.res, d.err = eval.EvalTree(ctx, d.file, d.root, opt)
+		close(d.done)
+	}()
+	return d.wait()
+}
+
+// Continue resumes the program until it reaches a breakpoint, returning
+// nil if it finishes first.
+func (d *Debugger) Continue() *Stop {
+	return d.resumeIn(running)
+}
+
+// StepIn resumes the program until it reaches another line or enters or
+// leaves a function.
+func (d *Debugger) StepIn() *Stop {
+	return d.resumeIn(stepIn)
+}
+
+// StepOver resumes the program until it reaches another line without
+// entering a function, or leaves the function.
+func (d *Debugger) StepOver() *Stop {
+	return d.resumeIn(stepOver)
+}
+
+// StepOut resumes the program until it leaves the current function.
+func (d *Debugger) StepOut() *Stop {
+	return d.resumeIn(stepOut)
+}
+
+// Pause stops the running program at the next expression, which is then
+// returned by the call which resumed it.
+func (d *Debugger) Pause() {
+	d.mu.Lock()
+	d.pause = true
+	d.mu.Unlock()
+}
+
+// Quit stops the program if it is running and waits for it to finish.
+func (d *Debugger) Quit() {
+	if !d.started {
+		return
+	}
+	d.cancel()
+	for {
+		select {
+		case <-d.stops:
+		case d.resume <- struct{}{}:
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// Done reports whether the program has finished.
+func (d *Debugger) Done() bool {
+	select {
+	case <-d.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Result returns the result of the program, or its errors as a
+// token.ErrorList, once it has finished.
+func (d *Debugger) Result() (interface{}, error) {
+	<-d.done
+	return d.res, d.err
+}
+
+func (d *Debugger) resumeIn(m mode) *Stop {
+	if !d.started {
+		return d.Start()
+	}
+	if d.Done() {
+		return nil
+	}
+	d.mu.Lock()
+	d.mode = m
+	d.mu.Unlock()
+	select {
+	case d.resume <- struct{}{}:
+	case <-d.done: // stopped by Quit
+		return nil
+	}
+	return d.wait()
+}
+
+func (d *Debugger) wait() *Stop {
+	select {
+	case s := <-d.stops:
+		return s
+	case <-d.done:
+		return nil
+	}
+}
+
+// hook is called by the evaluator before each node is evaluated, and
+// blocks for as long as the program is stopped
+func (d *Debugger) hook(n ast.Node, st *eval.State) {
+	if !stoppable(n) {
+		return
+	}
+	pos := st.Position(n.Pos())
+	depth := st.Depth()
+	d.mu.Lock()
+	reason := d.reason(pos, depth)
+	d.prev, d.pdepth = pos, depth
+	if reason != "" {
+		d.last, d.depth, d.pause = pos, depth, false
+	}
+	d.mu.Unlock()
+	if reason == "" {
+		return
+	}
+	d.stops <- &Stop{Reason: reason, Node: n, Pos: pos, State: st}
+	<-d.resume
+}
+
+// reason returns why the program should stop at pos, or "" if it should
+// not
+func (d *Debugger) reason(pos token.Position, depth int) string {
+	moved := pos.Filename != d.last.Filename || pos.Line != d.last.Line ||
+		depth != d.depth
+	arrived := pos.Filename != d.prev.Filename || pos.Line != d.prev.Line ||
+		depth != d.pdepth
+	switch {
+	case !d.last.IsValid():
+		return Entry
+	case d.pause:
+		return Pause
+	case arrived && d.breaks[token.Position{Filename: pos.Filename,
+		Line: pos.Line}]:
+		return Breakpoint
+	}
+	switch d.mode {
+	case stepIn:
+		if moved {
+			return Step
+		}
+	case stepOver:
+		if depth < d.depth || depth == d.depth && moved {
+			return Step
+		}
+	case stepOut:
+		if depth < d.depth {
+			return Step
+		}
+	}
+	return ""
+}
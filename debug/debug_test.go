@@ -0,0 +1,129 @@
+package debug_test
+
+import (
+	"bytes"
+	"github.com/rthornton128/gocalc/debug"
+	"github.com/rthornton128/gocalc/eval"
+	"strings"
+	"testing"
+)
+
+var src = `(define (sq x)
+	(* x x))
+(define (sum-sq a b)
+	(set s (+ (sq a)
+		(sq b)))
+	(+ s 0))
+(set n (sum-sq 2 3))
+(+ n 1)`
+
+func TestStepping(t *testing.T) {
+	var tests = []struct {
+		step  func(*debug.Debugger) *debug.Stop
+		line  int
+		depth int
+	}{
+		{(*debug.Debugger).Start, 7, 0},
+		{(*debug.Debugger).StepIn, 4, 1},
+		{(*debug.Debugger).StepIn, 2, 2},
+		{(*debug.Debugger).StepOut, 5, 1},
+		{(*debug.Debugger).StepOver, 6, 1},
+		{(*debug.Debugger).StepOver, 8, 0},
+		{(*debug.Debugger).StepOver, 0, 0},
+	}
+	d, err := debug.New("sum.calc", src, eval.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, test := range tests {
+		s := test.step(d)
+		if s == nil {
+			if test.line != 0 {
+				t.Fatal(i, "- Program finished early")
+			}
+			continue
+		}
+		if s.Pos.Line != test.line || s.State.Depth() != test.depth {
+			t.Log(i, "- Expected:", test.line, test.depth)
+			t.Fatal(i, "- Got:", s.Pos.Line, s.State.Depth())
+		}
+	}
+	if res, err := d.Result(); err != nil || res != 14 {
+		t.Fatal("Unexpected result:", res, err)
+	}
+}
+
+func TestBreakpoints(t *testing.T) {
+	d, err := debug.New("sum.calc", src, eval.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.SetBreakpoint("", 3) {
+		t.Fatal("Breakpoint set on a define")
+	}
+	if !d.SetBreakpoint("dir/sum.calc", 2) {
+		t.Fatal("Breakpoint not set")
+	}
+	d.Start()
+	var args []interface{}
+	for s := d.Continue(); s != nil; s = d.Continue() {
+		if s.Reason != debug.Breakpoint {
+			t.Fatal("Unexpected stop:", s.Reason)
+		}
+		x, _ := s.State.Lookup("x")
+		args = append(args, x)
+		calls := s.State.Calls()
+		if len(calls) != 2 || calls[0].Name != "sum-sq" ||
+			s.State.Position(calls[1].Pos).Line != len(args)+3 {
+			t.Fatal("Unexpected calls:", calls)
+		}
+		scopes := s.State.Scopes()
+		if len(scopes) != 2 || scopes[0].Name != "sq" ||
+			scopes[1].Name != "" || len(scopes[1].Vars) != 1 {
+			t.Fatal("Unexpected scopes:", scopes)
+		}
+	}
+	if len(args) != 2 || args[0] != 2 || args[1] != 3 {
+		t.Fatal("Unexpected arguments:", args)
+	}
+}
+
+func TestRun(t *testing.T) {
+	var tests = []struct {
+		in, want string
+	}{
+		{"q\n", "Entry at sum.calc:7:1\n" +
+			"=>    7  (set n (sum-sq 2 3))\n" +
+			"(debug) "},
+		{"b 2\nc\nbt\nv\np b\no\np b\nd\nc\n", "Entry at sum.calc:7:1\n" +
+			"=>    7  (set n (sum-sq 2 3))\n" +
+			"(debug) Breakpoint set at sum.calc:2\n" +
+			"(debug) Breakpoint at sum.calc:2:2 in sq\n" +
+			"=>    2  \t(* x x))\n" +
+			"(debug) #0  (sq 2) at sum.calc:2:2\n" +
+			"#1  (sum-sq 2 3) at sum.calc:4:12\n" +
+			"#2  <file> at sum.calc:7:8\n" +
+			"(debug) sq:\n" +
+			"  x = 2\n" +
+			"<file>:\n" +
+			"  n = <unset>\n" +
+			"(debug) No variable b in scope\n" +
+			"(debug) Stepped at sum.calc:5:3 in sum-sq\n" +
+			"=>    5  \t\t(sq b)))\n" +
+			"(debug) b = 3\n" +
+			"(debug) Deleted all breakpoints\n" +
+			"(debug) Program finished: 14\n"},
+	}
+	for i, test := range tests {
+		d, err := debug.New("sum.calc", src, eval.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		debug.Run(d, strings.NewReader(test.in), &out)
+		if out.String() != test.want {
+			t.Log(i, "- Expected:", test.want)
+			t.Fatal(i, "- Got:", out.String())
+		}
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+// Package doc extracts documentation from the top level defines of Calc
+// source files.
+//
+// The documentation of a define is the block of comments immediately above
+// it, with no blank line between them:
+//
+//	; fib returns the xth fibonacci number
+//	(define (fib x) ...)
+//
+// Where the documentation mentions another documented function by name, the
+// Markdown and HTML renderings link to it. A name declared by more than one
+// of the functions documented together links to the one in the same file,
+// and not at all if there is none there.
+package doc
+
+import (
+	"fmt"
+	"github.com/rthornton128/gocalc/ast"
+	"github.com/rthornton128/gocalc/token"
+	"html"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// Func is the documentation of a single top level define.
+type Func struct {
+	Name string
+	Type string   // declared return type, if any
+	Args []string // argument names, with their declared types, if any
+	Doc  string   // comment text, without the leading semicolons
+	File string   // name of the file declaring the function
+	Line int
+}
+
+// Signature returns the function as it would be called, such as (fib x).
+func (fn *Func) Signature() string {
+	return "(" + strings.Join(append([]string{typed(fn.Name, fn.Type)},
+		fn.Args...), " ") + ")"
+}
+
+func typed(name, typ string) string {
+	if typ != "" {
+		return name + ":" + typ
+	}
+	return name
+}
+
+// File returns the documentation of every top level define in n, which was
+// parsed from f, in source order.
+func File(f *token.File, n *ast.File) []*Func {
+	cmap := ast.NewCommentMap(f, n, n.Comments)
+	var funcs []*Func
+	for _, node := range n.Nodes {
+		if d, ok := node.(*ast.DefineExpr); ok {
+			funcs = append(funcs, Define(f, cmap, d))
+		}
+	}
+	return funcs
+}
+
+// Define returns the documentation of d, which need not be at the top level,
+// taking its doc comment from cmap.
+func Define(f *token.File, cmap ast.CommentMap, d *ast.DefineExpr) *Func {
+	fn := &Func{Name: d.Name, Type: d.Type, File: f.Name(),
+		Line: f.Line(d.Pos())}
+	for i, a := range d.Args {
+		if i < len(d.ArgTypes) {
+			a = typed(a, d.ArgTypes[i])
+		}
+		fn.Args = append(fn.Args, a)
+	}
+	for _, g := range cmap[d] {
+		// only the block of comments directly above the define
+		if g.End() < d.Pos() && f.Line(g.End()-1)+1 == fn.Line {
+			fn.Doc = g.Text()
+		}
+	}
+	return fn
+}
+
+// Text writes the documentation as plain text, in the style of go doc.
+func Text(w io.Writer, funcs []*Func) {
+	for i, fn := range funcs {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w, fn.Signature())
+		if fn.Doc == "" {
+			continue
+		}
+		for _, line := range strings.Split(fn.Doc, "\n") {
+			if line == "" {
+				fmt.Fprintln(w)
+			} else {
+				fmt.Fprintln(w, "    "+line)
+			}
+		}
+	}
+}
+
+// Markdown writes the documentation as Markdown, with a heading for each
+// function.
+func Markdown(w io.Writer, funcs []*Func) {
+	ids := anchors(funcs)
+	for i, fn := range funcs {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "<a id=\"%s\"></a>\n", html.EscapeString(ids[fn]))
+		fmt.Fprintf(w, "## %s\n\n", fn.Name)
+		fmt.Fprintf(w, "    %s\n", fn.Signature())
+		if fn.Doc != "" {
+			fmt.Fprintf(w, "\n%s\n", link(fn.Doc, fn, funcs, ids,
+				func(s string) string { return s },
+				func(name, id string) string {
+					return "[" + name + "](#" + url.PathEscape(id) + ")"
+				}))
+		}
+	}
+}
+
+// HTML writes the documentation as a complete HTML page with the given
+// title.
+func HTML(w io.Writer, title string, funcs []*Func) {
+	ids := anchors(funcs)
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n"+
+		"<title>%s</title>\n</head>\n<body>\n<h1>%s</h1>\n",
+		html.EscapeString(title), html.EscapeString(title))
+	for _, fn := range funcs {
+		fmt.Fprintf(w, "<h2 id=\"%s\">%s</h2>\n<pre>%s</pre>\n",
+			html.EscapeString(ids[fn]), html.EscapeString(fn.Name),
+			html.EscapeString(fn.Signature()))
+		for _, para := range strings.Split(fn.Doc, "\n\n") {
+			if strings.TrimSpace(para) == "" {
+				continue
+			}
+			fmt.Fprintf(w, "<p>%s</p>\n", link(para, fn, funcs, ids,
+				html.EscapeString,
+				func(name, id string) string {
+					return "<a href=\"#" + url.PathEscape(id) + "\">" +
+						html.EscapeString(name) + "</a>"
+				}))
+		}
+	}
+	fmt.Fprintln(w, "</body>\n</html>")
+}
+
+// anchors returns the anchor of each function: its name, unless another
+// function has the same name, when it is qualified by the file declaring
+// it, and by its line too if the file declares the name more than once.
+func anchors(funcs []*Func) map[*Func]string {
+	count := make(map[string]int)
+	for _, fn := range funcs {
+		count[fn.Name]++
+		count[fn.File+":"+fn.Name]++
+	}
+	ids := make(map[*Func]string)
+	for _, fn := range funcs {
+		switch id := fn.File + ":" + fn.Name; {
+		case count[fn.Name] == 1:
+			ids[fn] = fn.Name
+		case count[id] == 1:
+			ids[fn] = id
+		default:
+			ids[fn] = fmt.Sprintf("%s:%d:%s", fn.File, fn.Line, fn.Name)
+		}
+	}
+	return ids
+}
+
+// target returns the function named name to which the documentation of
+// self links, preferring the last declared in the same file, or nil if
+// there is none or the name is ambiguous.
+func target(name string, self *Func, funcs []*Func) *Func {
+	var same, other *Func
+	n := 0
+	for _, fn := range funcs {
+		if fn.Name != name {
+			continue
+		}
+		if fn.File == self.File {
+			same = fn
+		} else {
+			other = fn
+			n++
+		}
+	}
+	switch {
+	case same != nil:
+		return same
+	case n == 1:
+		return other
+	}
+	return nil
+}
+
+func isIdent(ch byte) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' ||
+		ch >= '0' && ch <= '9' || ch == '_' || ch == '-' || ch == '?'
+}
+
+// link rewrites text, replacing each word naming a function other than self
+// by a link to its anchor and escaping everything else
+func link(text string, self *Func, funcs []*Func, ids map[*Func]string,
+	escape func(string) string, ref func(name, id string) string) string {
+	var out []string
+	for i := 0; i < len(text); {
+		j := i
+		for j < len(text) && isIdent(text[j]) {
+			j++
+		}
+		if j > i {
+			w := text[i:j]
+			if fn := target(w, self, funcs); fn != nil && fn != self {
+				out = append(out, ref(w, ids[fn]))
+			} else {
+				out = append(out, escape(w))
+			}
+			i = j
+			continue
+		}
+		for j < len(text) && !isIdent(text[j]) {
+			j++
+		}
+		out = append(out, escape(text[i:j]))
+		i = j
+	}
+	return strings.Join(out, "")
+}
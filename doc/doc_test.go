@@ -0,0 +1,123 @@
+package doc_test
+
+import (
+	"bytes"
+	"github.com/rthornton128/gocalc/doc"
+	"github.com/rthornton128/gocalc/parser"
+	"github.com/rthornton128/gocalc/token"
+	"strings"
+	"testing"
+)
+
+const src = `; sq returns x multiplied by itself.
+(define (sq x) (* x x))
+
+; sum-sq returns the sum of sq of a and b.
+;
+; Both must be ints.
+(define (sum-sq:int a:int b:int) (+ (sq a) (sq b)))
+
+; not documentation, there is a blank line
+
+(define nodoc 1)
+(print (sum-sq 1 2))
+`
+
+func funcs(t *testing.T) []*doc.Func {
+	f := token.NewFile("lib.calc", src, 1)
+	n := parser.ParseFile(f, src)
+	if f.NumErrors() > 0 {
+		t.Fatal(f.Err())
+	}
+	return doc.File(f, n)
+}
+
+func TestFile(t *testing.T) {
+	var tests = []struct {
+		sig, doc string
+		line     int
+	}{
+		{"(sq x)", "sq returns x multiplied by itself.", 2},
+		{"(sum-sq:int a:int b:int)",
+			"sum-sq returns the sum of sq of a and b.\n\nBoth must be ints.", 7},
+		{"(nodoc)", "", 11},
+	}
+	fns := funcs(t)
+	if len(fns) != len(tests) {
+		t.Fatal("Expected", len(tests), "functions, got:", len(fns))
+	}
+	for i, test := range tests {
+		fn := fns[i]
+		if fn.Signature() != test.sig || fn.Doc != test.doc ||
+			fn.Line != test.line || fn.File != "lib.calc" {
+			t.Log(i, "- Expected:", test.sig, test.line, test.doc)
+			t.Fatal(i, "- Got:", fn.Signature(), fn.Line, fn.Doc)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	var tests = []struct {
+		render func(*bytes.Buffer)
+		want   string
+	}{
+		{func(b *bytes.Buffer) { doc.Text(b, funcs(t)) },
+			"(sum-sq:int a:int b:int)\n" +
+				"    sum-sq returns the sum of sq of a and b.\n\n" +
+				"    Both must be ints.\n"},
+		{func(b *bytes.Buffer) { doc.Markdown(b, funcs(t)) },
+			"sum-sq returns the sum of [sq](#sq) of a and b."},
+		{func(b *bytes.Buffer) { doc.HTML(b, "lib", funcs(t)) },
+			"<p>sum-sq returns the sum of <a href=\"#sq\">sq</a> of a and b.</p>"},
+	}
+	for i, test := range tests {
+		var b bytes.Buffer
+		test.render(&b)
+		if !strings.Contains(b.String(), test.want) {
+			t.Log(i, "- Expected:", test.want)
+			t.Fatal(i, "- Got:", b.String())
+		}
+	}
+}
+
+func TestRenderDuplicates(t *testing.T) {
+	var all []*doc.Func
+	for _, file := range []struct{ name, src string }{
+		{"a.calc", "; sq squares x\n(define (sq x) (* x x))\n" +
+			"; cube uses sq\n(define (cube x) (* x (sq x)))"},
+		{"b.calc", "; sq doubles x\n(define (sq x) (+ x x))\n" +
+			"; quad uses sq and cube\n(define (quad x) (sq (sq x)))"},
+		{"c.calc", "; four uses sq\n(define (four) 4)"},
+	} {
+		f := token.NewFile(file.name, file.src, 1)
+		n := parser.ParseFile(f, file.src)
+		if f.NumErrors() > 0 {
+			t.Fatal(f.Err())
+		}
+		all = append(all, doc.File(f, n)...)
+	}
+	var tests = []struct {
+		render func(*bytes.Buffer)
+		want   []string
+	}{
+		{func(b *bytes.Buffer) { doc.Markdown(b, all) }, []string{
+			"<a id=\"a.calc:sq\"></a>\n", "<a id=\"b.calc:sq\"></a>\n",
+			"<a id=\"cube\"></a>\n", "cube uses [sq](#a.calc:sq)\n",
+			"quad uses [sq](#b.calc:sq) and [cube](#cube)\n",
+			"four uses sq\n"}},
+		{func(b *bytes.Buffer) { doc.HTML(b, "lib", all) }, []string{
+			"<h2 id=\"a.calc:sq\">sq</h2>", "<h2 id=\"b.calc:sq\">sq</h2>",
+			"<p>quad uses <a href=\"#b.calc:sq\">sq</a> and " +
+				"<a href=\"#cube\">cube</a></p>"}},
+	}
+	for i, test := range tests {
+		var b bytes.Buffer
+		test.render(&b)
+		for _, want := range test.want {
+			if !strings.Contains(b.String(), want) {
+				t.Log(i, "- Expected:", want)
+				t.Fatal(i, "- Got:", b.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+package eval
+
+import (
+	"fmt"
+	"github.com/rthornton128/gocalc/ast"
+	"github.com/rthornton128/gocalc/token"
+	"strconv"
+)
+
+// Call is an active call of a user defined function.
+type Call struct {
+	Name  string
+	Def   *ast.DefineExpr // function called
+	Pos   token.Pos       // position of the call
+	Args  []interface{}   // values of the arguments when called
+	frame *frame
+}
+
+// Scope is a function scope, the scope of a test or the file scope, with
+// the values of the variables declared in it.
+type Scope struct {
+	Name string // of the function or test, or "" for the file scope
+	Vars []Var
+}
+
+// Var is an argument or variable and its current value, nil if it has yet
+// to be set.
+type Var struct {
+	Name  string
+	Value interface{}
+}
+
+// State is the state of an evaluation, as seen by a Debug hook. It is valid
+// only until the hook returns.
+type State struct {
+	e *evaluator
+}
+
+// Calls returns the active user function calls, outermost first.
+func (st *State) Calls() []Call {
+	list := make([]Call, len(st.e.calls))
+	for i, c := range st.e.calls {
+		list[i] = *c
+	}
+	return list
+}
+
+// Depth returns the number of active user function calls.
+func (st *State) Depth() int {
+	return len(st.e.calls)
+}
+
+// Position returns the location of p, which may be in the file being
+// evaluated or, in a session, that of an earlier entry.
+func (st *State) Position(p token.Pos) token.Position {
+	return st.e.fileOf(p).Position(p)
+}
+
+// Scopes returns the scope of the function being evaluated and those
+// lexically enclosing it, ending with the file scope.
+func (st *State) Scopes() []Scope {
+	var list []Scope
+	for f := st.e.frame; f != nil; f = f.link {
+		if f.def != nil {
+			list = append(list, Scope{f.def.Name, vars(f)})
+			continue
+		}
+		if f.test != nil {
+			list = append(list, Scope{f.test.Name,
+				named(locals(nil, f.test.Nodes), f)})
+			continue
+		}
+		var names []string
+		for _, root := range st.e.roots {
+			names = locals(names, root.Nodes)
+		}
+		list = append(list, Scope{"", named(names, f)})
+	}
+	return list
+}
+
+// Lookup returns the value of the argument or variable called name which is
+// visible where evaluation has stopped.
+func (st *State) Lookup(name string) (interface{}, bool) {
+	for _, s := range st.Scopes() {
+		for _, v := range s.Vars {
+			if v.Name == name {
+				return v.Value, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Vars returns the arguments and variables of the call.
+func (c Call) Vars() []Var {
+	return vars(c.frame)
+}
+
+// vars returns the arguments and variables of the function call f
+func vars(f *frame) []Var {
+	return named(locals(append([]string{}, f.def.Args...), f.def.Nodes), f)
+}
+
+// named pairs the values in the slots of f with their names
+func named(names []string, f *frame) []Var {
+	var list []Var
+	for i, name := range names {
+		if name != "" && i < len(f.slots) {
+			list = append(list, Var{name, f.slots[i]})
+		}
+	}
+	return list
+}
+
+// locals adds to names, by slot, the variables declared by sets among nodes
+// and outside of any nested define or test
+func locals(names []string, nodes []ast.Node) []string {
+	for _, n := range nodes {
+		if n == nil {
+			continue
+		}
+		ast.Inspect(n, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.DefineExpr, *ast.TestExpr:
+				return false
+			case *ast.SetExpr:
+				if n.Obj != nil && n.Obj.Decl == n {
+					for len(names) <= n.Obj.Index {
+						names = append(names, "")
+					}
+					names[n.Obj.Index] = n.Name
+				}
+			}
+			return true
+		})
+	}
+	return names
+}
+
+// traceback returns the frames of the active calls, outermost first, for
+// an error at p, or nil if there are none
+func (e *evaluator) traceback(p token.Pos) []token.Frame {
+	if len(e.calls) == 0 {
+		return nil
+	}
+	list := []token.Frame{e.traceFrame(e.calls[0].Pos)}
+	if e.test != nil {
+		list[0].Name = "deftest " + e.test.Name
+	}
+	for i, c := range e.calls {
+		at := p
+		if i+1 < len(e.calls) {
+			at = e.calls[i+1].Pos
+		}
+		fr := e.traceFrame(at)
+		fr.Name = c.Name
+		for _, a := range c.Args {
+			fr.Args = append(fr.Args, format(a))
+		}
+		list = append(list, fr)
+	}
+	return list
+}
+
+func (e *evaluator) traceFrame(p token.Pos) token.Frame {
+	f := e.fileOf(p)
+	pos := f.Position(p)
+	return token.Frame{Pos: pos, Text: f.LineText(pos.Line)}
+}
+
+// format formats the value v as it would be written in Calc
+func format(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return strconv.Quote(s)
+	}
+	return fmt.Sprint(v)
+}
@@ -8,48 +8,267 @@
 package eval
 
 import (
+	"context"
 	"fmt"
 	"github.com/rthornton128/gocalc/ast"
 	"github.com/rthornton128/gocalc/parser"
+	"github.com/rthornton128/gocalc/resolve"
 	"github.com/rthornton128/gocalc/token"
+	"github.com/rthornton128/gocalc/types"
+	"io"
+	"os"
 	"strconv"
 )
 
+// DefaultMaxDepth is the call depth limit used by EvalExpr and EvalFile. It
+// keeps runaway recursion from exhausting the Go stack.
+const DefaultMaxDepth = 10000
+
+// Options limits the resources a single evaluation may consume. A zero value
+// for any field means no limit.
+type Options struct {
+	MaxSteps int // maximum number of nodes evaluated
+	MaxDepth int // maximum depth of nested user function calls
+	MaxSize  int // maximum length, in bytes, of a string value
+
+	// Sandbox restricts builtins to those whose capabilities are listed in
+	// Allow. Scripts using any other builtin are rejected by the parser.
+	Sandbox bool
+	Allow   []string
+
+	// Stdout is where print writes, os.Stdout if nil.
+	Stdout io.Writer
+
+	// Enter and Exit, if not nil, are called when a user function is called,
+	// once its arguments are evaluated, and when it returns its result.
+	Enter func(c *Call)
+	Exit  func(c *Call, res interface{})
+
+	// Alloc, if not nil, is called when n allocates a value: a string, or the
+	// frame of a user function call.
+	Alloc func(n ast.Node)
+
+	// Debug, if not nil, is called before each node is evaluated, with the
+	// state of the evaluation. Evaluation waits for it to return.
+	Debug func(n ast.Node, st *State)
+}
+
 func EvalExpr(expr string) interface{} {
 	return EvalFile("", expr)
 }
 
 func EvalFile(fname, expr string) interface{} {
+	opt := Options{MaxDepth: DefaultMaxDepth}
+	res, err := EvalFileContext(context.Background(), fname, expr, opt)
+	if err != nil {
+		PrintError(err)
+		return nil
+	}
+	return res
+}
+
+// PrintError prints err to standard out, one line per error if err is a
+// token.ErrorList.
+func PrintError(err error) {
+	if l, ok := err.(token.ErrorList); ok {
+		for _, s := range l {
+			fmt.Println(s)
+		}
+		return
+	}
+	fmt.Println(err)
+}
+
+// EvalFileContext parses and evaluates expr within the limits set by opt.
+// Evaluation stops as soon as ctx is cancelled or a limit is exceeded. Any
+// parse or runtime errors are returned as a token.ErrorList.
+func EvalFileContext(ctx context.Context, fname, expr string,
+	opt Options) (interface{}, error) {
+	f, n, err := parse(fname, expr, opt)
+	if err != nil {
+		return nil, err
+	}
+	return evalTree(ctx, f, n, opt)
+}
+
+// parse parses expr, restricting its builtins as opt requires
+func parse(fname, expr string, opt Options) (*token.File, *ast.File, error) {
+	var n *ast.File
 	f := token.NewFile(fname, expr, 1)
-	n := parser.ParseFile(f, expr)
+	if opt.Sandbox {
+		for _, c := range opt.Allow {
+			if !parser.IsCapability(c) {
+				return nil, nil, fmt.Errorf("unknown capability: %s", c)
+			}
+		}
+		n = parser.ParseFileSandbox(f, expr, opt.Allow)
+	} else {
+		n = parser.ParseFile(f, expr)
+	}
 	if f.NumErrors() > 0 {
-		f.PrintErrors()
-		return nil
+		return nil, nil, f.Err()
+	}
+	return f, n, nil
+}
+
+// EvalTree resolves, checks and evaluates n like EvalFileContext. The tree
+// need not have been parsed, it may have been decoded from JSON, but its
+// positions must lie within f, in which errors are recorded.
+func EvalTree(ctx context.Context, f *token.File, n *ast.File,
+	opt Options) (interface{}, error) {
+	if !inFile(f, n) {
+		return nil, fmt.Errorf("positions of the tree lie outside %s",
+			f.Name())
+	}
+	if opt.Sandbox {
+		for _, c := range opt.Allow {
+			if !parser.IsCapability(c) {
+				return nil, fmt.Errorf("unknown capability: %s", c)
+			}
+		}
+		parser.CheckCapabilities(f, n, opt.Allow)
+		if f.NumErrors() > 0 {
+			return nil, f.Err()
+		}
 	}
-	e := &evaluator{file: f, scope: n.Scope}
-	res := e.eval(n)
+	return evalTree(ctx, f, n, opt)
+}
+
+// inFile reports whether the positions of n lie within f. Those of the
+// nodes of a tree decoded from JSON lie within those of its File.
+func inFile(f *token.File, n *ast.File) bool {
+	return n.Pos() >= f.Base() && n.End() <= f.Base()+token.Pos(f.Size())
+}
+
+func evalTree(ctx context.Context, f *token.File, n *ast.File,
+	opt Options) (interface{}, error) {
+	e, err := newEvaluator(ctx, f, n, opt)
+	if err != nil {
+		return nil, err
+	}
+	res := e.run(n)
 	if f.NumErrors() > 0 {
-		f.PrintErrors()
-		return nil
+		return nil, f.Err()
 	}
-	return res
+	return res, nil
+}
+
+// newEvaluator resolves and checks n, returning an evaluator for it
+func newEvaluator(ctx context.Context, f *token.File, n *ast.File,
+	opt Options) (*evaluator, error) {
+	resolve.File(f, n)
+	var info *types.Info
+	if f.NumErrors() == 0 {
+		info = types.Check(f, n)
+	}
+	if f.NumErrors() > 0 {
+		return nil, f.Err()
+	}
+	e := &evaluator{ctx: ctx, opt: opt, file: f, info: info,
+		roots: []*ast.File{n}}
+	e.frame = &frame{slots: make([]interface{}, n.NumSlots)}
+	return e, nil
 }
 
 func EvalPackage(path string, fset *token.FileSet) {
 }
 
 type evaluator struct {
+	ctx   context.Context
+	opt   Options
 	file  *token.File
-	scope *ast.Scope // current scope
+	info  *types.Info    // static types, by which bool? is answered
+	fset  *token.FileSet // files of earlier session entries, if any
+	roots []*ast.File    // files declaring the global variables
+	frame *frame         // frame of the function being evaluated
+	steps int            // number of nodes evaluated so far
+	calls []*Call        // active user function calls, innermost last
+	test  *ast.TestExpr  // test being run, if any
 }
 
-/* Scope */
-func (e *evaluator) openScope() {
-	e.scope = ast.NewScope(e.scope)
+// frame holds the arguments and variables of one call, in the slots assigned
+// by the resolver. The file scope has a frame of its own at depth 0.
+type frame struct {
+	slots []interface{}
+	link  *frame // frame of the lexically enclosing function
+	depth int
+	def   *ast.DefineExpr // function called, nil for the file scope
+	test  *ast.TestExpr   // test being run, for the frame of a test
 }
 
-func (e *evaluator) closeScope() {
-	e.scope = e.scope.Parent
+// bailout is used to unwind the evaluator once an error has been recorded
+// which it cannot recover from
+type bailout struct{}
+
+func (e *evaluator) run(n ast.Node) (res interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(bailout); !ok {
+				panic(r)
+			}
+			res = nil
+		}
+	}()
+	return e.eval(n)
+}
+
+// abort records a runtime error at p, with a traceback if it occurred in a
+// user function, and unwinds the evaluator
+func (e *evaluator) abort(p token.Pos, args ...interface{}) {
+	e.fileOf(p).AddErrorTrace(p, e.traceback(p), args...)
+	panic(bailout{})
+}
+
+// fileOf returns the file containing p
+func (e *evaluator) fileOf(p token.Pos) *token.File {
+	if e.fset != nil && !e.file.ValidPos(p) {
+		if f := e.fset.File(p); f != nil {
+			return f // in a function defined by an earlier entry
+		}
+	}
+	return e.file
+}
+
+/* Limits */
+func (e *evaluator) step(n ast.Node) {
+	e.steps++
+	if e.opt.MaxSteps > 0 && e.steps > e.opt.MaxSteps {
+		e.abort(n.Pos(), "Evaluation step limit of ", e.opt.MaxSteps,
+			" exceeded")
+	}
+	select {
+	case <-e.ctx.Done():
+		e.abort(n.Pos(), "Evaluation stopped: ", e.ctx.Err())
+	default:
+	}
+}
+
+func (e *evaluator) alloc(n ast.Node) {
+	if e.opt.Alloc != nil {
+		e.opt.Alloc(n)
+	}
+}
+
+func (e *evaluator) checkSize(n ast.Node, s string) {
+	if e.opt.MaxSize > 0 && len(s) > e.opt.MaxSize {
+		e.abort(n.Pos(), "String length limit of ", e.opt.MaxSize,
+			" exceeded")
+	}
+}
+
+/* Frames */
+
+// frameAt returns the active frame of the scope at the given depth
+func (e *evaluator) frameAt(depth int) *frame {
+	f := e.frame
+	for f.depth > depth {
+		f = f.link
+	}
+	return f
+}
+
+func (e *evaluator) slot(obj *ast.Object) *interface{} {
+	return &e.frameAt(obj.Depth).slots[obj.Index]
 }
 
 /* Evaluation */
@@ -57,15 +276,28 @@ func (e *evaluator) eval(n interface{}) interface{} {
 	if n == nil {
 		return nil
 	}
+	if node, ok := n.(ast.Node); ok {
+		e.step(node)
+		if e.opt.Debug != nil {
+			e.opt.Debug(node, &State{e})
+		}
+	}
 	switch node := n.(type) {
+	case *ast.AssertEqualExpr:
+		e.evalAssertEqualExpr(node)
+		return nil
+	case *ast.AssertExpr:
+		return e.evalAssertExpr(node)
 	case *ast.CaseExpr:
 		return e.evalCaseExpr(node)
 	case *ast.CompExpr:
 		return e.evalCompExpr(node)
 	case *ast.ConcatExpr:
 		return e.evalConcatExpr(node)
+	case *ast.ConvExpr:
+		return e.evalConvExpr(node)
 	case *ast.DefineExpr:
-		e.evalDefineExpr(node)
+		return nil // functions are bound by the resolver
 	case *ast.File:
 		var x interface{}
 		for _, n := range node.Nodes {
@@ -78,13 +310,18 @@ func (e *evaluator) eval(n interface{}) interface{} {
 		}
 		return x
 	case *ast.Identifier:
-		return e.eval(e.scope.Lookup(node.Lit))
+		if node.Obj == nil || node.Obj.Kind == ast.Fun {
+			return nil
+		}
+		return *e.slot(node.Obj)
 	case *ast.IfExpr:
 		return e.evalIfExpr(node)
 	case *ast.MathExpr:
 		return e.evalMathExpr(node)
 	case *ast.Number:
 		return node.Val
+	case *ast.PredExpr:
+		return e.evalPredExpr(node)
 	case *ast.PrintExpr:
 		e.evalPrintExpr(node)
 		return nil
@@ -95,6 +332,8 @@ func (e *evaluator) eval(n interface{}) interface{} {
 		return node.Lit[1 : len(node.Lit)-1]
 	case *ast.SwitchExpr:
 		e.evalSwitchExpr(node)
+	case *ast.TestExpr:
+		return nil // tests are run by RunTests
 	case *ast.UserExpr:
 		return e.evalUserExpr(node)
 	default:
@@ -103,6 +342,23 @@ func (e *evaluator) eval(n interface{}) interface{} {
 	return nil // unreachable
 }
 
+func (e *evaluator) evalAssertEqualExpr(a *ast.AssertEqualExpr) {
+	want, got := e.eval(a.Nodes[0]), e.eval(a.Nodes[1])
+	if want != got {
+		e.abort(a.Pos(), "Assertion failed: expected ", format(want),
+			", got ", format(got))
+	}
+}
+
+func (e *evaluator) evalAssertExpr(a *ast.AssertExpr) interface{} {
+	v := e.eval(a.Nodes[0])
+	t, _ := types.Lookup(a.Type)
+	if vt := types.ValueType(v); vt != t {
+		e.abort(a.Pos(), "Type assertion failed: expected ", t, ", got ", vt)
+	}
+	return v
+}
+
 func (e *evaluator) evalCaseExpr(ce *ast.CaseExpr) interface{} {
 	if e.eval(ce.Nodes[0]) == 1 {
 		for _, n := range ce.Nodes[1:] {
@@ -149,14 +405,26 @@ func (e *evaluator) evalConcatExpr(ce *ast.ConcatExpr) interface{} {
 				s += t
 			case int:
 				s += strconv.Itoa(t)
+			case float64:
+				s += types.FormatFloat(t)
 			}
 		}
 	}
+	e.alloc(ce)
+	e.checkSize(ce, s)
 	return s
 }
 
-func (e *evaluator) evalDefineExpr(d *ast.DefineExpr) {
-	e.scope.Insert(d.Name, d)
+func (e *evaluator) evalConvExpr(c *ast.ConvExpr) interface{} {
+	v, err := types.Convert(e.eval(c.Nodes[0]), types.Conversion(c.ConvLit))
+	if err != nil {
+		e.abort(c.Pos(), err)
+	}
+	if s, ok := v.(string); ok {
+		e.alloc(c)
+		e.checkSize(c, s)
+	}
+	return v
 }
 
 func (e *evaluator) evalIfExpr(i *ast.IfExpr) interface{} {
@@ -176,9 +444,15 @@ func (e *evaluator) evalMathExpr(m *ast.MathExpr) interface{} {
 	case "*":
 		return e.evalMathFunc(m.Nodes, func(a, b int) int { return a * b })
 	case "/":
-		return e.evalMathFunc(m.Nodes, func(a, b int) int { return a / b })
+		return e.evalMathFunc(m.Nodes, func(a, b int) int {
+			e.checkDivisor(m, b)
+			return a / b
+		})
 	case "%":
-		return e.evalMathFunc(m.Nodes, func(a, b int) int { return a % b })
+		return e.evalMathFunc(m.Nodes, func(a, b int) int {
+			e.checkDivisor(m, b)
+			return a % b
+		})
 	case "and":
 		return e.evalMathFunc(m.Nodes,
 			func(a, b int) int { return btoi(itob(a) && itob(b)) })
@@ -190,6 +464,12 @@ func (e *evaluator) evalMathExpr(m *ast.MathExpr) interface{} {
 	}
 }
 
+func (e *evaluator) checkDivisor(m *ast.MathExpr, b int) {
+	if b == 0 {
+		e.abort(m.Pos(), "Division by zero")
+	}
+}
+
 func (e *evaluator) evalMathFunc(list []ast.Node, fn func(int, int) int) int {
 	a, ok := e.eval(list[0]).(int)
 	if !ok {
@@ -205,16 +485,41 @@ func (e *evaluator) evalMathFunc(list []ast.Node, fn func(int, int) int) int {
 	return a
 }
 
+func (e *evaluator) evalPredExpr(p *ast.PredExpr) interface{} {
+	// functions are not values, so function? can only be given a name
+	if i, ok := p.Nodes[0].(*ast.Identifier); ok && i.Obj != nil &&
+		i.Obj.Kind == ast.Fun {
+		return btoi(p.PredLit == "function?")
+	}
+	// a bool is an int at run time, so only its static type tells them apart
+	if p.PredLit == "bool?" {
+		e.eval(p.Nodes[0])
+		return btoi(e.info.TypeOf(p.Nodes[0]) == types.Bool)
+	}
+	switch types.ValueType(e.eval(p.Nodes[0])) {
+	case types.Int, types.Float:
+		return btoi(p.PredLit == "number?")
+	case types.String:
+		return btoi(p.PredLit == "string?")
+	}
+	return 0 // there are no list values
+}
+
 func (e *evaluator) evalPrintExpr(p *ast.PrintExpr) {
 	args := make([]interface{}, len(p.Nodes))
 	for i, n := range p.Nodes {
 		args[i] = e.eval(n)
 	}
-	fmt.Println(args...)
+	w := e.opt.Stdout
+	if w == nil {
+		w = os.Stdout
+	}
+	fmt.Fprintln(w, args...)
 }
 
 func (e *evaluator) evalSetExpr(s *ast.SetExpr) {
-	e.scope.Insert(s.Name, s.Value)
+	v := e.eval(s.Value)
+	*e.slot(s.Obj) = v
 }
 
 func (e *evaluator) evalSwitchExpr(s *ast.SwitchExpr) {
@@ -239,19 +544,28 @@ func (e *evaluator) evalSwitchExpr(s *ast.SwitchExpr) {
 }
 
 func (e *evaluator) evalUserExpr(u *ast.UserExpr) interface{} {
-	n := e.scope.Lookup(u.Name)
-	d, _ := n.(*ast.DefineExpr)
-	e.openScope()
-	args := make([]interface{}, len(d.Args))
-	for i, _ := range args {
+	d := u.Obj.Decl.(*ast.DefineExpr)
+	if e.opt.MaxDepth > 0 && len(e.calls) >= e.opt.MaxDepth {
+		e.abort(u.Pos(), "Maximum call depth of ", e.opt.MaxDepth,
+			" exceeded in call to ", u.Name)
+	}
+	f := &frame{slots: make([]interface{}, d.NumSlots),
+		link: e.frameAt(u.Obj.Depth), depth: u.Obj.Depth + 1, def: d}
+	e.alloc(u)
+	for i := range d.Args {
 		if len(u.Nodes) <= i {
 			break
 		}
-		args[i] = e.eval(u.Nodes[i])
+		f.slots[i] = e.eval(u.Nodes[i])
 	}
-	for i, v := range args {
-		e.scope.Insert(d.Args[i], v)
+	args := append([]interface{}{}, f.slots[:len(d.Args)]...)
+	c := &Call{Name: u.Name, Def: d, Pos: u.Pos(), Args: args, frame: f}
+	e.calls = append(e.calls, c)
+	if e.opt.Enter != nil {
+		e.opt.Enter(c)
 	}
+	caller := e.frame
+	e.frame = f
 	var r interface{}
 	for _, v := range d.Nodes {
 		r = e.eval(v)
@@ -259,6 +573,10 @@ func (e *evaluator) evalUserExpr(u *ast.UserExpr) interface{} {
 			break
 		}
 	}
-	e.closeScope()
+	e.frame = caller
+	if e.opt.Exit != nil {
+		e.opt.Exit(c, r)
+	}
+	e.calls = e.calls[:len(e.calls)-1]
 	return r
 }
@@ -1,8 +1,13 @@
 package eval_test
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"github.com/rthornton128/gocalc/eval"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestEvalAddition(t *testing.T) {
@@ -27,6 +32,296 @@ func TestEvalAddition(t *testing.T) {
 	}
 }
 
+func TestEvalSandbox(t *testing.T) {
+	var tests = []struct {
+		expr  string
+		allow []string
+		err   string
+	}{
+		{"(+ 1 2)", nil, ""},
+		{"(print 1)", nil,
+			"Line: 1 Column: 1 - 'print' is not permitted: requires capability io"},
+		{"(print 1)", []string{"io"}, ""},
+		// only print requires a capability as yet
+		{"(print 1)", []string{"env", "fs", "random", "time"},
+			"Line: 1 Column: 1 - 'print' is not permitted: requires capability io"},
+		{"(+ 1 2)", []string{"env", "fs", "random", "time"}, ""},
+		{"(+ 1 2)", []string{"net"}, "unknown capability: net"},
+	}
+	for i, test := range tests {
+		var buf bytes.Buffer
+		_, err := eval.EvalFileContext(context.Background(), "", test.expr,
+			eval.Options{Sandbox: true, Allow: test.allow, Stdout: &buf})
+		if test.err == "" {
+			if err != nil {
+				t.Fatal(i, "- Unexpected error:", err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.err {
+			t.Log(i, "- Expected:", test.err)
+			t.Fatal(i, "- Got:", err)
+		}
+	}
+}
+
+func TestEvalLimits(t *testing.T) {
+	var tests = []struct {
+		expr string
+		opt  eval.Options
+		err  string
+	}{
+		{"(define (f x) (f x)) (f 1)", eval.Options{MaxDepth: 100},
+			"Traceback (most recent call last):\n" +
+				"  Line 1, column 22, in <file>\n" +
+				"    (define (f x) (f x)) (f 1)\n" +
+				strings.Repeat("  Line 1, column 15, in (f 1)\n"+
+					"    (define (f x) (f x)) (f 1)\n", 3) +
+				"  [Previous frame repeated 97 more times]\n" +
+				"Line: 1 Column: 15 - Maximum call depth of 100 exceeded in call to f"},
+		{"(+ 1 (+ 2 3))", eval.Options{MaxSteps: 3},
+			"Line: 1 Column: 6 - Evaluation step limit of 3 exceeded"},
+		{"(define (f s) (f (+ \"ab\" s))) (f \"\")", eval.Options{MaxSize: 8},
+			"Traceback (most recent call last):\n" +
+				"  Line 1, column 31, in <file>\n" +
+				"    (define (f s) (f (+ \"ab\" s))) (f \"\")\n" +
+				"  Line 1, column 15, in (f \"\")\n" +
+				"    (define (f s) (f (+ \"ab\" s))) (f \"\")\n" +
+				"  Line 1, column 15, in (f \"ab\")\n" +
+				"    (define (f s) (f (+ \"ab\" s))) (f \"\")\n" +
+				"  Line 1, column 15, in (f \"abab\")\n" +
+				"    (define (f s) (f (+ \"ab\" s))) (f \"\")\n" +
+				"  [Previous frame repeated 1 more time]\n" +
+				"  Line 1, column 18, in (f \"abababab\")\n" +
+				"    (define (f s) (f (+ \"ab\" s))) (f \"\")\n" +
+				"Line: 1 Column: 18 - String length limit of 8 exceeded"},
+		{"(+ 1 (+ 2 3))", eval.Options{MaxSteps: 6}, ""},
+	}
+	for x, test := range tests {
+		_, err := eval.EvalFileContext(context.Background(), "", test.expr,
+			test.opt)
+		if test.err == "" {
+			if err != nil {
+				t.Fatal(x, "- Unexpected error:", err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.err {
+			t.Log(x, "- Expected:", test.err)
+			t.Fatal(x, "- Got:", err)
+		}
+	}
+}
+
+func TestEvalTypes(t *testing.T) {
+	var tests = []struct {
+		expr string
+		res  interface{}
+		err  string
+	}{
+		{"(number? 1)", 1, ""},
+		{"(number? (float 1))", 1, ""},
+		{"(number? \"1\")", 0, ""},
+		{"(string? \"1\")", 1, ""},
+		{"(bool? (= 1 1))", 1, ""},
+		{"(bool? (and 1 (number? 2)))", 1, ""},
+		{"(bool? 1)", 0, ""},
+		{"(set b (< 1 2)) (bool? b)", 1, ""},
+		{"(set b (< 1 2)) (set b 5) (bool? b)", 0, ""},
+		{"(define (f x) (> x 0)) (bool? (f 1))", 1, ""},
+		{"(list? 1)", 0, ""},
+		{"(define (f) 1) (function? f)", 1, ""},
+		{"(define (f) 1) (number? f)", 0, ""},
+		{"(function? 1)", 0, ""},
+		{"(int \" 42 \")", 42, ""},
+		{"(int (float \"2.75\"))", 2, ""},
+		{"(str 42)", "42", ""},
+		{"(str (float \"0.5\"))", "0.5", ""},
+		// int, float and str convert only at the head of an expression
+		{"(set int \"7\") (int int)", 7, ""},
+		{"(define (f str) (+ \"n=\" (str str))) (f 1)", "n=1", ""},
+		{"(define (float x) (* x 2)) (float 3)", 6, ""},
+		{"(+ \"n=\" (float 3))", "n=3", ""},
+		{"(define (f x) (assert-type x int)) (+ (f 2) 1)", 3, ""},
+		{"(int \"abc\")", nil,
+			"Line: 1 Column: 1 - Cannot convert \"abc\" to int"},
+		{"(define (f x) (assert-type x int)) (f \"a\")", nil,
+			"Traceback (most recent call last):\n" +
+				"  Line 1, column 36, in <file>\n" +
+				"    (define (f x) (assert-type x int)) (f \"a\")\n" +
+				"  Line 1, column 15, in (f \"a\")\n" +
+				"    (define (f x) (assert-type x int)) (f \"a\")\n" +
+				"Line: 1 Column: 15 - Type assertion failed: expected int, got string"},
+		{"(assert-type \"a\" int)", nil,
+			"Line: 1 Column: 1 - Type assertion can never succeed: expected int, got string"},
+	}
+	for x, test := range tests {
+		res, err := eval.EvalFileContext(context.Background(), "", test.expr,
+			eval.Options{})
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Log(x, "- Expected:", test.err)
+				t.Fatal(x, "- Got:", err)
+			}
+			continue
+		}
+		if err != nil || res != test.res {
+			t.Log(x, "- Expected:", test.res)
+			t.Fatal(x, "- Got:", res, err)
+		}
+	}
+}
+
+func TestTraceback(t *testing.T) {
+	const src = `(define (div a b)
+	(/ a b))
+(define (mean total n)
+	(div total n))
+(print (mean 10 2))
+(mean 10 0)`
+	want := "Traceback (most recent call last):\n" +
+		"  File \"mean.calc\", line 6, column 1, in <file>\n" +
+		"    (mean 10 0)\n" +
+		"  File \"mean.calc\", line 4, column 2, in (mean 10 0)\n" +
+		"    (div total n))\n" +
+		"  File \"mean.calc\", line 2, column 2, in (div 10 0)\n" +
+		"    (/ a b))\n" +
+		"mean.calc - Line: 2 Column: 2 - Division by zero"
+	var out bytes.Buffer
+	_, err := eval.EvalFileContext(context.Background(), "mean.calc", src,
+		eval.Options{Stdout: &out})
+	if out.String() != "5\n" || err == nil || err.Error() != want {
+		t.Log("Expected:", want)
+		t.Fatal("Got:", out.String(), err)
+	}
+	_, err = eval.EvalFileContext(context.Background(), "", "(% 1 0)",
+		eval.Options{})
+	if err == nil || err.Error() != "Line: 1 Column: 1 - Division by zero" {
+		t.Fatal("Unexpected error:", err)
+	}
+}
+
+func TestEvalCancel(t *testing.T) {
+	expr := "(define (f x) (if (= x 0) 0 (+ (f (- x 1)) (f (- x 1))))) (f 40)"
+	ctx, cancel := context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer cancel()
+	_, err := eval.EvalFileContext(ctx, "", expr, eval.Options{})
+	if err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Fatal("Expected deadline to stop evaluation, got:", err)
+	}
+}
+
+func TestSession(t *testing.T) {
+	var tests = []struct {
+		src string
+		res interface{}
+		err string
+	}{
+		{"(define (sq x) (* x x))", nil, ""},
+		{"(set a (sq 3))", nil, ""},
+		{"(sq a)", 81, ""},
+		{"(set a \"s\")", nil,
+			"Cannot set a of type int to a value of type string"},
+		{"(+ a 1)", 10, ""},
+		{"(sq b)", nil, "Undeclared identifier: b"},
+		{"(define (f x) (f x))", nil, ""},
+		{"(f 1)", nil, "<input 7> - Line: 1 Column: 15 - Maximum call depth"},
+		{"(set a (+ a 1)) (+ a 0)", 10, ""},
+	}
+	s := eval.NewSession(eval.Options{MaxDepth: 100})
+	for x, test := range tests {
+		name := fmt.Sprintf("<input %d>", x+1)
+		res, err := s.Eval(context.Background(), name, test.src)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Log(x, "- Expected:", test.err)
+				t.Fatal(x, "- Got:", err)
+			}
+			continue
+		}
+		if err != nil || res != test.res {
+			t.Log(x, "- Expected:", test.res)
+			t.Fatal(x, "- Got:", res, err)
+		}
+	}
+}
+
+func TestSessionInspect(t *testing.T) {
+	s := eval.NewSession(eval.Options{})
+	for i, src := range []string{
+		"(define (sq x) (* x x)) (set a (sq 3))",
+		"(set name \"bob\") (str a)",
+		"(define (sq x) (+ x x)) (set a (sq a))",
+	} {
+		_, err := s.Eval(context.Background(), fmt.Sprint(i), src)
+		if err != nil {
+			t.Fatal(i, "- Unexpected error:", err)
+		}
+	}
+	var list []string
+	for _, b := range s.Bindings() {
+		list = append(list, b.String())
+	}
+	env := strings.Join(list, "\n")
+	want := "a:int = 18\nname:string = \"bob\"\n(sq:int x:int)"
+	if env != want {
+		t.Log("Expected:", want)
+		t.Fatal("Got:", env)
+	}
+	src := s.Source()
+	want = "(set a (sq 3))\n(set name \"bob\")\n" +
+		"(define (sq x) (+ x x))\n(set a (sq a))\n"
+	if src != want {
+		t.Log("Expected:", want)
+		t.Fatal("Got:", src)
+	}
+	if typ, err := s.TypeOf("", "(str name)"); err != nil ||
+		typ.String() != "string" {
+		t.Fatal("Expected string, got:", typ, err)
+	}
+	if _, err := s.TypeOf("", "(sq b)"); err == nil {
+		t.Fatal("Expected an error for an undeclared identifier")
+	}
+	s.Reset()
+	if len(s.Bindings()) != 0 || s.Source() != "" {
+		t.Fatal("Expected an empty session after Reset")
+	}
+}
+
+func TestSessionDiscard(t *testing.T) {
+	s := eval.NewSession(eval.Options{MaxDepth: 100})
+	for i, src := range []string{
+		"(define (id x) x) (define (f x) (f x))",
+		"(set a (id 1)) (define (g) 1) (f 1)",
+	} {
+		_, err := s.Eval(context.Background(), fmt.Sprint(i), src)
+		if (err != nil) != (i == 1) {
+			t.Fatal(i, "- Unexpected result:", err)
+		}
+	}
+	if _, err := s.TypeOf("", "(set b (id \"s\"))"); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	var list []string
+	for _, b := range s.Bindings() {
+		list = append(list, b.String())
+	}
+	env := strings.Join(list, "\n")
+	want := "(f x)\n(id x)"
+	if env != want {
+		t.Log("Expected:", want)
+		t.Fatal("Got:", env)
+	}
+	if _, err := s.Eval(context.Background(), "", "(g)"); err == nil ||
+		!strings.Contains(err.Error(), "Undeclared identifier: g") {
+		t.Fatal("Expected g to be undeclared, got:", err)
+	}
+	if _, err := s.Eval(context.Background(), "", "(set a \"s\")"); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+}
+
 /*
 func TestEvalSubtraction(t *testing.T) {
 	var tests = []struct {
@@ -109,3 +404,103 @@ func TestEvalSet(t *testing.T) {
 		}
 	}
 }*/
+
+func TestTracer(t *testing.T) {
+	const src = `(define (fib x)
+	(if (or (= x 0) (= x 1)) x (+ (fib (- x 1)) x)))
+(define (greet name) (+ "hi " name))
+(greet "bob")
+(fib 3)`
+	var tests = []struct {
+		funcs []string
+		want  string
+	}{
+		{nil, "-> (greet \"bob\")\n" +
+			"<- (greet \"bob\") = \"hi bob\"\n" +
+			"-> (fib 3)\n" +
+			"  -> (fib 2)\n" +
+			"    -> (fib 1)\n" +
+			"    <- (fib 1) = 1\n" +
+			"  <- (fib 2) = 3\n" +
+			"<- (fib 3) = 6\n"},
+		{[]string{"greet"}, "-> (greet \"bob\")\n" +
+			"<- (greet \"bob\") = \"hi bob\"\n"},
+	}
+	for i, test := range tests {
+		var buf bytes.Buffer
+		tr := &eval.Tracer{W: &buf, Funcs: test.funcs}
+		_, err := eval.EvalFileContext(context.Background(), "", src,
+			eval.Options{Enter: tr.Enter, Exit: tr.Exit})
+		if err != nil || buf.String() != test.want {
+			t.Log(i, "- Expected:", test.want)
+			t.Fatal(i, "- Got:", buf.String(), err)
+		}
+	}
+}
+
+func TestRunTests(t *testing.T) {
+	src := `(define (sq x) (* x x))
+(define (div a b) (/ a b))
+(set base 2)
+(deftest square
+	(set n (sq base))
+	(assert-equal 4 n))
+(deftest square-wrong
+	(assert-equal 5 (sq base)))
+(deftest greeting
+	(set n "hi")
+	(assert-equal "hi" n))
+(deftest divide
+	(div 1 0)
+	(print "not reached"))`
+	var tests = []struct {
+		run  string
+		want []string
+	}{
+		{"", []string{"square: ok",
+			"square-wrong: t.calc - Line: 8 Column: 2 - Assertion failed: " +
+				"expected 5, got 4",
+			"greeting: ok",
+			"divide: Traceback (most recent call last):\n" +
+				"  File \"t.calc\", line 13, column 2, in (deftest divide)\n" +
+				"    (div 1 0)\n" +
+				"  File \"t.calc\", line 2, column 19, in (div 1 0)\n" +
+				"    (define (div a b) (/ a b))\n" +
+				"t.calc - Line: 2 Column: 19 - Division by zero"}},
+		{"square", []string{"square: ok"}},
+		{"nothing", nil},
+	}
+	for i, test := range tests {
+		var match func(string) bool
+		if test.run != "" {
+			match = func(name string) bool { return name == test.run }
+		}
+		var out bytes.Buffer
+		res, err := eval.RunTests(context.Background(), "t.calc", src,
+			eval.Options{Stdout: &out}, match)
+		if err != nil {
+			t.Fatal(i, "- Unexpected error:", err)
+		}
+		var got []string
+		for _, r := range res {
+			s := r.Name + ": ok"
+			if r.Err != nil {
+				s = r.Name + ": " + r.Err.Error()
+			}
+			got = append(got, s)
+		}
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Log(i, "- Expected:", test.want)
+			t.Fatal(i, "- Got:", got)
+		}
+		if out.Len() != 0 {
+			t.Fatal(i, "- Unexpected output:", out.String())
+		}
+	}
+	_, err := eval.EvalFileContext(context.Background(), "", "(define (f) 3)\n"+
+		"(assert-equal 3 (f))\n(assert-equal 4 (f))", eval.Options{})
+	if err == nil || err.Error() !=
+		"Line: 3 Column: 1 - Assertion failed: expected 4, got 3" {
+		t.Fatal("Unexpected error:", err)
+	}
+}
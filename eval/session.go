@@ -0,0 +1,239 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+package eval
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/rthornton128/gocalc/ast"
+	"github.com/rthornton128/gocalc/parser"
+	"github.com/rthornton128/gocalc/resolve"
+	"github.com/rthornton128/gocalc/token"
+	"github.com/rthornton128/gocalc/types"
+	"strconv"
+	"strings"
+)
+
+// Session evaluates a sequence of entries, such as those typed at the REPL,
+// each of which sees the functions and variables defined by those before.
+type Session struct {
+	opt   Options
+	fset  *token.FileSet
+	files []*token.File
+	roots []*ast.File
+	srcs  []string
+	scope *ast.Scope // parser scope of the latest entry
+	env   *resolve.Env
+	info  *types.Info
+	frame *frame
+}
+
+// NewSession returns an empty session whose entries are evaluated within
+// the limits set by opt.
+func NewSession(opt Options) *Session {
+	return &Session{opt: opt, fset: token.NewFileSet(), env: resolve.NewEnv(),
+		info: types.NewInfo(), frame: new(frame)}
+}
+
+// Eval parses and evaluates src as the next entry of the session. An entry
+// with parse, type or run time errors is discarded, as if it had never been
+// entered, though any output it wrote and the variables it set before the
+// error remain. Errors are returned as a token.ErrorList.
+func (s *Session) Eval(ctx context.Context, name, src string) (interface{},
+	error) {
+	f, n, env, info, err := s.check(name, src)
+	if err != nil {
+		return nil, err
+	}
+	prev := *s
+	s.files = append(s.files, f)
+	s.roots = append(s.roots, n)
+	s.srcs = append(s.srcs, src)
+	s.scope, s.env = n.Scope, env
+	slots := len(s.frame.slots)
+	for len(s.frame.slots) < n.NumSlots {
+		s.frame.slots = append(s.frame.slots, nil)
+	}
+
+	before := make([]int, len(s.files))
+	for i, f := range s.files {
+		before[i] = f.NumErrors()
+	}
+	e := &evaluator{ctx: ctx, opt: s.opt, file: f, info: info,
+		fset: s.fset, roots: s.roots, frame: s.frame}
+	res := e.run(n)
+	var errs token.ErrorList
+	for i, f := range s.files {
+		if f.NumErrors() > before[i] {
+			errs = append(errs, f.Err().(token.ErrorList)[before[i]:]...)
+		}
+	}
+	if len(errs) > 0 {
+		*s = prev
+		s.frame.slots = s.frame.slots[:slots]
+		return nil, errs
+	}
+	s.info = info
+	return res, nil
+}
+
+// TypeOf returns the static type of the last expression in src, which is
+// checked as if it were the next entry but is neither evaluated nor kept.
+func (s *Session) TypeOf(name, src string) (types.Type, error) {
+	_, n, _, info, err := s.check(name, src)
+	if err != nil {
+		return types.Unknown, err
+	}
+	if len(n.Nodes) == 0 {
+		return types.Nil, nil
+	}
+	return info.TypeOf(n.Nodes[len(n.Nodes)-1]), nil
+}
+
+// Parse parses src in the scope of the session without resolving,
+// checking or keeping it. Errors are returned as a token.ErrorList.
+func (s *Session) Parse(name, src string) (*ast.File, error) {
+	f := s.fset.AddFile(name, src)
+	n := parser.ParseFileScope(f, src, s.scope, nil)
+	if f.NumErrors() > 0 {
+		return nil, f.Err()
+	}
+	return n, nil
+}
+
+// FileSet returns the files of the session's entries, and of those parsed
+// or checked in its scope.
+func (s *Session) FileSet() *token.FileSet {
+	return s.fset
+}
+
+// check parses, resolves and type checks src in the scope of the session,
+// returning the environment and type information which include it without
+// changing those of the session.
+func (s *Session) check(name, src string) (*token.File, *ast.File,
+	*resolve.Env, *types.Info, error) {
+	var allow []string
+	if s.opt.Sandbox {
+		for _, c := range s.opt.Allow {
+			if !parser.IsCapability(c) {
+				return nil, nil, nil, nil, fmt.Errorf("unknown capability: %s",
+					c)
+			}
+		}
+		allow = append([]string{}, s.opt.Allow...)
+	}
+	f := s.fset.AddFile(name, src)
+	n := parser.ParseFileScope(f, src, s.scope, allow)
+	env := s.env.Copy()
+	if f.NumErrors() == 0 {
+		env.File(f, n)
+	}
+	info := s.info.Copy()
+	if f.NumErrors() == 0 {
+		info.CheckFile(f, n)
+	}
+	if f.NumErrors() > 0 {
+		return nil, nil, nil, nil, f.Err()
+	}
+	return f, n, env, info, nil
+}
+
+// Reset discards every entry, leaving the session as it was when created.
+func (s *Session) Reset() {
+	*s = *NewSession(s.opt)
+}
+
+// Names returns the names of the functions and variables defined in the
+// session, in sorted order.
+func (s *Session) Names() []string {
+	if s.scope == nil {
+		return nil
+	}
+	return s.scope.Names()
+}
+
+// Binding is a function or variable defined in a session.
+type Binding struct {
+	Obj   *ast.Object
+	Type  types.Type   // of a variable, or the result of a function
+	Args  []types.Type // of the arguments of a function
+	Value interface{}  // of a variable
+}
+
+// String returns the signature of a function, with any types which are
+// known, or the name, type and value of a variable.
+func (b Binding) String() string {
+	if b.Obj.Kind == ast.Fun {
+		def := b.Obj.Decl.(*ast.DefineExpr)
+		list := []string{typed(b.Obj.Name, b.Type)}
+		for i, a := range def.Args {
+			if i < len(b.Args) {
+				a = typed(a, b.Args[i])
+			}
+			list = append(list, a)
+		}
+		return "(" + strings.Join(list, " ") + ")"
+	}
+	v := fmt.Sprint(b.Value)
+	if s, ok := b.Value.(string); ok {
+		v = strconv.Quote(s)
+	}
+	return typed(b.Obj.Name, b.Type) + " = " + v
+}
+
+func typed(name string, t types.Type) string {
+	if t == types.Unknown {
+		return name
+	}
+	return name + ":" + t.String()
+}
+
+// Bindings returns the functions and variables defined in the session, in
+// order of name.
+func (s *Session) Bindings() []Binding {
+	var list []Binding
+	for _, name := range s.env.Names() {
+		obj := s.env.Lookup(name)
+		b := Binding{Obj: obj, Type: s.info.Objects[obj]}
+		switch obj.Kind {
+		case ast.Fun:
+			b.Args = s.info.Args[obj.Decl.(*ast.DefineExpr)]
+		case ast.Var:
+			b.Value = s.frame.slots[obj.Index]
+		}
+		list = append(list, b)
+	}
+	return list
+}
+
+// Source returns the source of the top level sets of every entry, and of
+// the defines which have not been replaced, in the order they were entered,
+// one to a line.
+func (s *Session) Source() string {
+	var buf bytes.Buffer
+	for i, n := range s.roots {
+		base := s.files[i].Base()
+		for _, node := range n.Nodes {
+			switch node := node.(type) {
+			case *ast.DefineExpr:
+				if obj := s.env.Lookup(node.Name); obj == nil ||
+					obj.Decl != node {
+					continue // redefined by a later entry
+				}
+			case *ast.SetExpr:
+			default:
+				continue
+			}
+			beg, end := node.Pos()-base, node.End()-base+1
+			buf.WriteString(s.srcs[i][beg:end])
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.String()
+}
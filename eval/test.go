@@ -0,0 +1,82 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+package eval
+
+import (
+	"context"
+	"github.com/rthornton128/gocalc/ast"
+	"github.com/rthornton128/gocalc/token"
+)
+
+// TestResult is the outcome of a test declared with deftest.
+type TestResult struct {
+	Name string
+	Pos  token.Position // of the deftest
+	Err  error          // why the test failed, as a token.ErrorList, or nil
+}
+
+// RunTests parses and evaluates expr like EvalFileContext, then runs each
+// test declared in it whose name is accepted by match, or every test if
+// match is nil. A test is run in a scope of its own, so the variables it
+// sets are not seen by the tests after it, and stops at its first error,
+// such as a failed assert-equal. The results are returned in source order.
+//
+// A file without tests to run is not evaluated. Errors in a file which
+// prevent its tests from running are returned as a token.ErrorList.
+func RunTests(ctx context.Context, fname, expr string, opt Options,
+	match func(name string) bool) ([]TestResult, error) {
+	f, n, err := parse(fname, expr, opt)
+	if err != nil {
+		return nil, err
+	}
+	var tests []*ast.TestExpr
+	for _, node := range n.Nodes {
+		t, ok := node.(*ast.TestExpr)
+		if ok && (match == nil || match(t.Name)) {
+			tests = append(tests, t)
+		}
+	}
+	if len(tests) == 0 {
+		return nil, nil
+	}
+	e, err := newEvaluator(ctx, f, n, opt)
+	if err != nil {
+		return nil, err
+	}
+	if e.run(n); f.NumErrors() > 0 {
+		return nil, f.Err()
+	}
+	global := e.frame
+	list := make([]TestResult, len(tests))
+	for i, t := range tests {
+		errs := f.NumErrors()
+		e.frame = &frame{slots: make([]interface{}, t.NumSlots),
+			link: global, depth: 1, test: t}
+		e.calls, e.steps, e.test = nil, 0, t
+		e.runTest(t)
+		list[i] = TestResult{Name: t.Name, Pos: f.Position(t.Pos())}
+		if f.NumErrors() > errs {
+			list[i].Err = f.Err().(token.ErrorList)[errs:]
+		}
+	}
+	return list, nil
+}
+
+// runTest evaluates the body of t until it ends or an error occurs
+func (e *evaluator) runTest(t *ast.TestExpr) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(bailout); !ok {
+				panic(r)
+			}
+		}
+	}()
+	for _, n := range t.Nodes {
+		e.eval(n)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+package eval
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Tracer logs each call of a user function and its result to W, indented
+// by the number of traced calls enclosing it. Its Enter and Exit methods
+// are used as the hooks of the same name in Options.
+type Tracer struct {
+	W     io.Writer
+	Funcs []string // names of the functions to trace, all if empty
+
+	depth int
+}
+
+// traced reports whether calls of the function name are logged
+func (t *Tracer) traced(name string) bool {
+	if len(t.Funcs) == 0 {
+		return true
+	}
+	for _, f := range t.Funcs {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Enter logs the call c.
+func (t *Tracer) Enter(c *Call) {
+	if t.traced(c.Name) {
+		fmt.Fprintf(t.W, "%s-> %s\n", strings.Repeat("  ", t.depth), expr(c))
+		t.depth++
+	}
+}
+
+// Exit logs the return of res from the call c.
+func (t *Tracer) Exit(c *Call, res interface{}) {
+	if !t.traced(c.Name) {
+		return
+	}
+	t.depth--
+	s := ""
+	if res != nil {
+		s = " = " + format(res)
+	}
+	fmt.Fprintf(t.W, "%s<- %s%s\n", strings.Repeat("  ", t.depth), expr(c), s)
+}
+
+// expr formats c as the expression which made it
+func expr(c *Call) string {
+	list := []string{c.Name}
+	for _, a := range c.Args {
+		list = append(list, format(a))
+	}
+	return "(" + strings.Join(list, " ") + ")"
+}
@@ -0,0 +1,336 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+// Package format implements the canonical layout of Calc source code.
+//
+// An expression is printed on a single line if it fits within 80 columns
+// and contains no comments. Otherwise its elements are printed one per line,
+// indented by a tab, except for the leading elements which identify it: the
+// name and arguments of a define, the condition of an if, the predicate of
+// a switch and so on. A define whose body has more than one expression, or
+// an if, switch or define, is always broken over several lines, as is every
+// switch and any case with more than one expression.
+//
+// Comments are kept where they were, either at the end of a line or on a
+// line of their own, and single blank lines are preserved.
+package format
+
+import (
+	"bytes"
+	"github.com/rthornton128/gocalc/ast"
+	"github.com/rthornton128/gocalc/parser"
+	"github.com/rthornton128/gocalc/token"
+	"strings"
+)
+
+const (
+	maxWidth = 80
+	tabWidth = 8
+)
+
+// Source formats src, the contents of the file name, returning the result
+// or any parse errors as a token.ErrorList. Formatting is idempotent.
+func Source(name string, src []byte) ([]byte, error) {
+	s := string(src)
+	f := token.NewFile(name, s, 1)
+	n := parser.ParseFile(f, s)
+	if f.NumErrors() > 0 {
+		return nil, f.Err()
+	}
+	p := &printer{src: s, base: f.Base()}
+	for _, g := range n.Comments {
+		p.comments = append(p.comments, g.List...)
+	}
+	p.file(n)
+	return p.buf.Bytes(), nil
+}
+
+// item is a node ready for printing: either an atom of text or a list of
+// items in parens
+type item struct {
+	pos, end token.Pos
+	text     string
+	list     []*item
+	head     int  // number of elements kept on the first line of a list
+	force    bool // the list may not be printed on a single line
+}
+
+type printer struct {
+	src      string
+	base     token.Pos
+	buf      bytes.Buffer
+	col      int // column of the next character written
+	comments []*ast.Comment
+	cmt      int  // index of the next comment to print
+	needNL   bool // a comment was just printed
+}
+
+/* Items */
+func atom(pos token.Pos, text string) *item {
+	return &item{pos: pos, end: pos + token.Pos(len(text)), text: text}
+}
+
+func (p *printer) list(e *ast.Expression, head int, keyword string,
+	nodes ...ast.Node) *item {
+	it := &item{pos: e.Pos(), end: e.End(), head: head}
+	it.list = append(it.list, atom(e.Pos(), keyword))
+	for _, n := range nodes {
+		if n != nil { // the else clause of an if is optional
+			it.add(p.node(n))
+		}
+	}
+	return it
+}
+
+func (it *item) add(el *item) {
+	it.list = append(it.list, el)
+	it.force = it.force || el.force
+}
+
+func typed(name, typ string) string {
+	if typ != "" {
+		return name + ":" + typ
+	}
+	return name
+}
+
+func (p *printer) node(n ast.Node) *item {
+	switch n := n.(type) {
+	case *ast.Identifier:
+		return atom(n.Pos(), n.Lit)
+	case *ast.Number:
+		return atom(n.Pos(), n.Lit)
+	case *ast.String:
+		return atom(n.Pos(), n.Lit)
+	case *ast.AssertEqualExpr:
+		return p.list(&n.Expression, 1, "assert-equal", n.Nodes...)
+	case *ast.AssertExpr:
+		it := p.list(&n.Expression, 1, "assert-type", n.Nodes...)
+		it.add(atom(n.End(), n.Type))
+		return it
+	case *ast.CaseExpr:
+		it := p.list(&n.Expression, 2, "case", n.Nodes...)
+		it.force = it.force || len(n.Nodes) > 2
+		return it
+	case *ast.CompExpr:
+		return p.list(&n.Expression, 1, n.CompLit, n.Nodes...)
+	case *ast.ConcatExpr:
+		return p.list(&n.Expression, 1, "+", n.Nodes...)
+	case *ast.ConvExpr:
+		return p.list(&n.Expression, 1, n.ConvLit, n.Nodes...)
+	case *ast.DefineExpr:
+		return p.define(n)
+	case *ast.IfExpr:
+		return p.list(&n.Expression, 2, "if", n.Nodes...)
+	case *ast.ImportExpr:
+		it := p.list(&n.Expression, 2, "import")
+		it.add(atom(n.Pos(), n.Import))
+		return it
+	case *ast.MathExpr:
+		return p.list(&n.Expression, 1, n.OpLit, n.Nodes...)
+	case *ast.PredExpr:
+		return p.list(&n.Expression, 1, n.PredLit, n.Nodes...)
+	case *ast.PrintExpr:
+		return p.list(&n.Expression, 1, "print", n.Nodes...)
+	case *ast.SetExpr:
+		it := p.list(&n.Expression, 2, "set")
+		it.add(atom(n.Pos(), typed(n.Name, n.Type)))
+		it.add(p.node(n.Value))
+		return it
+	case *ast.SwitchExpr:
+		head := 1
+		if n.Pred != nil {
+			head = 2
+		}
+		it := p.list(&n.Expression, head, "switch", n.Pred)
+		for _, c := range n.Nodes {
+			it.add(p.node(c))
+		}
+		it.force = true
+		return it
+	case *ast.TestExpr:
+		it := p.list(&n.Expression, 2, "deftest")
+		it.add(atom(n.Pos(), n.Name))
+		for _, b := range n.Nodes {
+			it.add(p.node(b))
+		}
+		it.force = true
+		return it
+	case *ast.UserExpr:
+		return p.list(&n.Expression, 1, n.Name, n.Nodes...)
+	}
+	panic("format: unexpected node")
+}
+
+func (p *printer) define(d *ast.DefineExpr) *item {
+	sig := typed(d.Name, d.Type)
+	if len(d.Args) > 0 || !p.shortDefine(d) {
+		args := []string{sig}
+		for i, a := range d.Args {
+			if i < len(d.ArgTypes) {
+				a = typed(a, d.ArgTypes[i])
+			}
+			args = append(args, a)
+		}
+		sig = "(" + strings.Join(args, " ") + ")"
+	}
+	it := p.list(&d.Expression, 2, "define")
+	it.add(atom(d.Pos(), sig))
+	for _, n := range d.Nodes {
+		it.add(p.node(n))
+		switch n.(type) {
+		case *ast.DefineExpr, *ast.IfExpr, *ast.SwitchExpr:
+			it.force = true
+		}
+	}
+	it.force = it.force || len(d.Nodes) > 1
+	return it
+}
+
+// shortDefine reports whether d was written (define name ...), without
+// parens around its name
+func (p *printer) shortDefine(d *ast.DefineExpr) bool {
+	s := p.src[p.offset(d.Pos())+1:]
+	s = strings.TrimPrefix(s, "define")
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if !strings.HasPrefix(s, ";") {
+			break
+		}
+		if i := strings.IndexByte(s, '\n'); i >= 0 {
+			s = s[i:]
+		} else {
+			s = ""
+		}
+	}
+	return !strings.HasPrefix(s, "(")
+}
+
+/* Printing */
+func (p *printer) offset(pos token.Pos) int {
+	return int(pos - p.base)
+}
+
+func (p *printer) write(s string) {
+	p.buf.WriteString(s)
+	p.col += len(s)
+}
+
+// newline starts a new line at the given indent. A blank line is kept if
+// there is one before pos in the source.
+func (p *printer) newline(indent int, pos token.Pos) {
+	p.needNL = false
+	if p.buf.Len() == 0 {
+		return
+	}
+	p.buf.WriteByte('\n')
+	if p.blankBefore(pos) {
+		p.buf.WriteByte('\n')
+	}
+	p.buf.WriteString(strings.Repeat("\t", indent))
+	p.col = indent * tabWidth
+}
+
+func (p *printer) blankBefore(pos token.Pos) bool {
+	n := 0
+	for i := p.offset(pos) - 1; i >= 0 && i < len(p.src); i-- {
+		switch p.src[i] {
+		case '\n':
+			n++
+		case ' ', '\t', '\r':
+		default:
+			return n > 1
+		}
+	}
+	return false
+}
+
+// trailing reports whether c follows code on the same line
+func (p *printer) trailing(c *ast.Comment) bool {
+	for i := p.offset(c.Pos()) - 1; i >= 0; i-- {
+		switch p.src[i] {
+		case '\n':
+			return false
+		case ' ', '\t', '\r':
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// flush prints the comments preceding pos
+func (p *printer) flush(pos token.Pos, indent int) {
+	for p.cmt < len(p.comments) && p.comments[p.cmt].Pos() < pos {
+		c := p.comments[p.cmt]
+		p.cmt++
+		if p.trailing(c) && p.buf.Len() > 0 && !p.needNL {
+			p.write(" ")
+		} else {
+			p.newline(indent, c.Pos())
+		}
+		p.write(c.Text)
+		p.needNL = true
+	}
+}
+
+func (p *printer) file(n *ast.File) {
+	for _, node := range n.Nodes {
+		it := p.node(node)
+		p.flush(it.pos, 0)
+		p.newline(0, it.pos)
+		p.print(it, 0)
+	}
+	p.flush(n.End()+1, 0)
+	if p.buf.Len() > 0 {
+		p.buf.WriteByte('\n')
+	}
+}
+
+func (it *item) flat() string {
+	if it.list == nil {
+		return it.text
+	}
+	s := make([]string, len(it.list))
+	for i, el := range it.list {
+		s[i] = el.flat()
+	}
+	return "(" + strings.Join(s, " ") + ")"
+}
+
+// fits reports whether it may be printed on the rest of the current line
+func (p *printer) fits(it *item) bool {
+	if it.list == nil {
+		return true
+	}
+	if it.force || p.cmt < len(p.comments) && p.comments[p.cmt].Pos() < it.end {
+		return false
+	}
+	return p.col+len(it.flat()) <= maxWidth
+}
+
+func (p *printer) print(it *item, indent int) {
+	if p.fits(it) {
+		p.write(it.flat())
+		return
+	}
+	p.write("(")
+	for i, el := range it.list {
+		p.flush(el.pos, indent+1)
+		if i >= it.head || p.needNL {
+			p.newline(indent+1, el.pos)
+		} else if i > 0 {
+			p.write(" ")
+		}
+		p.print(el, indent+1)
+	}
+	p.flush(it.end, indent+1)
+	if p.needNL {
+		p.newline(indent, it.end)
+	}
+	p.write(")")
+}
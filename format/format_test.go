@@ -0,0 +1,77 @@
+package format_test
+
+import (
+	"github.com/rthornton128/gocalc/format"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestSource(t *testing.T) {
+	var tests = []struct {
+		src, out string
+	}{
+		{"(print   1  2)", "(print 1 2)\n"},
+		{"(define (sq x)\n  (* x x))", "(define (sq x) (* x x))\n"},
+		{"(define f  (+ 2 3))", "(define f (+ 2 3))\n"},
+		{"(define (f:int a b:string)\n\t(print b) a)",
+			"(define (f:int a b:string)\n\t(print b)\n\ta)\n"},
+		{"(set a:int 1) (if (> a 0) (print a))",
+			"(set a:int 1)\n(if (> a 0) (print a))\n"},
+		{"(set a 1)\n\n\n(switch a (case 1 (print 1)))",
+			"(set a 1)\n\n(switch a\n\t(case 1 (print 1)))\n"},
+		{"; top\n(print 1) ; one\n\n   ; two\n(print 2)",
+			"; top\n(print 1) ; one\n\n; two\n(print 2)\n"},
+		{"(if 1 ; cond\n (print 2))", "(if 1 ; cond\n\t(print 2))\n"},
+		{"(print 1 ; one\n)", "(print\n\t1 ; one\n)\n"},
+		{"(define (f) ; c\n 1)", "(define (f) ; c\n\t1)\n"},
+		{"(deftest t (set a 1)  (assert-equal 1 a))",
+			"(deftest t\n\t(set a 1)\n\t(assert-equal 1 a))\n"},
+		{"(print \"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa\" " +
+			"\"bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb\")",
+			"(print\n\t\"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa\"\n" +
+				"\t\"bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb\")\n"},
+	}
+	for i, test := range tests {
+		out, err := format.Source("", []byte(test.src))
+		if err != nil {
+			t.Fatal(i, "- Unexpected error:", err)
+		}
+		if string(out) != test.out {
+			t.Logf("%d - Expected: %q", i, test.out)
+			t.Fatalf("%d - Got: %q", i, out)
+		}
+	}
+}
+
+func TestSourceError(t *testing.T) {
+	_, err := format.Source("bad.calc", []byte("(print b)"))
+	if err == nil || err.Error() !=
+		"bad.calc - Line: 1 Column: 8 - Undeclared identifier: b" {
+		t.Fatal("Expected undeclared identifier error, got:", err)
+	}
+}
+
+func TestSourceIdempotent(t *testing.T) {
+	names, err := filepath.Glob(filepath.Join("..", "scripts", "*.calc"))
+	if err != nil || len(names) == 0 {
+		t.Fatal("No scripts found:", err)
+	}
+	for _, name := range names {
+		src, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		once, err := format.Source(name, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		twice, err := format.Source(name, once)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(once) != string(twice) {
+			t.Fatal(name, "- Formatting is not idempotent")
+		}
+	}
+}
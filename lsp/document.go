@@ -0,0 +1,252 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+package lsp
+
+import (
+	"github.com/rthornton128/gocalc/ast"
+	"github.com/rthornton128/gocalc/parser"
+	"github.com/rthornton128/gocalc/resolve"
+	"github.com/rthornton128/gocalc/scanner"
+	"github.com/rthornton128/gocalc/token"
+	"github.com/rthornton128/gocalc/types"
+	"sort"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+const base = token.Pos(1) // base of every document's token.File
+
+// document is an open text document and the results of analysing it
+type document struct {
+	uri    string
+	text   string
+	lines  []int // offset of the start of each line
+	file   *token.File
+	root   *ast.File   // nil if the parser gave up
+	info   *types.Info // nil unless the file parsed and resolved cleanly
+	idents []token.Pos // identifiers naming something, in source order
+	refs   []ref
+	crash  bool // the parser panicked
+}
+
+// ref is a use or declaration of a resolved name
+type ref struct {
+	pos  token.Pos
+	obj  *ast.Object
+	decl bool
+}
+
+func (r ref) end() token.Pos {
+	return r.pos + token.Pos(len(r.obj.Name))
+}
+
+func filename(uri string) string {
+	return strings.TrimPrefix(uri, "file://")
+}
+
+func newDocument(uri, text string) *document {
+	d := &document{uri: uri, text: text, lines: []int{0}}
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' {
+			d.lines = append(d.lines, i+1)
+		}
+	}
+	d.file = token.NewFile(filename(uri), text, base)
+	d.parse()
+	if d.root == nil || d.file.NumErrors() > 0 {
+		return d
+	}
+	resolve.File(d.file, d.root)
+	if d.file.NumErrors() == 0 {
+		d.info = types.Check(d.file, d.root)
+	}
+	d.scanIdents()
+	d.collectRefs()
+	return d
+}
+
+// parse parses the text. Malformed input may still panic the parser, in
+// which case the errors reported so far are kept.
+func (d *document) parse() {
+	defer func() {
+		if r := recover(); r != nil {
+			d.root = nil
+			d.crash = true
+		}
+	}()
+	d.root = parser.ParseFile(d.file, d.text)
+}
+
+// diagnostics returns the errors found in the document
+func (d *document) diagnostics() []Diagnostic {
+	list := []Diagnostic{}
+	for _, e := range d.file.Errors() {
+		off := int(e.Pos() - base)
+		end := off + 1
+		for end < len(d.text) && isIdent(d.text[end]) && isIdent(d.text[off]) {
+			end++
+		}
+		list = append(list, Diagnostic{
+			Range:    Range{d.position(off), d.position(end)},
+			Severity: 1,
+			Source:   "gocalc",
+			Message:  e.Msg(),
+		})
+	}
+	if d.crash {
+		end := d.position(len(d.text))
+		list = append(list, Diagnostic{Range: Range{end, end}, Severity: 1,
+			Source: "gocalc", Message: "Incomplete or malformed expression"})
+	}
+	return list
+}
+
+/* Positions */
+func (d *document) offset(p Position) int {
+	if p.Line < 0 {
+		return 0
+	}
+	if p.Line >= len(d.lines) {
+		return len(d.text)
+	}
+	off := d.lines[p.Line]
+	for n := 0; n < p.Character && off < len(d.text) && d.text[off] != '\n'; {
+		r, size := utf8.DecodeRuneInString(d.text[off:])
+		n += len(utf16.Encode([]rune{r}))
+		off += size
+	}
+	return off
+}
+
+func (d *document) position(off int) Position {
+	if off > len(d.text) {
+		off = len(d.text)
+	}
+	line := sort.Search(len(d.lines), func(i int) bool {
+		return d.lines[i] > off
+	}) - 1
+	s := d.text[d.lines[line]:off]
+	return Position{line, len(utf16.Encode([]rune(s)))}
+}
+
+func (d *document) rangeOf(pos, end token.Pos) Range {
+	return Range{d.position(int(pos - base)), d.position(int(end - base))}
+}
+
+func (d *document) pos(p Position) token.Pos {
+	return base + token.Pos(d.offset(p))
+}
+
+/* Names */
+func isIdent(ch byte) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' ||
+		ch >= '0' && ch <= '9' || ch == '_' || ch == '-' || ch == '?' ||
+		ch >= utf8.RuneSelf
+}
+
+// scanIdents records the position of every identifier except type names
+func (d *document) scanIdents() {
+	var s scanner.Scanner
+	s.Init(token.NewFile("", d.text, base), d.text)
+	prev := token.EOF
+	for {
+		tok, pos, _ := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.IDENT && prev != token.COLON {
+			d.idents = append(d.idents, pos+base)
+		}
+		prev = tok
+	}
+}
+
+// ident returns the position of the nth identifier following pos
+func (d *document) ident(pos token.Pos, n int) token.Pos {
+	i := sort.Search(len(d.idents), func(i int) bool {
+		return d.idents[i] > pos
+	})
+	if i+n < len(d.idents) {
+		return d.idents[i+n]
+	}
+	return token.NoPos
+}
+
+func (d *document) collectRefs() {
+	add := func(pos token.Pos, obj *ast.Object, decl bool) {
+		if pos.IsValid() && obj != nil {
+			d.refs = append(d.refs, ref{pos, obj, decl})
+		}
+	}
+	ast.Inspect(d.root, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.DefineExpr:
+			add(d.ident(n.Pos(), 0), n.Obj, true)
+			for i, a := range n.Args {
+				obj := &ast.Object{Kind: ast.Arg, Name: a, Decl: n, Index: i}
+				add(d.ident(n.Pos(), i+1), obj, true)
+			}
+		case *ast.Identifier:
+			add(n.Pos(), n.Obj, false)
+		case *ast.SetExpr:
+			add(d.ident(n.Pos(), 0), n.Obj, n.Obj != nil && n.Obj.Decl == n)
+		case *ast.UserExpr:
+			add(d.ident(n.Pos(), 0), n.Obj, false)
+		}
+		return true
+	})
+	sort.Slice(d.refs, func(i, j int) bool {
+		return d.refs[i].pos < d.refs[j].pos
+	})
+}
+
+// sameObj reports whether a and b are the same binding. The resolver does
+// not record the objects of arguments on their define, so arguments are
+// compared by declaration.
+func sameObj(a, b *ast.Object) bool {
+	return a == b || a.Kind == ast.Arg && b.Kind == ast.Arg &&
+		a.Decl == b.Decl && a.Index == b.Index
+}
+
+// refAt returns the reference touching pos
+func (d *document) refAt(pos token.Pos) (ref, bool) {
+	for _, r := range d.refs {
+		if r.pos <= pos && pos <= r.end() {
+			return r, true
+		}
+	}
+	return ref{}, false
+}
+
+func (d *document) references(obj *ast.Object, decl bool) []ref {
+	var list []ref
+	for _, r := range d.refs {
+		if sameObj(r.obj, obj) && (decl || !r.decl) {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+// scopeAt returns the parser's scope at pos: that of the innermost define or
+// test enclosing it, or the file scope.
+func (d *document) scopeAt(pos token.Pos) *ast.Scope {
+	path := ast.Enclosing(d.root, pos)
+	for i := len(path) - 1; i >= 0; i-- {
+		if def, ok := path[i].(*ast.DefineExpr); ok && def.Scope != nil &&
+			pos > def.Pos() {
+			return def.Scope
+		}
+		if t, ok := path[i].(*ast.TestExpr); ok && t.Scope != nil &&
+			pos > t.Pos() {
+			return t.Scope
+		}
+	}
+	return d.root.Scope
+}
@@ -0,0 +1,240 @@
+package lsp_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/rthornton128/gocalc/lsp"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const src = `; sq returns x times x
+(define (sq x) (* x x))
+(set a (sq 3))
+(print (sq a))
+`
+
+// client scripts a session, recording the messages to send
+type client struct {
+	buf bytes.Buffer
+	id  int
+}
+
+func (c *client) send(method string, params string) int {
+	c.id++
+	fmt.Fprintf(&c.buf, `{"jsonrpc":"2.0","id":%d,"method":%q,"params":%s}`,
+		c.id, method, params)
+	return c.id
+}
+
+func (c *client) notify(method string, params string) {
+	fmt.Fprintf(&c.buf, `{"jsonrpc":"2.0","method":%q,"params":%s}`, method,
+		params)
+}
+
+// script frames every message written by send and notify
+func (c *client) script() io.Reader {
+	var out bytes.Buffer
+	dec := json.NewDecoder(&c.buf)
+	for dec.More() {
+		var m json.RawMessage
+		dec.Decode(&m)
+		fmt.Fprintf(&out, "Content-Length: %d\r\n\r\n%s", len(m), m)
+	}
+	return &out
+}
+
+type reply struct {
+	ID     *int            `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code int `json:"code"`
+	} `json:"error"`
+}
+
+func replies(t *testing.T, r io.Reader) []reply {
+	var list []reply
+	in := bufio.NewReader(r)
+	for {
+		line, err := in.ReadString('\n')
+		if err == io.EOF {
+			return list
+		}
+		if !strings.HasPrefix(line, "Content-Length: ") {
+			t.Fatal("Bad header:", line)
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[16:]))
+		in.ReadString('\n')
+		data := make([]byte, n)
+		io.ReadFull(in, data)
+		var m reply
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, m)
+	}
+}
+
+func pos(uri string, line, char int) string {
+	return fmt.Sprintf(`{"textDocument":{"uri":%q},`+
+		`"position":{"line":%d,"character":%d}}`, uri, line, char)
+}
+
+func rng(l1, c1, l2, c2 int) string {
+	return fmt.Sprintf(`{"start":{"line":%d,"character":%d},`+
+		`"end":{"line":%d,"character":%d}}`, l1, c1, l2, c2)
+}
+
+func open(c *client, uri, text string) {
+	c.notify("textDocument/didOpen", fmt.Sprintf(
+		`{"textDocument":{"uri":%q,"languageId":"calc","version":1,"text":%q}}`,
+		uri, text))
+}
+
+func TestServer(t *testing.T) {
+	const a = "file:///a.calc"
+	c := new(client)
+	c.send("initialize", `{"capabilities":{}}`)
+	open(c, a, src)
+	var tests = []struct {
+		id   int
+		want string
+	}{
+		{c.send("textDocument/definition", pos(a, 3, 9)),
+			`{"uri":"file:///a.calc","range":` + rng(1, 9, 1, 11) + `}`},
+		{c.send("textDocument/definition", pos(a, 1, 21)),
+			`{"uri":"file:///a.calc","range":` + rng(1, 12, 1, 13) + `}`},
+		{c.send("textDocument/definition", pos(a, 0, 3)), `null`},
+		{c.send("textDocument/references", `{"textDocument":{"uri":"`+a+
+			`"},"position":{"line":2,"character":5},`+
+			`"context":{"includeDeclaration":true}}`),
+			`[{"uri":"file:///a.calc","range":` + rng(2, 5, 2, 6) + `},` +
+				`{"uri":"file:///a.calc","range":` + rng(3, 11, 3, 12) + `}]`},
+		{c.send("textDocument/references", `{"textDocument":{"uri":"`+a+
+			`"},"position":{"line":1,"character":12},`+
+			`"context":{"includeDeclaration":false}}`),
+			`[{"uri":"file:///a.calc","range":` + rng(1, 18, 1, 19) + `},` +
+				`{"uri":"file:///a.calc","range":` + rng(1, 20, 1, 21) + `}]`},
+		{c.send("textDocument/hover", pos(a, 2, 9)),
+			`{"contents":{"kind":"markdown","value":` +
+				"\"```calc\\n(sq x)\\n```\\n\\nsq returns x times x\"}," +
+				`"range":` + rng(2, 8, 2, 10) + `}`},
+		{c.send("textDocument/hover", pos(a, 2, 5)),
+			`{"contents":{"kind":"markdown","value":` +
+				"\"```calc\\na:int\\n```\\n\\nVariable\"}," +
+				`"range":` + rng(2, 5, 2, 6) + `}`},
+		{c.send("textDocument/completion", pos(a, 3, 9)),
+			`[{"label":"sq","kind":3,"detail":"(sq x)"},` +
+				`{"label":"set","kind":14},{"label":"str","kind":14},` +
+				`{"label":"string?","kind":14},{"label":"switch","kind":14}]`},
+		{c.send("textDocument/completion", pos(a, 1, 19)),
+			`[{"label":"x","kind":6}]`},
+		{c.send("textDocument/formatting",
+			`{"textDocument":{"uri":"`+a+`"},"options":{}}`), `[]`},
+		{c.send("textDocument/unknown", `{}`), ``},
+		{c.send("textDocument/hover", pos("file:///none.calc", 0, 0)), ``},
+	}
+	open(c, "file:///b.calc", "(print   1)")
+	fmtID := c.send("textDocument/formatting",
+		`{"textDocument":{"uri":"file:///b.calc"},"options":{}}`)
+	tests = append(tests, struct {
+		id   int
+		want string
+	}{fmtID, `[{"range":` + rng(0, 0, 0, 11) + `,"newText":"(print 1)\n"}]`})
+	open(c, "file:///c.calc", "(print b)\n(print")
+	c.send("shutdown", `null`)
+	c.notify("exit", `null`)
+
+	var out bytes.Buffer
+	if err := lsp.Serve(c.script(), &out); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	results := make(map[int]reply)
+	diags := make(map[string]string)
+	for _, r := range replies(t, &out) {
+		if r.ID != nil {
+			results[*r.ID] = r
+		} else if r.Method == "textDocument/publishDiagnostics" {
+			var p struct {
+				URI         string          `json:"uri"`
+				Diagnostics json.RawMessage `json:"diagnostics"`
+			}
+			json.Unmarshal(r.Params, &p)
+			diags[p.URI] = string(p.Diagnostics)
+		}
+	}
+	if !strings.Contains(string(results[1].Result), `"hoverProvider":true`) {
+		t.Fatal("Missing capabilities:", string(results[1].Result))
+	}
+	for i, test := range tests {
+		r, ok := results[test.id]
+		got := string(r.Result)
+		if test.want == "" { // an error is expected
+			if !ok || r.Error == nil {
+				t.Fatal(i, "- Expected an error, got:", got)
+			}
+			continue
+		}
+		if !ok || r.Error != nil || got != test.want {
+			t.Log(i, "- Expected:", test.want)
+			t.Fatal(i, "- Got:", got, r.Error)
+		}
+	}
+
+	var diagTests = []struct {
+		uri, want string
+	}{
+		{a, `[]`},
+		{"file:///c.calc", `[{"range":` + rng(0, 7, 0, 8) + `,"severity":1,` +
+			`"source":"gocalc","message":"Undeclared identifier: b"},` +
+			`{"range":` + rng(1, 6, 1, 6) + `,"severity":1,` +
+			`"source":"gocalc","message":"Unexpected end of file"}]`},
+	}
+	for i, test := range diagTests {
+		if diags[test.uri] != test.want {
+			t.Log(i, "- Expected:", test.want)
+			t.Fatal(i, "- Got:", diags[test.uri])
+		}
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	var tests = []struct {
+		src, want string
+	}{
+		{"(print b)", `"range":` + rng(0, 7, 0, 8) +
+			`,"severity":1,"source":"gocalc","message":"Undeclared identifier: b"`},
+		{"(set a 1)\n(set a \"s\")", `"range":` + rng(1, 0, 1, 1) +
+			`,"severity":1,"source":"gocalc",` +
+			`"message":"Cannot set a of type int to a value of type string"`},
+		{"(print 1)", `"diagnostics":[]`},
+		{"(print \"abc", `"range":` + rng(0, 7, 0, 8) +
+			`,"severity":1,"source":"gocalc","message":"Unterminated string"`},
+	}
+	for i, test := range tests {
+		c := new(client)
+		open(c, "file:///t.calc", test.src)
+		c.send("shutdown", `null`)
+		var out bytes.Buffer
+		lsp.Serve(c.script(), &out)
+		r := replies(t, &out)
+		if len(r) == 0 || !strings.Contains(string(r[0].Params), test.want) {
+			t.Log(i, "- Expected:", test.want)
+			t.Fatal(i, "- Got:", r)
+		}
+	}
+}
+
+func TestNoShutdown(t *testing.T) {
+	c := new(client)
+	c.notify("exit", `null`)
+	if err := lsp.Serve(c.script(), new(bytes.Buffer)); err != lsp.ErrNoShutdown {
+		t.Fatal("Expected ErrNoShutdown, got:", err)
+	}
+}
@@ -0,0 +1,375 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+// Package lsp implements a Language Server Protocol server for Calc.
+//
+// The server speaks JSON-RPC over a pair of streams, normally standard input
+// and output, and supports full document synchronisation, diagnostics,
+// go to definition, find references, hover, completion and formatting.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rthornton128/gocalc/ast"
+	"github.com/rthornton128/gocalc/doc"
+	"github.com/rthornton128/gocalc/format"
+	"github.com/rthornton128/gocalc/token"
+	"github.com/rthornton128/gocalc/types"
+	"io"
+	"strings"
+)
+
+// ErrNoShutdown is returned by Serve if the client exits, or closes the
+// connection, without first requesting a shutdown.
+var ErrNoShutdown = errors.New("lsp: exit without shutdown")
+
+type handler func(s *server, params json.RawMessage) (interface{}, error)
+
+var handlers = map[string]handler{
+	"initialize":              (*server).initialize,
+	"shutdown":                (*server).shutdown,
+	"textDocument/completion": (*server).completion,
+	"textDocument/definition": (*server).definition,
+	"textDocument/formatting": (*server).formatting,
+	"textDocument/hover":      (*server).hover,
+	"textDocument/references": (*server).references,
+}
+
+var notifications = map[string]func(s *server, params json.RawMessage) error{
+	"textDocument/didOpen":   (*server).didOpen,
+	"textDocument/didChange": (*server).didChange,
+	"textDocument/didClose":  (*server).didClose,
+}
+
+type server struct {
+	out      io.Writer
+	docs     map[string]*document
+	stopping bool // a shutdown request has been received
+}
+
+// Serve reads requests from r and writes responses and notifications to w
+// until the client sends exit or closes r.
+func Serve(r io.Reader, w io.Writer) error {
+	s := &server{out: w, docs: make(map[string]*document)}
+	in := bufio.NewReader(r)
+	for {
+		data, err := readMessage(in)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var m message
+		if err := json.Unmarshal(data, &m); err != nil {
+			err = s.reply(nil, nil, &rpcError{codeParseError, err.Error()})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if m.Method == "exit" {
+			break
+		}
+		if err := s.handle(&m); err != nil {
+			return err
+		}
+	}
+	if !s.stopping {
+		return ErrNoShutdown
+	}
+	return nil
+}
+
+// handle dispatches a request or notification, returning any error writing
+// the response
+func (s *server) handle(m *message) error {
+	if m.ID == nil {
+		if n, ok := notifications[m.Method]; ok {
+			return n(s, m.Params)
+		}
+		return nil
+	}
+	h, ok := handlers[m.Method]
+	switch {
+	case m.Method == "":
+		return s.reply(m.ID, nil, &rpcError{codeInvalidRequest,
+			"missing method"})
+	case !ok:
+		return s.reply(m.ID, nil, &rpcError{codeMethodNotFound,
+			"method not supported: " + m.Method})
+	case s.stopping:
+		return s.reply(m.ID, nil, &rpcError{codeInvalidRequest,
+			"server is shutting down"})
+	}
+	res, err := h(s, m.Params)
+	if err != nil {
+		e, ok := err.(*rpcError)
+		if !ok {
+			e = &rpcError{codeInvalidParams, err.Error()}
+		}
+		return s.reply(m.ID, nil, e)
+	}
+	return s.reply(m.ID, res, nil)
+}
+
+func (s *server) reply(id *json.RawMessage, res interface{},
+	e *rpcError) error {
+	if id == nil {
+		null := json.RawMessage("null")
+		id = &null
+	}
+	m := &message{ID: id, Error: e}
+	if e == nil {
+		data, err := json.Marshal(res)
+		if err != nil {
+			return err
+		}
+		m.Result = data
+	}
+	return writeMessage(s.out, m)
+}
+
+func (s *server) notify(method string, params interface{}) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return writeMessage(s.out, &message{Method: method, Params: data})
+}
+
+// document returns the open document named by uri
+func (s *server) document(uri string) (*document, error) {
+	d, ok := s.docs[uri]
+	if !ok {
+		return nil, fmt.Errorf("document not open: %s", uri)
+	}
+	return d, nil
+}
+
+/* Lifecycle */
+func (s *server) initialize(params json.RawMessage) (interface{}, error) {
+	return map[string]interface{}{
+		"capabilities": map[string]interface{}{
+			"textDocumentSync":           1, // full
+			"definitionProvider":         true,
+			"referencesProvider":         true,
+			"hoverProvider":              true,
+			"documentFormattingProvider": true,
+			"completionProvider": map[string]interface{}{
+				"triggerCharacters": []string{"("},
+			},
+		},
+		"serverInfo": map[string]string{"name": "gocalc"},
+	}, nil
+}
+
+func (s *server) shutdown(params json.RawMessage) (interface{}, error) {
+	s.stopping = true
+	return nil, nil
+}
+
+/* Synchronisation */
+func (s *server) update(uri, text string) error {
+	d := newDocument(uri, text)
+	s.docs[uri] = d
+	return s.notify("textDocument/publishDiagnostics",
+		publishDiagnosticsParams{uri, d.diagnostics()})
+}
+
+// Notifications cannot be answered with an error, so malformed ones are
+// ignored.
+func (s *server) didOpen(params json.RawMessage) error {
+	var p didOpenParams
+	if json.Unmarshal(params, &p) != nil {
+		return nil
+	}
+	return s.update(p.TextDocument.URI, p.TextDocument.Text)
+}
+
+func (s *server) didChange(params json.RawMessage) error {
+	var p didChangeParams
+	if json.Unmarshal(params, &p) != nil {
+		return nil
+	}
+	if len(p.ContentChanges) == 0 {
+		return nil
+	}
+	// only full synchronisation is offered, so the last change is the text
+	text := p.ContentChanges[len(p.ContentChanges)-1].Text
+	return s.update(p.TextDocument.URI, text)
+}
+
+func (s *server) didClose(params json.RawMessage) error {
+	var p didCloseParams
+	if json.Unmarshal(params, &p) != nil {
+		return nil
+	}
+	delete(s.docs, p.TextDocument.URI)
+	return s.notify("textDocument/publishDiagnostics",
+		publishDiagnosticsParams{p.TextDocument.URI, []Diagnostic{}})
+}
+
+/* Language features */
+func (s *server) locate(p *positionParams) (*document, token.Pos, error) {
+	d, err := s.document(p.TextDocument.URI)
+	if err != nil {
+		return nil, token.NoPos, err
+	}
+	return d, d.pos(p.Position), nil
+}
+
+func (s *server) definition(params json.RawMessage) (interface{}, error) {
+	var p positionParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	d, pos, err := s.locate(&p)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := d.refAt(pos)
+	if !ok {
+		return nil, nil
+	}
+	for _, decl := range d.references(r.obj, true) {
+		if decl.decl {
+			return Location{d.uri, d.rangeOf(decl.pos, decl.end())}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *server) references(params json.RawMessage) (interface{}, error) {
+	var p referenceParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	d, pos, err := s.locate(&p.positionParams)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := d.refAt(pos)
+	if !ok {
+		return nil, nil
+	}
+	list := []Location{}
+	for _, ref := range d.references(r.obj, p.Context.IncludeDeclaration) {
+		list = append(list, Location{d.uri, d.rangeOf(ref.pos, ref.end())})
+	}
+	return list, nil
+}
+
+func (s *server) hover(params json.RawMessage) (interface{}, error) {
+	var p positionParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	d, pos, err := s.locate(&p)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := d.refAt(pos)
+	if !ok {
+		return nil, nil
+	}
+	var sig, text string
+	switch r.obj.Kind {
+	case ast.Fun:
+		def := r.obj.Decl.(*ast.DefineExpr)
+		fn := doc.Define(d.file, ast.NewCommentMap(d.file, d.root,
+			d.root.Comments), def)
+		sig, text = fn.Signature(), fn.Doc
+	case ast.Arg:
+		def := r.obj.Decl.(*ast.DefineExpr)
+		sig = r.obj.Name
+		if d.info != nil && r.obj.Index < len(d.info.Args[def]) {
+			sig = typed(sig, d.info.Args[def][r.obj.Index])
+		}
+		text = "Argument of " + def.Name
+	case ast.Var:
+		sig = r.obj.Name
+		if d.info != nil {
+			sig = typed(sig, d.info.Objects[r.obj])
+		}
+		text = "Variable"
+	}
+	value := "```calc\n" + sig + "\n```"
+	if text != "" {
+		value += "\n\n" + text
+	}
+	rng := d.rangeOf(r.pos, r.end())
+	return Hover{MarkupContent{"markdown", value}, &rng}, nil
+}
+
+func typed(name string, t types.Type) string {
+	if t == types.Unknown {
+		return name
+	}
+	return name + ":" + t.String()
+}
+
+func (s *server) completion(params json.RawMessage) (interface{}, error) {
+	var p positionParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	d, pos, err := s.locate(&p)
+	if err != nil {
+		return nil, err
+	}
+	start := int(pos - base)
+	for start > 0 && isIdent(d.text[start-1]) {
+		start--
+	}
+	prefix := d.text[start:int(pos-base)]
+	list := []CompletionItem{}
+	if d.root != nil {
+		scope := d.scopeAt(pos)
+		for _, name := range scope.Names() {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			item := CompletionItem{Label: name, Kind: VariableCompletion}
+			// the parser binds arguments to their define, so check the name
+			if def, ok := scope.Lookup(name).(*ast.DefineExpr); ok &&
+				def.Name == name {
+				item.Kind = FunctionCompletion
+				item.Detail = doc.Define(d.file, nil, def).Signature()
+			}
+			list = append(list, item)
+		}
+	}
+	for _, kw := range token.Keywords() {
+		if strings.HasPrefix(kw, prefix) {
+			list = append(list, CompletionItem{Label: kw,
+				Kind: KeywordCompletion})
+		}
+	}
+	return list, nil
+}
+
+func (s *server) formatting(params json.RawMessage) (interface{}, error) {
+	var p formattingParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	d, err := s.document(p.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+	out, err := format.Source(filename(d.uri), []byte(d.text))
+	if err != nil || string(out) == d.text {
+		// a file which does not parse is left as it is
+		return []TextEdit{}, nil
+	}
+	end := d.position(len(d.text))
+	return []TextEdit{{Range{Position{}, end}, string(out)}}, nil
+}
@@ -20,23 +20,84 @@ func ParseExpr(expr string) ast.Node {
 	return ParseFile(f, expr)
 }
 
+// Capabilities which may be granted to a sandboxed script. Only print, which
+// writes to standard output, requires one as yet; the others are for the
+// builtins to come.
+const (
+	CapEnv    = "env"
+	CapFS     = "fs"
+	CapIO     = "io"
+	CapRandom = "random"
+	CapTime   = "time"
+)
+
+var capabilities = []string{CapEnv, CapFS, CapIO, CapRandom, CapTime}
+
+// builtinCaps maps each builtin to the capability it requires. Builtins not
+// listed require no capability.
+var builtinCaps = map[token.Token]string{
+	token.PRINT: CapIO,
+}
+
+// IsCapability reports whether name is a known capability.
+func IsCapability(name string) bool {
+	for _, c := range capabilities {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
 func ParseFile(f *token.File, str string) *ast.File {
+	return parseFile(f, str, nil)
+}
+
+// ParseFileScope parses str like ParseFile, but with a file scope nested in
+// outer so the names declared by earlier files, such as previous entries at
+// the REPL, are visible. If allow is not nil, builtins are restricted to
+// those it permits as by ParseFileSandbox.
+func ParseFileScope(f *token.File, str string, outer *ast.Scope,
+	allow []string) *ast.File {
+	n := parseFile(f, str, outer)
+	if allow != nil && n != nil {
+		CheckCapabilities(f, n, allow)
+	}
+	return n
+}
+
+// ParseFileSandbox parses str like ParseFile but reports an error for any
+// builtin requiring a capability not listed in allow.
+func ParseFileSandbox(f *token.File, str string, allow []string) *ast.File {
+	n := parseFile(f, str, nil)
+	if n != nil {
+		CheckCapabilities(f, n, allow)
+	}
+	return n
+}
+
+func parseFile(f *token.File, str string, outer *ast.Scope) *ast.File {
 	if f.Size() != len(str) {
 		fmt.Println("File size does not match string length.")
 		return nil
 	}
 
-	root := ast.NewFile(token.Pos(1), token.Pos(len(str)+1))
+	root := ast.NewFile(f.Base(), f.Base()+token.Pos(len(str)))
+	root.Scope.Parent = outer
 	p := new(parser)
 	p.init(f, str)
 	p.topScope = root.Scope
 	p.curScope = root.Scope
-	n := p.parse()
 	for p.file.NumErrors() < 10 && p.tok != token.EOF {
-		root.Nodes = append(root.Nodes, n)
-		p.next()
-		n = p.parse()
+		n, ok := p.parseTopLevel()
+		if n != nil {
+			root.Nodes = append(root.Nodes, n)
+		}
+		if ok {
+			p.next()
+		}
 	}
+	root.Comments = p.comments
 	if p.topScope != p.curScope {
 		panic("Imbalanced scope!")
 	}
@@ -48,13 +109,69 @@ type parser struct {
 	scan     *scanner.Scanner
 	topScope *ast.Scope
 	curScope *ast.Scope
+	comments []*ast.CommentGroup
+	depth    int // number of parens open, including the current token
+	formErrs int // number of errors when the top level form began
+	exprErrs int // number of errors when the innermost expression began
 	tok      token.Token
 	pos      token.Pos
 	lit      string
 }
 
+// bailout is panicked to abandon the top level form being parsed
+type bailout struct{}
+
+// addError reports an error at the current token. Once an expression has
+// an error, any further errors in it are most likely caused by the first
+// and are not reported. Reaching the end of the file abandons parsing.
 func (p *parser) addError(args ...interface{}) {
-	p.file.AddError(p.pos, args...)
+	if p.tok == token.EOF {
+		p.file.AddError(p.pos, "Unexpected end of file")
+		panic(bailout{})
+	}
+	if p.file.NumErrors() == p.exprErrs {
+		p.file.AddError(p.pos, args...)
+	}
+}
+
+// sync skips to the paren closing the expression opened at depth. If it
+// instead finds a paren at the start of a line, taken to be the next top
+// level form, the current form is abandoned.
+func (p *parser) sync(depth int) {
+	for p.tok != token.EOF && p.depth >= depth {
+		p.next()
+		if p.tok == token.LPAREN && p.startsLine() {
+			panic(bailout{})
+		}
+	}
+}
+
+// startsLine reports whether the current token is in the first column
+func (p *parser) startsLine() bool {
+	return p.file.Position(p.pos).Column == 1
+}
+
+// CheckCapabilities reports an error in f for each builtin in n requiring a
+// capability not listed in allow. ParseFileSandbox checks the trees it parses
+// with it, and it may be used on those which were not parsed from source,
+// such as those decoded from JSON. The arguments of a builtin which is not
+// permitted are not checked.
+func CheckCapabilities(f *token.File, n ast.Node, allow []string) {
+	caps := make(map[string]bool)
+	for _, c := range allow {
+		caps[c] = true
+	}
+	ast.Inspect(n, func(n ast.Node) bool {
+		if _, ok := n.(*ast.PrintExpr); !ok {
+			return true
+		}
+		if c := builtinCaps[token.PRINT]; !caps[c] {
+			f.AddError(n.Pos(), "'print' is not permitted: requires capability ",
+				c)
+			return false
+		}
+		return true
+	})
 }
 
 func (p *parser) init(file *token.File, expr string) {
@@ -64,22 +181,63 @@ func (p *parser) init(file *token.File, expr string) {
 	p.next()
 }
 
+// next advances to the next token. Comments are recorded, in groups of
+// comments on adjacent lines, rather than returned.
 func (p *parser) next() {
+	prev := p.pos // position of the previous token
+	p.scanToken()
+	var g *ast.CommentGroup
+	line := 0
+	for p.tok == token.COMMENT {
+		l := p.file.Line(p.pos)
+		if g == nil || l > line+1 {
+			g = new(ast.CommentGroup)
+			p.comments = append(p.comments, g)
+		}
+		g.List = append(g.List, &ast.Comment{Semi: p.pos, Text: p.lit})
+		line = l
+		if len(g.List) == 1 && prev.IsValid() && p.file.Line(prev) == l {
+			line = -1 // trailing comments are grouped alone
+		}
+		p.scanToken()
+	}
+}
+
+func (p *parser) scanToken() {
 	p.tok, p.pos, p.lit = p.scan.Scan()
 	p.pos += p.file.Base()
+	switch p.tok {
+	case token.LPAREN:
+		p.depth++
+	case token.RPAREN:
+		p.depth--
+	}
 	//fmt.Println("tok:", p.tok)
 	//fmt.Println("pos:", p.pos)
 	//fmt.Println("lit:", p.lit)
 }
 
+// parseTopLevel parses a single top level form. If the form is abandoned
+// the parser is left at the start of the next one and ok is false.
+func (p *parser) parseTopLevel() (n ast.Node, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(bailout); !ok {
+				panic(r)
+			}
+			p.curScope = p.topScope
+			n, ok = nil, false
+		}
+	}()
+	p.formErrs = p.file.NumErrors()
+	p.exprErrs = p.formErrs
+	return p.parse(), true
+}
+
 func (p *parser) parse() ast.Node {
 	switch p.tok {
 	case token.LPAREN:
 		return p.parseExpression()
-	case token.COMMENT:
-		// consume comment and move on
-		p.next()
-		return p.parse()
 	case token.EOF:
 		return nil
 	default:
@@ -98,6 +256,66 @@ func (p *parser) parse() ast.Node {
 	return nil
 }
 
+// parseArgument parses the single argument taken by builtins such as int and
+// number?
+func (p *parser) parseArgument(name string) []ast.Node {
+	if p.tok == token.RPAREN {
+		p.addError("'", name, "' requires an argument")
+		return nil
+	}
+	n := p.parseSubExpression2()
+	if n == nil {
+		return nil
+	}
+	if p.tok != token.RPAREN {
+		p.addError("'", name, "' takes a single argument, got: ", p.lit)
+		return nil
+	}
+	return []ast.Node{n}
+}
+
+func (p *parser) parseAssertEqualExpression(lp token.Pos) *ast.AssertEqualExpr {
+	ae := new(ast.AssertEqualExpr)
+	ae.LParen = lp
+	p.next()
+	for p.tok != token.RPAREN && p.tok != token.EOF {
+		n := p.parseSubExpression2()
+		if n == nil {
+			return nil
+		}
+		ae.Nodes = append(ae.Nodes, n)
+	}
+	if len(ae.Nodes) != 2 {
+		p.addError("'assert-equal' requires an expected and an actual value")
+		return nil
+	}
+	ae.RParen = p.pos
+	return ae
+}
+
+func (p *parser) parseAssertExpression(lp token.Pos) *ast.AssertExpr {
+	ae := new(ast.AssertExpr)
+	ae.LParen = lp
+	p.next()
+	v := p.parseSubExpression2()
+	if v == nil {
+		return nil
+	}
+	if p.tok != token.IDENT {
+		p.addError("Expected type name, got: ", p.lit)
+		return nil
+	}
+	ae.Type = p.lit
+	p.next()
+	if p.tok != token.RPAREN {
+		p.addError("Expected closing paren, got: ", p.lit)
+		return nil
+	}
+	ae.Nodes = []ast.Node{v}
+	ae.RParen = p.pos
+	return ae
+}
+
 func (p *parser) parseCaseExpr(compok bool) *ast.CaseExpr {
 	if p.tok != token.LPAREN {
 		p.addError("Expected opening bracket, got: ", p.lit)
@@ -133,6 +351,9 @@ func (p *parser) parseCaseExpr(compok bool) *ast.CaseExpr {
 	nodes := make([]ast.Node, 0, 2)
 	nodes = append(nodes, comp)
 	for p.tok != token.RPAREN {
+		if p.tok == token.EOF {
+			p.addError()
+		}
 		nodes = append(nodes, p.parse())
 		p.next()
 	}
@@ -176,6 +397,19 @@ func (p *parser) parseConcatExpression(lp token.Pos) *ast.ConcatExpr {
 		p.addError("Concatenation requires at least two arguments")
 		return nil
 	}
+	ce.RParen = p.pos
+	return ce
+}
+
+func (p *parser) parseConvExpression(lp token.Pos) *ast.ConvExpr {
+	ce := new(ast.ConvExpr)
+	ce.LParen = lp
+	ce.ConvLit = p.lit
+	p.next()
+	if ce.Nodes = p.parseArgument(ce.ConvLit); ce.Nodes == nil {
+		return nil
+	}
+	ce.RParen = p.pos
 	return ce
 }
 
@@ -190,18 +424,27 @@ func (p *parser) parseDefineExpression(lparen token.Pos) *ast.DefineExpr {
 	p.next()
 	switch p.tok {
 	case token.LPAREN:
-		e := p.parseIdentifierList()
+		e, types := p.parseIdentifierList()
+		if e == nil {
+			return nil
+		}
+		if len(e.Nodes) == 0 {
+			p.addError("Expected function name")
+			return nil
+		}
 		l := e.Nodes
 		d.Name = l[0].(*ast.Identifier).Lit
+		d.Type = types[0]
+		d.ArgTypes = types[1:]
 		l = l[1:]
 		for _, v := range l {
 			d.Args = append(d.Args, v.(*ast.Identifier).Lit)
-			d.Scope.Insert(v.(*ast.Identifier).Lit, nil)
 			p.curScope.Insert(v.(*ast.Identifier).Lit, d)
 		}
 	case token.IDENT:
 		d.Name = p.parseIdentifier().Lit
 		p.next()
+		d.Type = p.parseTypeAnnotation()
 	default:
 		p.addError("Expected identifier(s) but got: ", p.lit)
 		return nil
@@ -218,11 +461,33 @@ func (p *parser) parseDefineExpression(lparen token.Pos) *ast.DefineExpr {
 		p.addError("Expected closing paren but got: ", p.lit)
 		d = nil // don't exit without reverting scope
 	}
+	if d != nil {
+		d.RParen = p.pos
+	}
 	p.curScope = tmp
 	return d
 }
 
+// parseExpression parses a parenthesized expression. On error it skips to
+// the closing paren, restoring the scope, and returns nil.
 func (p *parser) parseExpression() ast.Node {
+	if p.depth > 1 && p.file.NumErrors() > p.formErrs && p.startsLine() {
+		// an unclosed paren in a form with errors, presumably
+		panic(bailout{})
+	}
+	depth, scope, errs := p.depth, p.curScope, p.exprErrs
+	p.exprErrs = p.file.NumErrors()
+	n := p.parseForm()
+	if p.file.NumErrors() > p.exprErrs {
+		p.curScope = scope
+		p.sync(depth)
+		n = nil
+	}
+	p.exprErrs = errs
+	return n
+}
+
+func (p *parser) parseForm() ast.Node {
 	lparen := p.pos
 	p.next()
 	switch p.tok {
@@ -238,9 +503,22 @@ func (p *parser) parseExpression() ast.Node {
 	case token.ADD, token.SUB, token.MUL, token.DIV, token.MOD, token.AND,
 		token.OR:
 		return p.parseMathExpression(lparen)
+	case token.ASSERTEQUAL:
+		return p.parseAssertEqualExpression(lparen)
+	case token.ASSERTTYPE:
+		return p.parseAssertExpression(lparen)
+	case token.BOOLP, token.FUNCTIONP, token.LISTP, token.NUMBERP,
+		token.STRINGP:
+		return p.parsePredExpression(lparen)
 	case token.DEFINE:
 		return p.parseDefineExpression(lparen)
+	case token.DEFTEST:
+		return p.parseTestExpression(lparen)
 	case token.IDENT:
+		// a function may take the name of a builtin which isn't a keyword
+		if token.IsBuiltin(p.lit) && !p.isFunction(p.lit) {
+			return p.parseConvExpression(lparen)
+		}
 		return p.parseUserExpression(lparen)
 	case token.IF:
 		return p.parseIfExpression(lparen)
@@ -251,29 +529,34 @@ func (p *parser) parseExpression() ast.Node {
 	case token.SWITCH:
 		return p.parseSwitchExpression(lparen)
 	}
+	p.addError("Expected operator, keyword or function name, got: ", p.lit)
 	return nil
 }
 
 func (p *parser) parseIdentifier() *ast.Identifier {
-	return &ast.Identifier{p.pos, p.lit}
+	return &ast.Identifier{Id: p.pos, Lit: p.lit}
 }
 
-func (p *parser) parseIdentifierList() *ast.Expression {
+// parseIdentifierList parses a list of identifiers, each with an optional
+// type annotation. The declared types are returned alongside the list.
+func (p *parser) parseIdentifierList() (*ast.Expression, []string) {
 	e := new(ast.Expression)
 	e.LParen = p.pos
 	e.Nodes = make([]ast.Node, 0)
+	types := make([]string, 0)
 	p.next()
 	for p.tok == token.IDENT {
 		e.Nodes = append(e.Nodes, p.parseIdentifier())
 		p.next()
+		types = append(types, p.parseTypeAnnotation())
 	}
 	if p.tok != token.RPAREN {
 		p.addError("Expected identifier or rparen, got: ", p.lit)
-		return nil
+		return nil, nil
 	}
 	e.RParen = p.pos
 	p.next()
-	return e
+	return e, types
 }
 
 func (p *parser) parseIfExpression(lparen token.Pos) *ast.IfExpr {
@@ -301,22 +584,6 @@ func (p *parser) parseIfExpression(lparen token.Pos) *ast.IfExpr {
 	return ie
 }
 
-func (p *parser) parseImportExpression(lp token.Pos) *ast.ImportExpr {
-	ie := new(ast.ImportExpr)
-	ie.LParen = lp
-	if p.tok != token.STRING { // p.expect(token.STRING)
-		p.addError("Expected string, got:", p.lit)
-		return nil
-	}
-	ie.Import = p.lit
-	if p.tok != token.RPAREN { // p.expect(token.STRING)
-		p.addError("Expected closing paren, got:", p.lit)
-		return nil
-	}
-	ie.RParen = p.pos
-	return ie
-}
-
 func (p *parser) parseMathExpression(lp token.Pos) ast.Node {
 	me := new(ast.MathExpr)
 	me.LParen = lp
@@ -329,6 +596,10 @@ func (p *parser) parseMathExpression(lp token.Pos) ast.Node {
 	for p.tok != token.RPAREN && p.tok != token.EOF {
 		me.Nodes = append(me.Nodes, p.parseSubExpression())
 	}
+	if p.tok != token.RPAREN {
+		p.addError("Expected closing paren, got: ", p.lit)
+		return nil
+	}
 	if len(me.Nodes) < 2 {
 		p.addError("Math expressions must have at least 2 arguments")
 		return nil
@@ -346,6 +617,18 @@ func (p *parser) parseNumber() *ast.Number {
 	return &ast.Number{p.pos, p.lit, int(i)}
 }
 
+func (p *parser) parsePredExpression(lp token.Pos) *ast.PredExpr {
+	pe := new(ast.PredExpr)
+	pe.LParen = lp
+	pe.PredLit = p.lit
+	p.next()
+	if pe.Nodes = p.parseArgument(pe.PredLit); pe.Nodes == nil {
+		return nil
+	}
+	pe.RParen = p.pos
+	return pe
+}
+
 func (p *parser) parsePrintExpression(lparen token.Pos) *ast.PrintExpr {
 	pe := new(ast.PrintExpr)
 	pe.LParen = lparen
@@ -375,6 +658,7 @@ func (p *parser) parseSetExpression(lparen token.Pos) *ast.SetExpr {
 	// be either tested in another pass or at runtime
 	se.Name = p.parseIdentifier().Lit
 	p.next()
+	se.Type = p.parseTypeAnnotation()
 	se.Value = p.parseSubExpression2()
 	if p.tok != token.RPAREN {
 		p.addError("Unknown token:", p.lit, "Expected: ')'")
@@ -392,9 +676,6 @@ func (p *parser) parseString() *ast.String {
 }
 
 func (p *parser) parseSubExpression() ast.Node {
-	for p.tok == token.COMMENT {
-		p.next()
-	}
 	var n ast.Node
 	switch p.tok {
 	case token.IDENT:
@@ -420,9 +701,6 @@ func (p *parser) parseSubExpression() ast.Node {
 }
 
 func (p *parser) parseSubExpression2() ast.Node {
-	for p.tok == token.COMMENT {
-		p.next()
-	}
 	if p.tok == token.STRING {
 		n := p.parseString()
 		p.next()
@@ -460,6 +738,62 @@ func (p *parser) parseSwitchExpression(lparen token.Pos) *ast.SwitchExpr {
 		RParen: p.pos, Nodes: nodes}, Pred: pred}
 }
 
+// parseTestExpression parses (deftest name body...). The body has a scope of
+// its own, like that of a define, but the name is not declared.
+func (p *parser) parseTestExpression(lparen token.Pos) *ast.TestExpr {
+	if p.depth > 1 {
+		p.addError("Tests may only be declared at the top level")
+		return nil
+	}
+	te := new(ast.TestExpr)
+	te.LParen = lparen
+	p.next()
+	if p.tok != token.IDENT {
+		p.addError("Expected test name but got: ", p.lit)
+		return nil
+	}
+	te.Name = p.lit
+	p.next()
+	tmp := p.curScope
+	te.Scope = ast.NewScope(p.curScope)
+	p.curScope = te.Scope
+	te.Nodes = make([]ast.Node, 0)
+	for p.tok != token.RPAREN {
+		te.Nodes = append(te.Nodes, p.parseSubExpression2())
+	}
+	p.curScope = tmp
+	if len(te.Nodes) < 1 {
+		p.addError("Expected list of expressions but got: ", p.lit)
+		return nil
+	}
+	te.RParen = p.pos
+	return te
+}
+
+// parseTypeAnnotation parses an optional ':type' following an identifier
+// and returns the name of the type, or an empty string if there is none.
+// Checking the type is valid is left to the type checker.
+func (p *parser) parseTypeAnnotation() string {
+	if p.tok != token.COLON {
+		return ""
+	}
+	p.next()
+	if p.tok != token.IDENT {
+		p.addError("Expected type name after ':', got: ", p.lit)
+		return ""
+	}
+	typ := p.lit
+	p.next()
+	return typ
+}
+
+// isFunction reports whether name is that of a function in scope. Arguments
+// are bound to their define, so its name is checked too.
+func (p *parser) isFunction(name string) bool {
+	d, ok := p.curScope.Lookup(name).(*ast.DefineExpr)
+	return ok && d.Name == name
+}
+
 func (p *parser) parseUserExpression(lp token.Pos) *ast.UserExpr {
 	ident := p.curScope.Lookup(p.lit)
 	if ident == nil {
@@ -472,6 +806,7 @@ func (p *parser) parseUserExpression(lp token.Pos) *ast.UserExpr {
 		return nil
 	}
 	ue := new(ast.UserExpr)
+	ue.LParen = lp
 	ue.Name = p.lit
 	p.next()
 	for p.tok != token.RPAREN {
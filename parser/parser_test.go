@@ -1,11 +1,19 @@
 package parser_test
 
 import (
+	"bytes"
+	"flag"
 	"github.com/rthornton128/gocalc/ast"
 	"github.com/rthornton128/gocalc/parser"
+	"github.com/rthornton128/gocalc/token"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
+var update = flag.Bool("update", false, "update the golden files")
+
 func TestParserBasic(t *testing.T) {
 	var tests = []struct {
 		expr string
@@ -30,3 +38,142 @@ func TestParserBasic(t *testing.T) {
 		}
 	}
 }
+
+func TestParserSandbox(t *testing.T) {
+	var tests = []struct {
+		expr  string
+		allow []string
+		errs  int
+	}{
+		{"(+ 1 2)", nil, 0},
+		{"(print 1)", nil, 1},
+		{"(print (print 1))", nil, 1},
+		{"(print 1)", []string{"io"}, 0},
+		{"(print 1) (print 2)", []string{"fs", "time"}, 2},
+	}
+	for i, test := range tests {
+		f := token.NewFile("", test.expr, 1)
+		parser.ParseFileSandbox(f, test.expr, test.allow)
+		if f.NumErrors() != test.errs {
+			t.Log(i, ") Expected errors:", test.errs)
+			t.Fatal(i, ") Got:", f.Err())
+		}
+	}
+}
+
+func TestParserComments(t *testing.T) {
+	src := "; one\n;two\n\n; three\n(print 1) ; four\n; five\n(print 2)"
+	f := token.NewFile("", src, 1)
+	n := parser.ParseFile(f, src)
+	if f.NumErrors() > 0 {
+		t.Fatal(f.Err())
+	}
+	want := []string{"one\ntwo", "three", "four", "five"}
+	if len(n.Comments) != len(want) {
+		t.Fatal("Expected", len(want), "comment groups, got:", len(n.Comments))
+	}
+	for i, g := range n.Comments {
+		if g.Text() != want[i] {
+			t.Log(i, "- Expected:", want[i])
+			t.Fatal(i, "- Got:", g.Text())
+		}
+	}
+}
+
+func TestParserRecovery(t *testing.T) {
+	var tests = []struct {
+		src  string
+		errs []string
+	}{
+		{"(print 1", []string{"Line: 1 Column: 9 - Unexpected end of file"}},
+		{"(42) (print c) (+ 1)", []string{
+			"Line: 1 Column: 2 - Expected operator, keyword or function " +
+				"name, got: 42",
+			"Line: 1 Column: 13 - Undeclared identifier: c",
+			"Line: 1 Column: 20 - Math expressions must have at least 2 " +
+				"arguments"}},
+		{"(if (g 1) 2) (print 3)", []string{
+			"Line: 1 Column: 6 - Undeclared identifier: g"}},
+		// the scope of a define is left behind
+		{"(define (f x) (print y)) (print x)", []string{
+			"Line: 1 Column: 22 - Undeclared identifier: y",
+			"Line: 1 Column: 33 - Undeclared identifier: x"}},
+		{"(define (f 1) 2)\n(define (g x) (* x))\n(print (f 1) (g 2))",
+			[]string{
+				"Line: 1 Column: 12 - Expected identifier or rparen, got: 1",
+				"Line: 2 Column: 19 - Math expressions must have at least 2 " +
+					"arguments",
+				"Line: 3 Column: 9 - Undeclared identifier: f"}},
+		// int, float and str are builtins only at the head of an expression
+		{"(set int 1)\n(print (+ int float) (str))", []string{
+			"Line: 2 Column: 15 - Undeclared identifier: float",
+			"Line: 2 Column: 26 - 'str' requires an argument"}},
+		{"(define () 1)\n(print 2)", []string{
+			"Line: 1 Column: 12 - Expected function name"}},
+		// a missing paren is found at the next top level form
+		{"(define (f x)\n\t(print y)\n(print (f 1))\n(print z)", []string{
+			"Line: 2 Column: 9 - Undeclared identifier: y",
+			"Line: 4 Column: 8 - Undeclared identifier: z"}},
+		{"(switch\n\t(case (= 1 1) (print 1)\n(set a (+ 1 \"a\"))", []string{
+			"Line: 3 Column: 13 - Expected Number or Expression, got " +
+				"String:\"a\"",
+			"Line: 3 Column: 18 - Unexpected end of file"}},
+		{"(define (f) (deftest t 1) 2)\n(deftest (g) 1)\n(assert-equal 1)",
+			[]string{
+				"Line: 1 Column: 14 - Tests may only be declared at the top " +
+					"level",
+				"Line: 2 Column: 10 - Expected test name but got: (",
+				"Line: 3 Column: 16 - 'assert-equal' requires an expected " +
+					"and an actual value"}},
+	}
+	for i, test := range tests {
+		f := token.NewFile("", test.src, 1)
+		parser.ParseFile(f, test.src)
+		var got []string
+		if err := f.Err(); err != nil {
+			got = err.(token.ErrorList)
+		}
+		if strings.Join(got, "\n") != strings.Join(test.errs, "\n") {
+			t.Log(i, "- Expected:", test.errs)
+			t.Fatal(i, "- Got:", got)
+		}
+	}
+}
+
+// TestParserGolden compares the tree parsed from each file in testdata with
+// the dump in the matching .golden file.
+func TestParserGolden(t *testing.T) {
+	names, err := filepath.Glob(filepath.Join("testdata", "*.calc"))
+	if err != nil || len(names) == 0 {
+		t.Fatal("No test files found:", err)
+	}
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fset := token.NewFileSet()
+		f := fset.AddFile(name, string(data))
+		n := parser.ParseFile(f, string(data))
+		if f.NumErrors() > 0 {
+			t.Fatal(name, "- Unexpected errors:", f.Err())
+		}
+		var buf bytes.Buffer
+		ast.Fprint(&buf, fset, n)
+		golden := strings.TrimSuffix(name, ".calc") + ".golden"
+		if *update {
+			if err := ioutil.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Log(name, "- Expected:", string(want))
+			t.Fatal(name, "- Got:", buf.String())
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+package profile
+
+import (
+	"compress/gzip"
+	"io"
+	"sort"
+)
+
+// buffer encodes a protocol buffer message
+type buffer []byte
+
+func (b *buffer) varint(x uint64) {
+	for x >= 0x80 {
+		*b = append(*b, byte(x)|0x80)
+		x >>= 7
+	}
+	*b = append(*b, byte(x))
+}
+
+// int encodes a varint field, omitted if zero
+func (b *buffer) int(field int, x int64) {
+	if x != 0 {
+		b.varint(uint64(field) << 3)
+		b.varint(uint64(x))
+	}
+}
+
+// bytes encodes a length delimited field
+func (b *buffer) bytes(field int, data []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(data)))
+	*b = append(*b, data...)
+}
+
+func (b *buffer) packed(field int, list []int64) {
+	var p buffer
+	for _, x := range list {
+		p.varint(uint64(x))
+	}
+	b.bytes(field, p)
+}
+
+// Fields of the messages in profile.proto, from github.com/google/pprof
+const (
+	profileSampleType        = 1
+	profileSample            = 2
+	profileLocation          = 4
+	profileFunction          = 5
+	profileStringTable       = 6
+	profileTimeNanos         = 9
+	profileDurationNanos     = 10
+	profileDefaultSampleType = 14
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+
+	locationID   = 1
+	locationLine = 4
+
+	lineFunctionID = 1
+	lineLine       = 2
+
+	functionID         = 1
+	functionName       = 2
+	functionSystemName = 3
+	functionFilename   = 4
+	functionStartLine  = 5
+)
+
+// pprof encodes a profile
+type pprof struct {
+	buffer
+	strings map[string]int64
+	table   []string
+	funcs   map[*Func]int64
+	locs    map[loc]int64
+}
+
+func (e *pprof) string(s string) int64 {
+	i, ok := e.strings[s]
+	if !ok {
+		i = int64(len(e.table))
+		e.strings[s] = i
+		e.table = append(e.table, s)
+	}
+	return i
+}
+
+func (e *pprof) valueType(field int, typ, unit string) {
+	var m buffer
+	m.int(valueTypeType, e.string(typ))
+	m.int(valueTypeUnit, e.string(unit))
+	e.bytes(field, m)
+}
+
+func (e *pprof) function(f *Func) int64 {
+	id, ok := e.funcs[f]
+	if !ok {
+		id = int64(len(e.funcs) + 1)
+		e.funcs[f] = id
+		name := f.Name
+		if f.def == nil && f.Pos.Filename != "" {
+			name = f.Pos.Filename // pprof drops names in angle brackets
+		}
+		var m buffer
+		m.int(functionID, id)
+		m.int(functionName, e.string(name))
+		m.int(functionSystemName, e.string(name))
+		m.int(functionFilename, e.string(f.Pos.Filename))
+		m.int(functionStartLine, int64(f.Pos.Line))
+		e.bytes(profileFunction, m)
+	}
+	return id
+}
+
+func (e *pprof) location(l loc) int64 {
+	id, ok := e.locs[l]
+	if !ok {
+		fn := e.function(l.fn)
+		id = int64(len(e.locs) + 1)
+		e.locs[l] = id
+		var line buffer
+		line.int(lineFunctionID, fn)
+		if l.line != nil {
+			line.int(lineLine, int64(l.line.Pos.Line))
+		}
+		var m buffer
+		m.int(locationID, id)
+		m.bytes(locationLine, line)
+		e.bytes(profileLocation, m)
+	}
+	return id
+}
+
+// samples encodes a sample for n, if anything was spent there, and each of
+// its children
+func (e *pprof) samples(n *node) {
+	if n.evals != 0 || n.time != 0 || n.allocs != 0 {
+		var ids []int64
+		for s := n; s.parent != nil; s = s.parent {
+			ids = append(ids, e.location(s.loc))
+		}
+		var m buffer
+		m.packed(sampleLocationID, ids)
+		m.packed(sampleValue, []int64{n.evals, n.time, n.allocs})
+		e.bytes(profileSample, m)
+	}
+	var list []*node
+	for _, c := range n.children {
+		list = append(list, c)
+	}
+	sortNodes(list)
+	for _, c := range list {
+		e.samples(c)
+	}
+}
+
+// sortNodes orders places in a call stack by function, then line, so that
+// profiles are written the same way each time
+func sortNodes(list []*node) {
+	line := func(l loc) int {
+		if l.line == nil {
+			return 0
+		}
+		return l.line.Pos.Line
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i].loc, list[j].loc
+		switch {
+		case a.fn.Pos.Line != b.fn.Pos.Line:
+			return a.fn.Pos.Line < b.fn.Pos.Line
+		case a.fn.Name != b.fn.Name:
+			return a.fn.Name < b.fn.Name
+		}
+		return line(a) < line(b)
+	})
+}
+
+// WritePprof writes the profile to w in the gzipped protocol buffer format
+// read by go tool pprof. Each sample is a call stack of Calc functions,
+// with the number of nodes evaluated, the time taken and the number of
+// allocations made there.
+func (p *Profiler) WritePprof(w io.Writer) error {
+	e := &pprof{strings: map[string]int64{"": 0}, table: []string{""},
+		funcs: make(map[*Func]int64), locs: make(map[loc]int64)}
+	e.valueType(profileSampleType, "evaluations", "count")
+	e.valueType(profileSampleType, "time", "nanoseconds")
+	e.valueType(profileSampleType, "allocations", "count")
+	e.samples(&p.root)
+	e.int(profileTimeNanos, p.start.UnixNano())
+	e.int(profileDurationNanos, int64(p.Total()))
+	e.int(profileDefaultSampleType, e.string("time"))
+	for _, s := range e.table {
+		e.bytes(profileStringTable, []byte(s))
+	}
+	z := gzip.NewWriter(w)
+	if _, err := z.Write(e.buffer); err != nil {
+		return err
+	}
+	return z.Close()
+}
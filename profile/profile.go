@@ -0,0 +1,307 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+// Package profile measures where the evaluation of a Calc program spends
+// its time.
+//
+// Rather than sampling, the profiler is called by the evaluator before each
+// node is evaluated, and as user functions are called and return. The time
+// between two such events is charged to the function and line being
+// evaluated at the first. Calls, evaluations and allocations are counted
+// exactly. The results may be printed as a report, or written in the
+// protocol buffer format read by go tool pprof.
+package profile
+
+import (
+	"fmt"
+	"github.com/rthornton128/gocalc/ast"
+	"github.com/rthornton128/gocalc/eval"
+	"github.com/rthornton128/gocalc/token"
+	"io"
+	"sort"
+	"time"
+)
+
+// Func holds the statistics of a user function, or of the file itself.
+type Func struct {
+	Name   string         // "<file>" for the file
+	Pos    token.Position // of the definition
+	Calls  int
+	Self   time.Duration // spent evaluating the function itself
+	Cum    time.Duration // including the functions it called
+	Allocs int
+
+	def    *ast.DefineExpr
+	active int // calls in progress
+	start  time.Time
+}
+
+// Line holds the statistics of a line of source.
+type Line struct {
+	Pos    token.Position // the Filename and Line only
+	Evals  int            // number of nodes evaluated
+	Self   time.Duration
+	Allocs int
+}
+
+// node is a call stack, or a place in one, with what was spent there
+type node struct {
+	loc      loc
+	parent   *node
+	children map[loc]*node
+	evals    int64
+	time     int64
+	allocs   int64
+}
+
+// loc is a line within a function
+type loc struct {
+	fn   *Func
+	line *Line
+}
+
+func (n *node) child(l loc) *node {
+	c, ok := n.children[l]
+	if !ok {
+		if n.children == nil {
+			n.children = make(map[loc]*node)
+		}
+		c = &node{loc: l, parent: n}
+		n.children[l] = c
+	}
+	return c
+}
+
+// caller is what is restored when a call returns
+type caller struct {
+	stack *node
+	at    loc
+	leaf  *node
+}
+
+// Profiler gathers the statistics of an evaluation.
+type Profiler struct {
+	now         func() time.Time
+	start, last time.Time
+
+	file  *Func
+	funcs map[*ast.DefineExpr]*Func
+	lines map[token.Position]*Line
+	pos   map[token.Pos]*Line // cache of the line of each node
+
+	root  node
+	stack *node // call stack in progress
+	at    loc   // where evaluation is
+	leaf  *node // at, within stack
+	calls []caller
+}
+
+// New returns a Profiler, which starts measuring at the first event.
+func New() *Profiler {
+	p := &Profiler{now: time.Now, file: &Func{Name: "<file>", Calls: 1},
+		funcs: make(map[*ast.DefineExpr]*Func),
+		lines: make(map[token.Position]*Line),
+		pos:   make(map[token.Pos]*Line)}
+	p.stack = &p.root
+	p.at = loc{fn: p.file}
+	p.leaf = p.root.child(p.at)
+	return p
+}
+
+// Attach sets the hooks of opt to call the profiler, before any already
+// set.
+func (p *Profiler) Attach(opt *eval.Options) {
+	debug, enter, exit, alloc := opt.Debug, opt.Enter, opt.Exit, opt.Alloc
+	opt.Debug = func(n ast.Node, st *eval.State) {
+		p.eval(n, st)
+		if debug != nil {
+			debug(n, st)
+		}
+	}
+	opt.Enter = func(c *eval.Call) {
+		p.enter(c)
+		if enter != nil {
+			enter(c)
+		}
+	}
+	opt.Exit = func(c *eval.Call, res interface{}) {
+		p.exit(c)
+		if exit != nil {
+			exit(c, res)
+		}
+	}
+	opt.Alloc = func(n ast.Node) {
+		p.alloc()
+		if alloc != nil {
+			alloc(n)
+		}
+	}
+}
+
+// tick charges the time since the last event to where evaluation was
+func (p *Profiler) tick() time.Time {
+	t := p.now()
+	if p.last.IsZero() {
+		p.start = t
+	}
+	d := t.Sub(p.last)
+	if p.last.IsZero() {
+		d = 0
+	}
+	p.last = t
+	p.at.fn.Self += d
+	if p.at.line != nil {
+		p.at.line.Self += d
+	}
+	p.leaf.time += int64(d)
+	return t
+}
+
+func (p *Profiler) eval(n ast.Node, st *eval.State) {
+	p.tick()
+	if _, ok := n.(*ast.File); ok {
+		return
+	}
+	l, ok := p.pos[n.Pos()]
+	if !ok {
+		pos := st.Position(n.Pos())
+		key := token.Position{Filename: pos.Filename, Line: pos.Line}
+		if l, ok = p.lines[key]; !ok {
+			l = &Line{Pos: key}
+			p.lines[key] = l
+		}
+		p.pos[n.Pos()] = l
+	}
+	if f := p.at.fn; !f.Pos.IsValid() {
+		if f.def != nil {
+			f.Pos = st.Position(f.def.Pos())
+		} else {
+			f.Pos = token.Position{Filename: l.Pos.Filename, Line: 1}
+		}
+	}
+	l.Evals++
+	p.at.line = l
+	p.leaf = p.stack.child(p.at)
+	p.leaf.evals++
+}
+
+func (p *Profiler) enter(c *eval.Call) {
+	t := p.tick()
+	p.calls = append(p.calls, caller{p.stack, p.at, p.leaf})
+	f, ok := p.funcs[c.Def]
+	if !ok {
+		f = &Func{Name: c.Name, def: c.Def}
+		p.funcs[c.Def] = f
+	}
+	f.Calls++
+	if f.active == 0 {
+		f.start = t
+	}
+	f.active++
+	p.stack = p.leaf
+	p.at = loc{fn: f}
+	p.leaf = p.stack.child(p.at)
+}
+
+func (p *Profiler) exit(c *eval.Call) {
+	t := p.tick()
+	f := p.at.fn
+	if f.active--; f.active == 0 {
+		f.Cum += t.Sub(f.start)
+	}
+	r := p.calls[len(p.calls)-1]
+	p.calls = p.calls[:len(p.calls)-1]
+	p.stack, p.at, p.leaf = r.stack, r.at, r.leaf
+}
+
+func (p *Profiler) alloc() {
+	p.at.fn.Allocs++
+	if p.at.line != nil {
+		p.at.line.Allocs++
+	}
+	p.leaf.allocs++
+}
+
+// Stop ends the profile, closing any calls left in progress by an error.
+func (p *Profiler) Stop() {
+	t := p.tick()
+	for _, f := range p.funcs {
+		if f.active > 0 {
+			f.Cum += t.Sub(f.start)
+			f.active = 0
+		}
+	}
+	p.file.Cum = p.Total()
+}
+
+// Total returns the time spent evaluating.
+func (p *Profiler) Total() time.Duration {
+	return p.last.Sub(p.start)
+}
+
+// Funcs returns the statistics of the file and each function called, in
+// decreasing order of self time.
+func (p *Profiler) Funcs() []*Func {
+	list := []*Func{p.file}
+	for _, f := range p.funcs {
+		list = append(list, f)
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Self != list[j].Self {
+			return list[i].Self > list[j].Self
+		}
+		return list[i].Pos.Line < list[j].Pos.Line
+	})
+	return list
+}
+
+// Lines returns the statistics of each line evaluated, in decreasing order
+// of self time.
+func (p *Profiler) Lines() []*Line {
+	var list []*Line
+	for _, l := range p.lines {
+		list = append(list, l)
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Self != list[j].Self {
+			return list[i].Self > list[j].Self
+		}
+		return list[i].Pos.Line < list[j].Pos.Line
+	})
+	return list
+}
+
+// WriteReport writes a table of the functions and lines to w.
+func (p *Profiler) WriteReport(w io.Writer) {
+	total := p.Total()
+	percent := func(d time.Duration) float64 {
+		if total == 0 {
+			return 0
+		}
+		return 100 * float64(d) / float64(total)
+	}
+	round := func(d time.Duration) time.Duration {
+		return d.Round(time.Microsecond)
+	}
+	fmt.Fprintf(w, "Total time: %v\n\n", round(total))
+	fmt.Fprintf(w, "%8s %10s %6s %10s %8s  %s\n", "calls", "self", "self%",
+		"cum", "allocs", "function")
+	for _, f := range p.Funcs() {
+		name := f.Name
+		if f.Pos.IsValid() {
+			name += fmt.Sprintf(" (%s:%d)", f.Pos.Filename, f.Pos.Line)
+		}
+		fmt.Fprintf(w, "%8d %10v %5.1f%% %10v %8d  %s\n", f.Calls,
+			round(f.Self), percent(f.Self), round(f.Cum), f.Allocs, name)
+	}
+	fmt.Fprintf(w, "\n%8s %10s %6s %8s  %s\n", "evals", "self", "self%",
+		"allocs", "line")
+	for _, l := range p.Lines() {
+		fmt.Fprintf(w, "%8d %10v %5.1f%% %8d  %s:%d\n", l.Evals, round(l.Self),
+			percent(l.Self), l.Allocs, l.Pos.Filename, l.Pos.Line)
+	}
+}
@@ -0,0 +1,99 @@
+package profile_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"github.com/rthornton128/gocalc/eval"
+	"github.com/rthornton128/gocalc/profile"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const src = `(define (fib x)
+	(if (or (= x 0) (= x 1)) x (+ (fib (- x 1)) x)))
+(define (greet name)
+	(+ "hi " name))
+(fib 5)
+(greet (str (fib 2)))`
+
+func run(t *testing.T) *profile.Profiler {
+	p := profile.New()
+	var opt eval.Options
+	p.Attach(&opt)
+	if _, err := eval.EvalFileContext(context.Background(), "p.calc", src,
+		opt); err != nil {
+		t.Fatal(err)
+	}
+	p.Stop()
+	return p
+}
+
+func TestProfile(t *testing.T) {
+	p := run(t)
+	var tests = []struct {
+		name                string
+		line, calls, allocs int
+	}{
+		{"<file>", 1, 1, 4},
+		{"fib", 1, 7, 5},
+		{"greet", 3, 1, 1},
+	}
+	funcs := make(map[string]*profile.Func)
+	var self, cum int64
+	for _, f := range p.Funcs() {
+		funcs[f.Name] = f
+		self += int64(f.Self)
+		if f.Self < 0 || f.Cum < f.Self {
+			t.Fatal("Unexpected times:", f.Name, f.Self, f.Cum)
+		}
+		if f.Name == "<file>" {
+			cum = int64(f.Cum)
+		}
+	}
+	if self != int64(p.Total()) || cum != self {
+		t.Fatal("Self times do not add up:", self, cum, p.Total())
+	}
+	for i, test := range tests {
+		f := funcs[test.name]
+		if f == nil || f.Pos.Line != test.line || f.Calls != test.calls ||
+			f.Allocs != test.allocs {
+			t.Log(i, "- Expected:", test)
+			t.Fatal(i, "- Got:", f)
+		}
+	}
+	evals := make(map[int]int)
+	for _, l := range p.Lines() {
+		evals[l.Pos.Line] = l.Evals
+	}
+	if evals[2] != 88 || evals[4] != 3 || evals[1] != 1 || evals[3] != 1 {
+		t.Fatal("Unexpected evaluations by line:", evals)
+	}
+	var buf bytes.Buffer
+	p.WriteReport(&buf)
+	if !strings.Contains(buf.String(), "fib (p.calc:1)") {
+		t.Fatal("Unexpected report:", buf.String())
+	}
+}
+
+func TestPprof(t *testing.T) {
+	var buf bytes.Buffer
+	if err := run(t).WritePprof(&buf); err != nil {
+		t.Fatal(err)
+	}
+	z, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"fib", "greet", "p.calc", "time",
+		"nanoseconds", "allocations"} {
+		if !bytes.Contains(data, []byte(s)) {
+			t.Fatal("Missing from profile:", s)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+// Package readline reads lines typed at a terminal, with line editing,
+// history and tab completion. Input which is not a terminal is read a line
+// at a time without editing.
+//
+// The editing keys are those of Emacs and most shells: the arrow keys,
+// Home, End and Delete, Ctrl-A and Ctrl-E to move to either end of the line,
+// Ctrl-K and Ctrl-U to delete to either end, Ctrl-W to delete a word and
+// Ctrl-P and Ctrl-N to move through the history.
+package readline
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// MaxHistory is the number of lines of history kept.
+const MaxHistory = 1000
+
+// ErrInterrupt is returned by ReadLine when the user types Ctrl-C.
+var ErrInterrupt = errors.New("readline: interrupted")
+
+// Completer returns the candidates for completing the word which ends at
+// offset pos of line, and the offset at which that word starts.
+type Completer func(line string, pos int) (start int, candidates []string)
+
+// Reader reads lines from a terminal.
+type Reader struct {
+	Complete Completer // may be nil
+
+	in      *bufio.Reader
+	out     io.Writer
+	term    *terminal // nil if not switching in and out of raw mode
+	edit    bool      // whether lines are edited
+	history []string
+}
+
+// New returns a Reader for in. Lines are edited if in is a terminal, which
+// is put in raw mode while a line is read.
+func New(in *os.File, out io.Writer) *Reader {
+	r := &Reader{in: bufio.NewReader(in), out: out}
+	if t, err := openTerminal(int(in.Fd())); err == nil {
+		r.term, r.edit = t, true
+	}
+	return r
+}
+
+// NewEditor returns a Reader which edits the lines read from in, which must
+// behave as a terminal in raw mode.
+func NewEditor(in io.Reader, out io.Writer) *Reader {
+	return &Reader{in: bufio.NewReader(in), out: out, edit: true}
+}
+
+// ReadLine prints prompt and returns the next line, without its newline. It
+// returns ErrInterrupt if the user types Ctrl-C and io.EOF at the end of the
+// input, or if the user types Ctrl-D on an empty line.
+func (r *Reader) ReadLine(prompt string) (string, error) {
+	if !r.edit {
+		fmt.Fprint(r.out, prompt)
+		line, err := r.in.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	if r.term != nil {
+		if err := r.term.raw(); err != nil {
+			return "", err
+		}
+		defer r.term.restore()
+	}
+	e := &editor{r: r, prompt: prompt, hist: len(r.history)}
+	return e.run()
+}
+
+/* History */
+
+// AddHistory adds line to the history, unless it is blank or the same as
+// the line before it.
+func (r *Reader) AddHistory(line string) {
+	if strings.TrimSpace(line) == "" ||
+		len(r.history) > 0 && r.history[len(r.history)-1] == line {
+		return
+	}
+	r.history = append(r.history, line)
+	if len(r.history) > MaxHistory {
+		r.history = r.history[len(r.history)-MaxHistory:]
+	}
+}
+
+// History returns the lines of history, oldest first.
+func (r *Reader) History() []string {
+	return r.history
+}
+
+// ReadHistory adds each line read from in to the history.
+func (r *Reader) ReadHistory(in io.Reader) error {
+	s := bufio.NewScanner(in)
+	for s.Scan() {
+		r.AddHistory(s.Text())
+	}
+	return s.Err()
+}
+
+// WriteHistory writes the history to w, one line at a time.
+func (r *Reader) WriteHistory(w io.Writer) error {
+	for _, line := range r.history {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Editing */
+func ctrl(c rune) rune {
+	return c & 0x1f
+}
+
+type editor struct {
+	r      *Reader
+	prompt string
+	buf    []rune
+	pos    int    // cursor position in buf
+	hist   int    // index of the history line shown, len(history) if none
+	saved  []rune // the line being entered, while showing history
+}
+
+func (e *editor) run() (string, error) {
+	e.refresh()
+	for {
+		c, _, err := e.r.in.ReadRune()
+		if err != nil {
+			if err == io.EOF && len(e.buf) > 0 {
+				err = nil
+			}
+			fmt.Fprint(e.r.out, "\r\n")
+			return string(e.buf), err
+		}
+		switch c {
+		case '\r', '\n':
+			fmt.Fprint(e.r.out, "\r\n")
+			return string(e.buf), nil
+		case ctrl('C'):
+			fmt.Fprint(e.r.out, "^C\r\n")
+			return "", ErrInterrupt
+		case ctrl('D'):
+			if len(e.buf) == 0 {
+				fmt.Fprint(e.r.out, "\r\n")
+				return "", io.EOF
+			}
+			e.delete(e.pos, e.pos+1)
+		case ctrl('A'):
+			e.pos = 0
+		case ctrl('E'):
+			e.pos = len(e.buf)
+		case ctrl('B'):
+			e.move(-1)
+		case ctrl('F'):
+			e.move(1)
+		case ctrl('H'), 127:
+			e.delete(e.pos-1, e.pos)
+		case ctrl('K'):
+			e.delete(e.pos, len(e.buf))
+		case ctrl('U'):
+			e.delete(0, e.pos)
+		case ctrl('W'):
+			i := e.pos
+			for i > 0 && unicode.IsSpace(e.buf[i-1]) {
+				i--
+			}
+			for i > 0 && !unicode.IsSpace(e.buf[i-1]) {
+				i--
+			}
+			e.delete(i, e.pos)
+		case ctrl('P'):
+			e.showHistory(e.hist - 1)
+		case ctrl('N'):
+			e.showHistory(e.hist + 1)
+		case '\t':
+			e.complete()
+		case 27:
+			e.escape()
+		default:
+			if unicode.IsPrint(c) {
+				e.insert(c)
+			}
+		}
+		e.refresh()
+	}
+}
+
+// escape handles the escape sequences sent by the arrow keys and friends
+func (e *editor) escape() {
+	c, _, err := e.r.in.ReadRune()
+	if err != nil || c != '[' && c != 'O' {
+		return
+	}
+	var arg []rune
+	for {
+		c, _, err = e.r.in.ReadRune()
+		if err != nil {
+			return
+		}
+		if c < '0' || c > '9' {
+			break
+		}
+		arg = append(arg, c)
+	}
+	switch {
+	case c == 'A':
+		e.showHistory(e.hist - 1)
+	case c == 'B':
+		e.showHistory(e.hist + 1)
+	case c == 'C':
+		e.move(1)
+	case c == 'D':
+		e.move(-1)
+	case c == 'H', c == '~' && (string(arg) == "1" || string(arg) == "7"):
+		e.pos = 0
+	case c == 'F', c == '~' && (string(arg) == "4" || string(arg) == "8"):
+		e.pos = len(e.buf)
+	case c == '~' && string(arg) == "3":
+		e.delete(e.pos, e.pos+1)
+	}
+}
+
+func (e *editor) refresh() {
+	s := "\r" + e.prompt + string(e.buf) + "\x1b[K"
+	if n := len(e.buf) - e.pos; n > 0 {
+		s += fmt.Sprintf("\x1b[%dD", n)
+	}
+	fmt.Fprint(e.r.out, s)
+}
+
+func (e *editor) move(n int) {
+	if p := e.pos + n; p >= 0 && p <= len(e.buf) {
+		e.pos = p
+	}
+}
+
+func (e *editor) insert(s ...rune) {
+	e.buf = append(e.buf[:e.pos], append(s, e.buf[e.pos:]...)...)
+	e.pos += len(s)
+}
+
+// delete removes buf[i:j], as much of it as exists
+func (e *editor) delete(i, j int) {
+	if i < 0 {
+		i = 0
+	}
+	if j > len(e.buf) {
+		j = len(e.buf)
+	}
+	if i >= j {
+		return
+	}
+	e.buf = append(e.buf[:i], e.buf[j:]...)
+	if e.pos > j {
+		e.pos -= j - i
+	} else if e.pos > i {
+		e.pos = i
+	}
+}
+
+func (e *editor) showHistory(i int) {
+	h := e.r.history
+	if i < 0 || i > len(h) || i == e.hist {
+		return
+	}
+	if e.hist == len(h) {
+		e.saved = e.buf
+	}
+	e.hist = i
+	if i == len(h) {
+		e.buf = e.saved
+	} else {
+		e.buf = []rune(h[i])
+	}
+	e.pos = len(e.buf)
+}
+
+// complete completes the word before the cursor as far as the candidates
+// agree, listing them if that adds nothing
+func (e *editor) complete() {
+	if e.r.Complete == nil {
+		return
+	}
+	line := string(e.buf)
+	pos := len(string(e.buf[:e.pos]))
+	start, list := e.r.Complete(line, pos)
+	if len(list) == 0 || start < 0 || start > pos {
+		fmt.Fprint(e.r.out, "\a")
+		return
+	}
+	prefix := list[0]
+	for _, s := range list[1:] {
+		for !strings.HasPrefix(s, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	word := line[start:pos]
+	if len(list) > 1 && len(prefix) <= len(word) {
+		fmt.Fprint(e.r.out, "\r\n"+strings.Join(list, "  ")+"\r\n")
+		return
+	}
+	e.delete(e.pos-len([]rune(word)), e.pos)
+	e.insert([]rune(prefix)...)
+}
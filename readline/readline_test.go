@@ -0,0 +1,86 @@
+package readline_test
+
+import (
+	"bytes"
+	"github.com/rthornton128/gocalc/readline"
+	"io"
+	"strings"
+	"testing"
+)
+
+var words = []string{"prime", "print", "set"}
+
+func complete(line string, pos int) (int, []string) {
+	start := strings.LastIndexAny(line[:pos], " (") + 1
+	var list []string
+	for _, w := range words {
+		if strings.HasPrefix(w, line[start:pos]) {
+			list = append(list, w)
+		}
+	}
+	return start, list
+}
+
+func TestReadLine(t *testing.T) {
+	var tests = []struct {
+		in, line string
+		err      error
+	}{
+		{"abc\r", "abc", nil},
+		{"abc\x1b[D\x1b[DX\r", "aXbc", nil},
+		{"abc\x7f\x7f\r", "a", nil},
+		{"abc\x01X\x05Y\r", "XabcY", nil},
+		{"abc\x1b[H\x1b[3~\x1b[F!\r", "bc!", nil},
+		{"abc\x02\x02\x0b\r", "a", nil},
+		{"abc\x02\x15\r", "c", nil},
+		{"(print one\x17two\r", "(print two", nil},
+		{"(se\t 1\r", "(set 1", nil},
+		{"(pr\t\tn\t\r", "(print", nil},
+		{"\x1b[A\x1b[A\r", "one", nil},
+		{"\x1b[A\x1b[A\x1b[B\r", "two", nil},
+		{"new\x10\x0e\r", "new", nil},
+		{"x\x04\r", "x", nil},
+		{"partial", "partial", nil},
+		{"abc\x03", "", readline.ErrInterrupt},
+		{"\x04", "", io.EOF},
+	}
+	for i, test := range tests {
+		var out bytes.Buffer
+		r := readline.NewEditor(strings.NewReader(test.in), &out)
+		r.Complete = complete
+		r.AddHistory("one")
+		r.AddHistory("two")
+		line, err := r.ReadLine("> ")
+		if line != test.line || err != test.err {
+			t.Logf("%d - Expected: %q %v", i, test.line, test.err)
+			t.Fatalf("%d - Got: %q %v", i, line, err)
+		}
+	}
+}
+
+func TestReadLineCompletionList(t *testing.T) {
+	var out bytes.Buffer
+	r := readline.NewEditor(strings.NewReader("(pri\t\r"), &out)
+	r.Complete = complete
+	r.ReadLine("> ")
+	if !strings.Contains(out.String(), "\r\nprime  print\r\n") {
+		t.Fatalf("Expected candidates to be listed, got: %q", out.String())
+	}
+}
+
+func TestHistory(t *testing.T) {
+	r := readline.NewEditor(strings.NewReader(""), new(bytes.Buffer))
+	r.ReadHistory(strings.NewReader("a\nb\nb\n\nc\n"))
+	r.AddHistory("c")
+	r.AddHistory("  ")
+	for i := 0; i < readline.MaxHistory-1; i++ {
+		r.AddHistory(string(rune('d' + i%2)))
+	}
+	var out bytes.Buffer
+	r.WriteHistory(&out)
+	h := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(h) != readline.MaxHistory || h[0] != "c" ||
+		h[len(h)-1] != "d" {
+		t.Fatal("Unexpected history:", len(h), h[0], h[len(h)-1])
+	}
+}
@@ -0,0 +1,23 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package readline
+
+import "errors"
+
+// terminal is not supported, so lines are never edited
+type terminal struct{}
+
+func openTerminal(fd int) (*terminal, error) {
+	return nil, errors.New("readline: terminal not supported")
+}
+
+func (t *terminal) raw() error     { return nil }
+func (t *terminal) restore() error { return nil }
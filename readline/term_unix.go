@@ -0,0 +1,55 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package readline
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// terminal switches a terminal in and out of raw mode
+type terminal struct {
+	fd   int
+	orig syscall.Termios
+}
+
+func openTerminal(fd int) (*terminal, error) {
+	t := &terminal{fd: fd}
+	if err := ioctl(fd, ioctlGetTermios, &t.orig); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// raw stops the terminal echoing input, processing it a line at a time and
+// turning Ctrl-C into a signal
+func (t *terminal) raw() error {
+	raw := t.orig
+	raw.Iflag &^= syscall.ICRNL | syscall.IXON | syscall.BRKINT |
+		syscall.INPCK | syscall.ISTRIP
+	raw.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	return ioctl(t.fd, ioctlSetTermios, &raw)
+}
+
+func (t *terminal) restore() error {
+	return ioctl(t.fd, ioctlSetTermios, &t.orig)
+}
+
+func ioctl(fd int, req uintptr, t *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req,
+		uintptr(unsafe.Pointer(t)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -8,15 +8,35 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/rthornton128/gocalc/ast"
+	"github.com/rthornton128/gocalc/cover"
+	"github.com/rthornton128/gocalc/dap"
+	"github.com/rthornton128/gocalc/debug"
+	"github.com/rthornton128/gocalc/doc"
 	"github.com/rthornton128/gocalc/eval"
+	"github.com/rthornton128/gocalc/format"
+	"github.com/rthornton128/gocalc/lsp"
+	"github.com/rthornton128/gocalc/parser"
+	"github.com/rthornton128/gocalc/profile"
+	"github.com/rthornton128/gocalc/readline"
+	"github.com/rthornton128/gocalc/resolve"
 	"github.com/rthornton128/gocalc/token"
 	"github.com/rthornton128/gocalc/trans"
+	"github.com/rthornton128/gocalc/vm"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 )
 
 var version = "0.2"
@@ -33,34 +53,734 @@ func stripCR(in []byte) []byte {
 	return out[:i]
 }
 
-func transpileCode(out *os.File, expr string) {
-  /*data, err := ioutil.ReadFile(flag.Arg(0))
-  if err != nil {
-    fmt.Println(err)
-    os.Exit(1)
-  }*/
-  trans.TransExpr(out, string(stripCR([]byte(expr))))
+// transpileFile translates src, read from the named file, to C in out.c.
+// In sandbox mode its builtins are restricted as opt requires. It returns
+// the exit status.
+func transpileFile(name, src string, opt eval.Options) int {
+	f := token.NewFile(name, src, 1)
+	var n *ast.File
+	if opt.Sandbox {
+		for _, c := range opt.Allow {
+			if !parser.IsCapability(c) {
+				fmt.Println("unknown capability:", c)
+				return 2
+			}
+		}
+		n = parser.ParseFileSandbox(f, src, opt.Allow)
+	} else {
+		n = parser.ParseFile(f, src)
+	}
+	if f.NumErrors() > 0 {
+		f.PrintErrors()
+		return 1
+	}
+	out, err := os.Create("out.c")
+	if err != nil {
+		fmt.Println("create:", err)
+		return 1
+	}
+	defer out.Close()
+	trans.TransTree(out, f, n)
+	if f.NumErrors() > 0 {
+		return 1
+	}
+	return 0
+}
+
+// traceFlag is the value of -trace, which may be given alone or with the
+// names of the functions to trace
+type traceFlag struct {
+	on    bool
+	funcs []string
+}
+
+func (t *traceFlag) String() string {
+	return strings.Join(t.funcs, ",")
+}
+
+func (t *traceFlag) Set(s string) error {
+	switch s {
+	case "true", "false":
+		t.on, t.funcs = s == "true", nil
+	default:
+		t.on, t.funcs = true, strings.Split(s, ",")
+	}
+	return nil
+}
+
+func (t *traceFlag) IsBoolFlag() bool {
+	return true
+}
+
+// evalFile evaluates src with the options selected on the command line,
+// printing any errors.
+func evalFile(name, src string, opt eval.Options) interface{} {
+	res, err := eval.EvalFileContext(context.Background(), name, src, opt)
+	if err != nil {
+		eval.PrintError(err)
+		return nil
+	}
+	return res
+}
+
+// vmFile compiles and runs src with the bytecode VM, within the limits and
+// sandbox of opt, printing any errors
+func vmFile(name, src string, opt eval.Options) interface{} {
+	res, err := vm.EvalFileContext(context.Background(), name, src,
+		vm.Options{MaxSteps: opt.MaxSteps, MaxDepth: opt.MaxDepth,
+			MaxSize: opt.MaxSize, Sandbox: opt.Sandbox, Allow: opt.Allow})
+	if err != nil {
+		vm.PrintError(err)
+		return nil
+	}
+	return res
+}
+
+// debugFile runs the named file under the debugger. It returns the exit
+// status.
+func debugFile(name string, opt eval.Options) int {
+	if name == "" {
+		fmt.Println("Usage: gocalc debug file.calc")
+		return 2
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	d, err := debug.New(name, string(stripCR(data)), opt)
+	if err != nil {
+		eval.PrintError(err)
+		return 1
+	}
+	if debug.Run(d, os.Stdin, os.Stdout) != nil {
+		return 1
+	}
+	return 0
+}
+
+// writeProfile ends the profile, printing its report to standard error if
+// report is set, and writing it in pprof format to the file out if named.
+func writeProfile(p *profile.Profiler, report bool, out string) {
+	p.Stop()
+	if report {
+		p.WriteReport(os.Stderr)
+	}
+	if out == "" {
+		return
+	}
+	f, err := os.Create(out)
+	if err == nil {
+		err = p.WritePprof(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// coverFile evaluates src, recording which expressions are evaluated. It
+// prints a report of the coverage to standard error if report is set, and
+// writes a profile and a page of HTML to the files prof and page if named.
+func coverFile(name, src string, opt eval.Options, report bool,
+	prof, page string) {
+	p, err := cover.New(name, src)
+	if err != nil {
+		eval.PrintError(err)
+		return
+	}
+	if _, err := p.Eval(context.Background(), opt); err != nil {
+		eval.PrintError(err)
+	}
+	if report {
+		p.WriteReport(os.Stderr)
+	}
+	for _, out := range []struct {
+		name  string
+		write func(io.Writer) error
+	}{{prof, p.WriteProfile}, {page, p.WriteHTML}} {
+		if out.name == "" {
+			continue
+		}
+		f, err := os.Create(out.name)
+		if err == nil {
+			err = out.write(f)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+// formatFiles formats the named files, or standard input if there are none,
+// and prints the result. If write is set files are instead rewritten in
+// place. It returns the exit status.
+func formatFiles(names []string, write bool) int {
+	if len(names) == 0 {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err == nil {
+			data, err = format.Source("", stripCR(data))
+		}
+		if err != nil {
+			eval.PrintError(err)
+			return 1
+		}
+		os.Stdout.Write(data)
+		return 0
+	}
+	status := 0
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			fmt.Println(err)
+			status = 1
+			continue
+		}
+		data = stripCR(data)
+		out, err := format.Source(name, data)
+		switch {
+		case err != nil:
+			eval.PrintError(err)
+			status = 1
+		case !write:
+			os.Stdout.Write(out)
+		case !bytes.Equal(data, out):
+			if err := ioutil.WriteFile(name, out, 0644); err != nil {
+				fmt.Println(err)
+				status = 1
+			}
+		}
+	}
+	return status
 }
 
+// testFiles runs the tests declared in the files named by args, and in the
+// .calc files beneath the directories named, or the current directory if
+// there are none. Flags among args select the tests run and how much is
+// printed. What a file prints is shown only if one of its tests fails or
+// in verbose mode. It returns the exit status.
+func testFiles(args []string, opt eval.Options) int {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	run := fs.String("run", "",
+		"Run only the tests whose names match this regular expression")
+	verbose := fs.Bool("v", false, "Print the name of each test as it passes")
+	fs.Parse(args)
+	var match func(string) bool
+	if *run != "" {
+		re, err := regexp.Compile(*run)
+		if err != nil {
+			fmt.Println("Bad -run pattern:", err)
+			return 2
+		}
+		match = re.MatchString
+	}
+	names := fs.Args()
+	if len(names) == 0 {
+		names = []string{"."}
+	}
+	var files []string
+	for _, name := range names {
+		err := filepath.Walk(name, func(path string, fi os.FileInfo,
+			err error) error {
+			if err == nil && !fi.IsDir() &&
+				(path == name || filepath.Ext(path) == ".calc") {
+				files = append(files, path)
+			}
+			return err
+		})
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+
+	status, tests := 0, 0
+	for _, name := range files {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			fmt.Println(err)
+			status = 1
+			continue
+		}
+		var out bytes.Buffer
+		opt.Stdout = &out
+		start := time.Now()
+		res, err := eval.RunTests(context.Background(), name,
+			string(stripCR(data)), opt, match)
+		failed := 0
+		for _, r := range res {
+			if r.Err != nil {
+				failed++
+			}
+		}
+		if *verbose || failed > 0 || err != nil {
+			os.Stdout.Write(out.Bytes())
+		}
+		if err != nil {
+			eval.PrintError(err)
+			fmt.Printf("FAIL\t%s\n", name)
+			status = 1
+			continue
+		}
+		for _, r := range res {
+			if r.Err == nil {
+				if *verbose {
+					fmt.Printf("--- PASS: %s (%s:%d)\n", r.Name, name, r.Pos.Line)
+				}
+				continue
+			}
+			fmt.Printf("--- FAIL: %s (%s:%d)\n", r.Name, name, r.Pos.Line)
+			for _, s := range r.Err.(token.ErrorList) {
+				fmt.Println("    " + strings.Replace(s, "\n", "\n    ", -1))
+			}
+		}
+		tests += len(res)
+		d := time.Since(start).Seconds()
+		switch {
+		case failed > 0:
+			fmt.Printf("FAIL\t%s\t%.3fs (%d of %d failed)\n", name, d, failed,
+				len(res))
+			status = 1
+		case len(res) > 0:
+			fmt.Printf("ok  \t%s\t%.3fs (%d passed)\n", name, d, len(res))
+		}
+	}
+	if tests == 0 && status == 0 {
+		fmt.Println("No tests to run")
+	}
+	return status
+}
+
+// document prints the documentation of the functions defined in the named
+// files in the given format. It returns the exit status.
+func document(names []string, form string) int {
+	var funcs []*doc.Func
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		src := string(stripCR(data))
+		f := token.NewFile(name, src, 1)
+		n := parser.ParseFile(f, src)
+		if f.NumErrors() > 0 {
+			f.PrintErrors()
+			return 1
+		}
+		funcs = append(funcs, doc.File(f, n)...)
+	}
+	switch form {
+	case "text":
+		doc.Text(os.Stdout, funcs)
+	case "markdown", "md":
+		doc.Markdown(os.Stdout, funcs)
+	case "html":
+		title := "Calc documentation"
+		if len(names) == 1 {
+			title = filepath.Base(names[0])
+		}
+		doc.HTML(os.Stdout, title, funcs)
+	default:
+		fmt.Println("unknown documentation format:", form)
+		return 2
+	}
+	return 0
+}
+
+// printAST prints the syntax trees of the named files in the given format,
+// resolving their names if they parse cleanly. It returns the exit status.
+func printAST(names []string, form string) int {
+	print := ast.Fprint
+	switch form {
+	case "text":
+	case "json":
+		print = ast.FprintJSON
+	default:
+		fmt.Println("unknown syntax tree format:", form)
+		return 2
+	}
+	status := 0
+	fset := token.NewFileSet()
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		src := string(stripCR(data))
+		f := fset.AddFile(name, src)
+		n := parser.ParseFile(f, src)
+		if f.NumErrors() == 0 {
+			resolve.File(f, n)
+		}
+		if f.NumErrors() > 0 {
+			f.PrintErrors()
+			status = 1
+		}
+		print(os.Stdout, fset, n)
+	}
+	return status
+}
+
+// historyFile is the file in which the REPL keeps its history
+const historyFile = ".gocalc_history"
+
+// repl reads expressions from standard input and evaluates them in a single
+// session, each as soon as its parens balance.
+func repl(opt eval.Options) {
+	fmt.Println("Welcome to Calc REPL", version)
+	fmt.Println()
+	fmt.Println("Type in expression(s) to evaluate on one or more lines.")
+	fmt.Println("Expressions are evaluated as soon as their parens balance.")
+	fmt.Println("Press Ctrl-C to cancel an evaluation or the current input.")
+	fmt.Println("Type 'q' (without quotes) or press Ctrl-D to exit.")
+	fmt.Println("Type :help for a list of commands.")
+
+	s := eval.NewSession(opt)
+	rl := readline.New(os.Stdin, os.Stdout)
+	rl.Complete = func(line string, pos int) (int, []string) {
+		return complete(s, line, pos)
+	}
+	hist := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		hist = filepath.Join(home, historyFile)
+		if f, err := os.Open(hist); err == nil {
+			rl.ReadHistory(f)
+			f.Close()
+		}
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	for n := 1; ; n++ {
+		expr, err := readEntry(rl)
+		if err == readline.ErrInterrupt {
+			continue
+		}
+		if err != nil || strings.TrimSpace(expr) == "q" {
+			break
+		}
+		if line := strings.TrimSpace(expr); strings.HasPrefix(line, ":") {
+			command(s, line[1:], interrupt)
+			continue
+		}
+		res, err := evalEntry(s, fmt.Sprintf("<input %d>", n), expr,
+			interrupt)
+		if err != nil {
+			eval.PrintError(err)
+		} else if res != nil {
+			fmt.Println(res)
+		}
+	}
+	if hist != "" {
+		if f, err := os.Create(hist); err == nil {
+			rl.WriteHistory(f)
+			f.Close()
+		}
+	}
+}
+
+// commands lists the REPL commands with a line of help for each
+var commands = [][2]string{
+	{":ast expr", "print the syntax tree of expr"},
+	{":c expr", "print expr, and the definitions it uses, translated to C"},
+	{":env", "list the functions and variables defined"},
+	{":help", "print this list"},
+	{":load file", "evaluate the expressions in file"},
+	{":reset", "discard every definition"},
+	{":save file", "write the definitions to file as source"},
+	{":time expr", "evaluate expr and report how long it took"},
+	{":type expr", "print the type of expr without evaluating it"},
+}
+
+// command runs the REPL command line, which follows a colon.
+func command(s *eval.Session, line string, interrupt chan os.Signal) {
+	name, arg := line, ""
+	if i := strings.IndexAny(line, " \t\n"); i >= 0 {
+		name, arg = line[:i], strings.TrimSpace(line[i:])
+	}
+	needArg := map[string]string{"ast": "expr", "c": "expr",
+		"load": "file", "save": "file", "time": "expr", "type": "expr"}
+	if what, ok := needArg[name]; ok && arg == "" {
+		fmt.Printf("Usage: :%s %s\n", name, what)
+		return
+	}
+	switch name {
+	case "ast":
+		n, err := s.Parse("<ast>", arg)
+		if err != nil {
+			eval.PrintError(err)
+			return
+		}
+		ast.Fprint(os.Stdout, s.FileSet(), n)
+	case "c":
+		trans.TransFile(os.Stdout, "<c>", s.Source()+arg)
+	case "env":
+		for _, b := range s.Bindings() {
+			fmt.Println(b)
+		}
+	case "help":
+		for _, c := range commands {
+			fmt.Printf("  %-12s %s\n", c[0], c[1])
+		}
+	case "load":
+		data, err := ioutil.ReadFile(arg)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		_, err = evalEntry(s, arg, string(stripCR(data)), interrupt)
+		if err != nil {
+			eval.PrintError(err)
+		}
+	case "reset":
+		s.Reset()
+	case "save":
+		src := []byte(s.Source())
+		if out, err := format.Source(arg, src); err == nil {
+			src = out
+		}
+		if err := ioutil.WriteFile(arg, src, 0644); err != nil {
+			fmt.Println(err)
+		}
+	case "time":
+		start := time.Now()
+		res, err := evalEntry(s, "<time>", arg, interrupt)
+		elapsed := time.Since(start)
+		if err != nil {
+			eval.PrintError(err)
+		} else if res != nil {
+			fmt.Println(res)
+		}
+		fmt.Println("Time:", elapsed)
+	case "type":
+		t, err := s.TypeOf("<type>", arg)
+		if err != nil {
+			eval.PrintError(err)
+			return
+		}
+		fmt.Println(t)
+	default:
+		fmt.Printf("Unknown command :%s, type :help for a list\n", name)
+	}
+}
+
+// readEntry reads lines until the parens of the input balance.
+func readEntry(rl *readline.Reader) (string, error) {
+	var lines []string
+	prompt := ">>> "
+	for {
+		line, err := rl.ReadLine(prompt)
+		if err != nil {
+			if err == io.EOF && len(lines) > 0 {
+				err = errors.New("unexpected end of input")
+			}
+			return "", err
+		}
+		rl.AddHistory(line)
+		lines = append(lines, line)
+		expr := strings.Join(lines, "\n")
+		if strings.TrimSpace(expr) == "" {
+			lines = nil
+			continue
+		}
+		if depth(expr) <= 0 {
+			return expr, nil
+		}
+		prompt = "... "
+	}
+}
+
+// depth returns the number of parens left open in src, ignoring those in
+// strings and comments. A string left open counts as one more, so that the
+// entry is continued on the next line.
+func depth(src string) int {
+	n := 0
+	for i := 0; i < len(src); i++ {
+		switch src[i] {
+		case '(':
+			n++
+		case ')':
+			n--
+		case '"':
+			for i++; i < len(src) && src[i] != '"'; i++ {
+			}
+			if i >= len(src) {
+				return n + 1
+			}
+		case ';':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		}
+	}
+	return n
+}
+
+// evalEntry evaluates expr in the session, cancelling the evaluation if an
+// interrupt is received before it finishes.
+func evalEntry(s *eval.Session, name, expr string,
+	interrupt chan os.Signal) (interface{}, error) {
+	select {
+	case <-interrupt: // left over from before the evaluation
+	default:
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-done:
+		}
+	}()
+	return s.Eval(ctx, name, expr)
+}
+
+// complete returns the names defined in the session and the keywords which
+// complete the word ending at pos, or the commands completing a command.
+func complete(s *eval.Session, line string, pos int) (int, []string) {
+	if strings.HasPrefix(line, ":") && !strings.Contains(line[:pos], " ") {
+		var list []string
+		for _, c := range commands {
+			name := strings.Fields(c[0])[0]
+			if strings.HasPrefix(name, line[:pos]) {
+				list = append(list, name)
+			}
+		}
+		return 0, list
+	}
+	start := strings.LastIndexAny(line[:pos], " \t()\"") + 1
+	word := line[start:pos]
+	var list []string
+	for _, name := range append(s.Names(), token.Keywords()...) {
+		if strings.HasPrefix(name, word) {
+			list = append(list, name)
+		}
+	}
+	sort.Strings(list)
+	return start, list
+}
 
 func main() {
   t := flag.Bool("t", false, "Transpile")
+	sandbox := flag.Bool("sandbox", false,
+		"Reject builtins whose capabilities are not granted by -allow")
+	allow := flag.String("allow", "",
+		"Comma separated capabilities granted in sandbox mode "+
+			"(env, fs, io, random, time)")
+	useVM := flag.Bool("vm", false, "Execute files with the bytecode VM")
+	fmtMode := flag.Bool("fmt", false, "Format files in the canonical layout")
+	write := flag.Bool("w", false,
+		"With -fmt, rewrite files in place instead of printing them")
+	docMode := flag.Bool("doc", false,
+		"Print documentation for the functions defined in files")
+	docFormat := flag.String("docfmt", "text",
+		"With -doc, the output format: text, markdown or html")
+	astMode := flag.Bool("ast", false, "Print the syntax trees of files")
+	astFormat := flag.String("astfmt", "text",
+		"With -ast, the output format: text or json")
+	profMode := flag.Bool("profile", false,
+		"Print where the evaluation of a file spends its time")
+	pprofOut := flag.String("pprof", "",
+		"Profile the evaluation of a file, writing the profile to this file "+
+			"in pprof format")
+	coverMode := flag.Bool("cover", false,
+		"Print which expressions of a file are evaluated")
+	coverOut := flag.String("coverprofile", "",
+		"Record the coverage of a file, writing the profile to this file")
+	coverHTML := flag.String("coverhtml", "",
+		"Record the coverage of a file, writing its source annotated with "+
+			"the coverage to this file as HTML")
+	var trace traceFlag
+	flag.Var(&trace, "trace", "Log calls of user functions to standard "+
+		"error, or only of those listed (-trace=fact1,fib)")
 	flag.Parse()
+	if flag.Arg(0) == "lsp" {
+		if err := lsp.Serve(os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.Arg(0) == "dap" {
+		if err := dap.Serve(os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *docMode {
+		os.Exit(document(flag.Args(), *docFormat))
+	}
+	if *astMode {
+		os.Exit(printAST(flag.Args(), *astFormat))
+	}
+	if *fmtMode {
+		os.Exit(formatFiles(flag.Args(), *write))
+	}
+	if *useVM {
+		// the VM supports none of the hooks these rely on
+		for _, f := range []struct {
+			name string
+			set  bool
+		}{
+			{"trace", trace.on},
+			{"profile", *profMode},
+			{"pprof", *pprofOut != ""},
+			{"cover", *coverMode},
+			{"coverprofile", *coverOut != ""},
+			{"coverhtml", *coverHTML != ""},
+		} {
+			if f.set {
+				fmt.Println("-vm may not be combined with -" + f.name)
+				os.Exit(2)
+			}
+		}
+	}
+	opt := eval.Options{MaxDepth: eval.DefaultMaxDepth, Sandbox: *sandbox}
+	if *allow != "" {
+		opt.Allow = strings.Split(*allow, ",")
+	}
+	if trace.on {
+		t := &eval.Tracer{W: os.Stderr, Funcs: trace.funcs}
+		opt.Enter, opt.Exit = t.Enter, t.Exit
+	}
+	var prof *profile.Profiler
+	if *profMode || *pprofOut != "" {
+		prof = profile.New()
+		prof.Attach(&opt)
+	}
+	if flag.Arg(0) == "test" || flag.Arg(0) == "debug" {
+		var status int
+		if flag.Arg(0) == "test" {
+			status = testFiles(flag.Args()[1:], opt)
+		} else {
+			status = debugFile(flag.Arg(1), opt)
+		}
+		if prof != nil {
+			writeProfile(prof, *profMode, *pprofOut)
+		}
+		os.Exit(status)
+	}
 	if flag.NArg() >= 1 {
 
     if (*t == true) {
       fmt.Println("transpiling")
-      out, err := os.Create("out.c")
-      if err != nil {
-        fmt.Println("create:", err)
-        os.Exit(1)
-      }
 			data, err := ioutil.ReadFile(flag.Arg(0))
 			if err != nil {
 				fmt.Println(err)
+				os.Exit(1)
 			}
-      transpileCode(out, string(data))//flag.Arg(0))
-      return
+			os.Exit(transpileFile(flag.Arg(0), string(stripCR(data)), opt))
     }
 
 
@@ -78,7 +798,19 @@ func main() {
 			if err != nil {
 				fmt.Println(err)
 			} else {
-				eval.EvalFile(flag.Arg(0), string(stripCR(data)))
+				if *useVM {
+					vmFile(flag.Arg(0), string(stripCR(data)), opt)
+				} else {
+					if *coverMode || *coverOut != "" || *coverHTML != "" {
+						coverFile(flag.Arg(0), string(stripCR(data)), opt,
+							*coverMode, *coverOut, *coverHTML)
+					} else {
+						evalFile(flag.Arg(0), string(stripCR(data)), opt)
+					}
+					if prof != nil {
+						writeProfile(prof, *profMode, *pprofOut)
+					}
+				}
 			}
 		} else {
 			fset := token.NewFileSet()
@@ -98,35 +830,9 @@ func main() {
 			eval.EvalPackage(flag.Arg(0), fset)
 		}
 	} else {
-		fmt.Println("Welcome to Calc REPL", version)
-		fmt.Println()
-		fmt.Println("Type in expression(s) to evaluate on one or more lines.")
-		fmt.Println("Press enter on an empty line to execute the expression(s).")
-		fmt.Println("Type 'q' (without quotes) on an empty line to exit.")
-
-		in := bufio.NewReader(os.Stdin)
-		for {
-			fmt.Print(">>>")
-			var expr string
-			stop := false
-			for !stop {
-				b, _ := in.ReadBytes('\n')
-				b = stripCR(b)
-				if len(b) <= 2 {
-					switch b[0] {
-					case 'q':
-						fmt.Println("QUIT!")
-						os.Exit(0)
-					case '\n':
-						stop = true
-					}
-				}
-				expr += string(b)
-			}
-			res := eval.EvalExpr(expr)
-			if res != nil {
-				fmt.Println(res)
-			}
+		repl(opt)
+		if prof != nil {
+			writeProfile(prof, *profMode, *pprofOut)
 		}
 	}
 }
@@ -0,0 +1,239 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+// Package resolve binds every name in a parsed file to an ast.Object so that
+// later passes may access variables by slot rather than looking them up by
+// name at run time.
+//
+// Names are resolved lexically, in source order. A set expression declares
+// a variable in the innermost scope unless that scope already declares one of
+// the same name, in which case the existing slot is reused.
+package resolve
+
+import (
+	"github.com/rthornton128/gocalc/ast"
+	"github.com/rthornton128/gocalc/token"
+	"sort"
+)
+
+// File resolves every identifier, set, define and user expression in n and
+// records the number of slots each scope requires. Unresolved names are
+// reported as errors in f.
+func File(f *token.File, n *ast.File) {
+	NewEnv().File(f, n)
+}
+
+// Env is a file scope shared by a sequence of files, such as the entries
+// typed at the REPL. Each file resolved in an Env sees the names declared by
+// those before it, and its global variables take the slots following theirs.
+type Env struct {
+	names map[string]*ast.Object
+	slots int
+}
+
+// NewEnv returns an empty Env.
+func NewEnv() *Env {
+	return &Env{names: make(map[string]*ast.Object)}
+}
+
+// Copy returns a copy of env, so a file may be resolved without changing
+// env should it prove to have errors.
+func (env *Env) Copy() *Env {
+	c := &Env{names: make(map[string]*ast.Object, len(env.names)),
+		slots: env.slots}
+	for k, v := range env.names {
+		c.names[k] = v
+	}
+	return c
+}
+
+// Lookup returns the object declared in env with the given name, or nil.
+func (env *Env) Lookup(name string) *ast.Object {
+	return env.names[name]
+}
+
+// Names returns the names declared in env, in sorted order.
+func (env *Env) Names() []string {
+	names := make([]string, 0, len(env.names))
+	for k := range env.names {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// File resolves n like the package function File, in the scope of env.
+// n.NumSlots is set to the number of slots env requires afterwards.
+func (env *Env) File(f *token.File, n *ast.File) {
+	r := &resolver{file: f}
+	r.scope = &scope{names: env.names, slots: env.slots}
+	for _, node := range n.Nodes {
+		r.resolve(node)
+	}
+	env.slots = r.scope.slots
+	n.NumSlots = env.slots
+	for _, u := range r.unresolved {
+		if u.later {
+			f.AddError(u.pos, "Identifier used before definition: ", u.name)
+		} else {
+			f.AddError(u.pos, "Undeclared identifier: ", u.name)
+		}
+	}
+}
+
+type scope struct {
+	parent *scope
+	depth  int
+	slots  int
+	names  map[string]*ast.Object
+}
+
+type use struct {
+	name  string
+	pos   token.Pos
+	scope *scope
+	later bool // declared later in an enclosing scope
+}
+
+type resolver struct {
+	file       *token.File
+	scope      *scope
+	unresolved []*use
+}
+
+/* Scope */
+func (r *resolver) openScope() {
+	s := &scope{parent: r.scope, names: make(map[string]*ast.Object)}
+	if r.scope != nil {
+		s.depth = r.scope.depth + 1
+	}
+	r.scope = s
+}
+
+func (r *resolver) closeScope() {
+	r.scope = r.scope.parent
+}
+
+func (r *resolver) declare(obj *ast.Object) {
+	obj.Depth = r.scope.depth
+	r.scope.names[obj.Name] = obj
+	for _, u := range r.unresolved {
+		if u.name != obj.Name || u.later {
+			continue
+		}
+		for s := u.scope; s != nil; s = s.parent {
+			if s == r.scope {
+				u.later = true
+				break
+			}
+		}
+	}
+}
+
+func (r *resolver) lookup(name string, p token.Pos) *ast.Object {
+	for s := r.scope; s != nil; s = s.parent {
+		if obj, ok := s.names[name]; ok {
+			return obj
+		}
+	}
+	r.unresolved = append(r.unresolved, &use{name: name, pos: p,
+		scope: r.scope})
+	return nil
+}
+
+/* Resolution */
+func (r *resolver) resolve(n ast.Node) {
+	switch node := n.(type) {
+	case *ast.AssertEqualExpr:
+		r.resolveList(node.Nodes)
+	case *ast.AssertExpr:
+		r.resolveList(node.Nodes)
+	case *ast.CaseExpr:
+		r.resolveList(node.Nodes)
+	case *ast.CompExpr:
+		r.resolveList(node.Nodes)
+	case *ast.ConcatExpr:
+		r.resolveList(node.Nodes)
+	case *ast.ConvExpr:
+		r.resolveList(node.Nodes)
+	case *ast.DefineExpr:
+		r.resolveDefineExpr(node)
+	case *ast.Identifier:
+		node.Obj = r.lookup(node.Lit, node.Pos())
+	case *ast.IfExpr:
+		r.resolveList(node.Nodes)
+	case *ast.MathExpr:
+		r.resolveList(node.Nodes)
+	case *ast.PredExpr:
+		r.resolveList(node.Nodes)
+	case *ast.PrintExpr:
+		r.resolveList(node.Nodes)
+	case *ast.SetExpr:
+		r.resolveSetExpr(node)
+	case *ast.SwitchExpr:
+		if node.Pred != nil {
+			r.resolve(node.Pred)
+		}
+		r.resolveList(node.Nodes)
+	case *ast.TestExpr:
+		r.resolveTestExpr(node)
+	case *ast.UserExpr:
+		r.resolveUserExpr(node)
+	}
+}
+
+func (r *resolver) resolveList(list []ast.Node) {
+	for _, n := range list {
+		if n != nil {
+			r.resolve(n)
+		}
+	}
+}
+
+func (r *resolver) resolveDefineExpr(d *ast.DefineExpr) {
+	d.Obj = &ast.Object{Kind: ast.Fun, Name: d.Name, Decl: d}
+	r.declare(d.Obj) // declared before the body to allow recursion
+	r.openScope()
+	for _, a := range d.Args {
+		r.declare(&ast.Object{Kind: ast.Arg, Name: a, Decl: d,
+			Index: r.scope.slots})
+		r.scope.slots++
+	}
+	r.resolveList(d.Nodes)
+	d.NumSlots = r.scope.slots
+	r.closeScope()
+}
+
+func (r *resolver) resolveSetExpr(s *ast.SetExpr) {
+	// the value is resolved first so (set a (+ a 1)) refers to the old a
+	r.resolve(s.Value)
+	if obj, ok := r.scope.names[s.Name]; ok && obj.Kind != ast.Fun {
+		s.Obj = obj
+		return
+	}
+	s.Obj = &ast.Object{Kind: ast.Var, Name: s.Name, Decl: s,
+		Index: r.scope.slots}
+	r.scope.slots++
+	r.declare(s.Obj)
+}
+
+// resolveTestExpr resolves the body of a test in a scope of its own, as if it
+// were a function without arguments. The name of a test is not declared.
+func (r *resolver) resolveTestExpr(t *ast.TestExpr) {
+	r.openScope()
+	r.resolveList(t.Nodes)
+	t.NumSlots = r.scope.slots
+	r.closeScope()
+}
+
+func (r *resolver) resolveUserExpr(u *ast.UserExpr) {
+	u.Obj = r.lookup(u.Name, u.Pos())
+	if u.Obj != nil && u.Obj.Kind != ast.Fun {
+		r.file.AddError(u.Pos(), "Undeclared function: ", u.Name)
+	}
+	r.resolveList(u.Nodes)
+}
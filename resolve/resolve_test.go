@@ -0,0 +1,84 @@
+package resolve_test
+
+import (
+	"github.com/rthornton128/gocalc/ast"
+	"github.com/rthornton128/gocalc/parser"
+	"github.com/rthornton128/gocalc/resolve"
+	"github.com/rthornton128/gocalc/token"
+	"testing"
+)
+
+func TestResolveSlots(t *testing.T) {
+	expr := "(set a 1) (define (f x) (set y (+ a x)) " +
+		"(define (g) (+ x y)) (g)) (set a 2) (f a)"
+	f := token.NewFile("", expr, 1)
+	n := parser.ParseFile(f, expr)
+	resolve.File(f, n)
+	if f.NumErrors() > 0 {
+		t.Fatal(f.Err())
+	}
+	if n.NumSlots != 1 {
+		t.Fatal("Expected 1 global slot, got:", n.NumSlots)
+	}
+	d := n.Nodes[1].(*ast.DefineExpr)
+	if d.NumSlots != 2 || d.Obj.Depth != 0 {
+		t.Fatal("Expected f to have 2 slots at depth 0, got:", d.NumSlots,
+			d.Obj.Depth)
+	}
+	g := d.Nodes[1].(*ast.DefineExpr)
+	sum := g.Nodes[0].(*ast.MathExpr)
+	var tests = []struct {
+		ident *ast.Identifier
+		kind  ast.ObjKind
+		depth int
+		index int
+	}{
+		{d.Nodes[0].(*ast.SetExpr).Value.(*ast.MathExpr).Nodes[0].(*ast.Identifier),
+			ast.Var, 0, 0},
+		{sum.Nodes[0].(*ast.Identifier), ast.Arg, 1, 0},
+		{sum.Nodes[1].(*ast.Identifier), ast.Var, 1, 1},
+		{n.Nodes[3].(*ast.UserExpr).Nodes[0].(*ast.Identifier), ast.Var, 0, 0},
+	}
+	for i, test := range tests {
+		obj := test.ident.Obj
+		if obj == nil || obj.Kind != test.kind || obj.Depth != test.depth ||
+			obj.Index != test.index {
+			t.Log(i, "- Expected:", test.kind, test.depth, test.index)
+			t.Fatal(i, "- Got:", obj)
+		}
+	}
+	if n.Nodes[2].(*ast.SetExpr).Obj != n.Nodes[0].(*ast.SetExpr).Obj {
+		t.Fatal("Expected second set of a to reuse the first binding")
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	// The parser rejects these, so the trees are built by hand
+	expr := "(print y) (print z) (set y 1)"
+	f := token.NewFile("", expr, 1)
+	n := ast.NewFile(1, token.Pos(len(expr)+1))
+	y := &ast.Identifier{Id: 8, Lit: "y"}
+	z := &ast.Identifier{Id: 18, Lit: "z"}
+	n.Nodes = append(n.Nodes,
+		&ast.PrintExpr{Expression: ast.Expression{LParen: 1, RParen: 9,
+			Nodes: []ast.Node{y}}},
+		&ast.PrintExpr{Expression: ast.Expression{LParen: 11, RParen: 19,
+			Nodes: []ast.Node{z}}},
+		&ast.SetExpr{Expression: ast.Expression{LParen: 21, RParen: 29},
+			Name: "y", Value: &ast.Number{Num: 28, Lit: "1", Val: 1}})
+	resolve.File(f, n)
+	want := token.ErrorList{
+		"Line: 1 Column: 8 - Identifier used before definition: y",
+		"Line: 1 Column: 18 - Undeclared identifier: z",
+	}
+	got, _ := f.Err().(token.ErrorList)
+	if len(got) != len(want) {
+		t.Fatal("Expected:", want, "Got:", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Log(i, "- Expected:", want[i])
+			t.Fatal(i, "- Got:", got[i])
+		}
+	}
+}
@@ -69,6 +69,8 @@ func (s *Scanner) Scan() (tok token.Token, pos token.Pos, lit string) {
 		return
 	case '=':
 		tok = token.EQ
+	case ':':
+		tok = token.COLON
 	case '<':
 		switch s.ch {
 		case '=':
@@ -151,7 +153,8 @@ func (s *Scanner) scanComment() (token.Pos, string) {
 
 func (s *Scanner) scanIdentifier() (token.Pos, string) {
 	start := s.off
-	for unicode.IsDigit(s.ch) || isAlpha(s.ch) || s.ch == '_' || s.ch == '-' {
+	for unicode.IsDigit(s.ch) || isAlpha(s.ch) || s.ch == '_' || s.ch == '-' ||
+		s.ch == '?' {
 		s.next()
 	}
 	return token.Pos(start), s.str[start:s.off]
@@ -168,6 +171,11 @@ func (s *Scanner) scanNumber() (token.Pos, string) {
 func (s *Scanner) scanString() string {
 	start := s.off - 1
 	for s.ch != '"' {
+		if s.off >= len(s.str) {
+			s.file.AddError(s.file.Base()+token.Pos(start),
+				"Unterminated string")
+			return s.str[start:]
+		}
 		s.next()
 	}
 	s.next()
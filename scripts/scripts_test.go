@@ -0,0 +1,135 @@
+package scripts_test
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"github.com/rthornton128/gocalc/ast"
+	"github.com/rthornton128/gocalc/eval"
+	"github.com/rthornton128/gocalc/parser"
+	"github.com/rthornton128/gocalc/token"
+	"github.com/rthornton128/gocalc/trans"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// cflags are those used by the Makefile
+var cflags = []string{"-Wall", "-Wextra", "-Werror", "-fmax-errors=10",
+	"-std=c99"}
+
+// parse returns the tree of src, reporting whether it declares the function
+// main, from which a translated program starts
+func parse(t *testing.T, name, src string) (*token.File, *ast.File, bool) {
+	f := token.NewFile(name, src, 1)
+	n := parser.ParseFile(f, src)
+	if f.NumErrors() > 0 {
+		t.Fatal(name, "- Unexpected errors:", f.Err())
+	}
+	return f, n, n.Scope.Lookup("main") != nil
+}
+
+// interpret returns the output of src run by the interpreter. As with the
+// translated program, main is called once the file has been evaluated.
+func interpret(t *testing.T, name, src string, main bool) []byte {
+	var buf bytes.Buffer
+	s := eval.NewSession(eval.Options{Stdout: &buf})
+	if _, err := s.Eval(context.Background(), name, src); err != nil {
+		t.Fatal(name, "- Unexpected errors:", err)
+	}
+	if main {
+		if _, err := s.Eval(context.Background(), "main", "(main)"); err != nil {
+			t.Fatal(name, "- Unexpected errors:", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// compile returns the output of n translated to C, built with gcc in dir
+// and run
+func compile(t *testing.T, dir string, f *token.File, n *ast.File) []byte {
+	var c bytes.Buffer
+	trans.TransTree(&c, f, n)
+	if f.NumErrors() > 0 {
+		t.Fatal(f.Name(), "- Unable to translate:", f.Err())
+	}
+	base := strings.TrimSuffix(filepath.Base(f.Name()), ".calc")
+	csrc := filepath.Join(dir, base+".c")
+	if err := ioutil.WriteFile(csrc, c.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(dir, base)
+	args := append(cflags, "-o", bin, csrc)
+	if out, err := exec.Command("gcc", args...).CombinedOutput(); err != nil {
+		t.Fatal(f.Name(), "- gcc failed:", err, "\n", string(out), "\n",
+			c.String())
+	}
+	out, err := exec.Command(bin).Output()
+	if err != nil {
+		t.Fatal(f.Name(), "- Translated program failed:", err)
+	}
+	return out
+}
+
+// TestScripts runs each script through the interpreter, and through the
+// translator and gcc, comparing the output of each with the matching
+// .golden file. With -update, the golden files are written instead, once
+// the outputs are found to be the same.
+func TestScripts(t *testing.T) {
+	names, err := filepath.Glob("*.calc")
+	if err != nil || len(names) == 0 {
+		t.Fatal("No scripts found:", err)
+	}
+	_, gccErr := exec.LookPath("gcc")
+	if *update && gccErr != nil {
+		t.Fatal("Golden files are only updated with gcc:", gccErr)
+	}
+	dir, err := ioutil.TempDir("", "scripts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			data, err := ioutil.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			src := string(data)
+			f, n, main := parse(t, name, src)
+			got := interpret(t, name, src, main)
+			golden := strings.TrimSuffix(name, ".calc") + ".golden"
+			if *update {
+				if gotC := compile(t, dir, f, n); !bytes.Equal(got, gotC) {
+					t.Log("Interpreter got:", string(got))
+					t.Fatal("Translation got:", string(gotC))
+				}
+				if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Log("Expected:", string(want))
+				t.Fatal("Interpreter got:", string(got))
+			}
+			if gccErr != nil {
+				t.Skip("Not translated without gcc:", gccErr)
+			}
+			if gotC := compile(t, dir, f, n); !bytes.Equal(gotC, want) {
+				t.Log("Expected:", string(want))
+				t.Fatal("Translation got:", string(gotC))
+			}
+		})
+	}
+}
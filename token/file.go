@@ -7,11 +7,103 @@
 
 package token
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 type Error struct {
-	pos Pos
-	msg string
+	pos   Pos
+	msg   string
+	trace []Frame
+}
+
+// Frame is an entry in the traceback of a runtime error: where the error
+// occurred, or a call was made, within a call of the function Name or, if
+// Name is empty, the file itself.
+type Frame struct {
+	Pos  Position
+	Text string   // of the line at Pos
+	Name string   // of the function called
+	Args []string // values of the arguments of the call, as written
+}
+
+func (fr Frame) String() string {
+	loc := fmt.Sprintf("line %d, column %d", fr.Pos.Line, fr.Pos.Column)
+	if fr.Pos.Filename != "" {
+		loc = fmt.Sprintf("File %q, %s", fr.Pos.Filename, loc)
+	} else {
+		loc = strings.ToUpper(loc[:1]) + loc[1:]
+	}
+	in := "<file>"
+	if fr.Name != "" {
+		in = "(" + strings.Join(append([]string{fr.Name}, fr.Args...), " ") +
+			")"
+	}
+	return fmt.Sprintf("  %s, in %s\n    %s\n", loc, in,
+		strings.TrimSpace(fr.Text))
+}
+
+// repeats is the number of frames at the same place, as happens in a
+// recursive function, shown before the rest are summarised
+const repeats = 3
+
+// Pos returns the position at which the error occurred.
+func (e Error) Pos() Pos {
+	return e.pos
+}
+
+// Msg returns the error message, without its position.
+func (e Error) Msg() string {
+	return e.msg
+}
+
+// Trace returns the traceback of a runtime error, outermost first, or nil
+// if the error did not occur in a function call.
+func (e Error) Trace() []Frame {
+	return e.trace
+}
+
+// traceback formats the frames as Python does, most recent call last
+func traceback(list []Frame) string {
+	s := "Traceback (most recent call last):\n"
+	n := 0 // frames at the same place as the one before
+	for i, fr := range list {
+		if i > 0 && fr.Pos == list[i-1].Pos && fr.Name == list[i-1].Name {
+			n++
+		} else {
+			s += repeated(n)
+			n = 0
+		}
+		if n < repeats {
+			s += fr.String()
+		}
+	}
+	return s + repeated(n)
+}
+
+func repeated(n int) string {
+	if n < repeats {
+		return ""
+	}
+	if n -= repeats - 1; n == 1 {
+		return "  [Previous frame repeated 1 more time]\n"
+	}
+	return fmt.Sprintf("  [Previous frame repeated %d more times]\n", n)
+}
+
+// ErrorList is returned by File.Err. Each entry is formatted the same way
+// PrintError would print it.
+type ErrorList []string
+
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0]
+	}
+	return fmt.Sprintf("%s (and %d more errors)", l[0], len(l)-1)
 }
 
 type File struct {
@@ -20,6 +112,7 @@ type File struct {
 	lines []int   // Location of each line ending ('\n')
 	name  string  // Filename
 	size  int     // Length of file
+	src   string
 }
 
 // In the future, will take a FileSet as an argument
@@ -28,6 +121,7 @@ func NewFile(name, str string, base Pos) *File {
 	f.base = base
 	f.name = name
 	f.size = len(str)
+	f.src = str
 	return f
 }
 
@@ -35,40 +129,138 @@ func (f *File) AddLine(off int) {
 	f.lines = append(f.lines, off)
 }
 
+// AddError records an error at p, which may be the end of the file.
 func (f *File) AddError(p Pos, args ...interface{}) {
-	if f.ValidPos(p) {
-		f.errs = append(f.errs, Error{p, fmt.Sprint(args...)})
+	if f.ValidPos(p) || p == f.base+Pos(f.size) {
+		f.errs = append(f.errs, Error{pos: p, msg: fmt.Sprint(args...)})
 	} else {
 		panic("Invalid Position!") // this a little extreme?
 	}
 }
 
+// AddErrorTrace records a runtime error at p, which occurred in the calls
+// listed by trace.
+func (f *File) AddErrorTrace(p Pos, trace []Frame, args ...interface{}) {
+	f.AddError(p, args...)
+	f.errs[len(f.errs)-1].trace = trace
+}
+
 func (f *File) Base() Pos {
 	return f.base
 }
 
+// Name returns the file name given to NewFile.
+func (f *File) Name() string {
+	return f.name
+}
+
+// Errors returns the errors recorded in the file, in the order they were
+// added.
+func (f *File) Errors() []Error {
+	return f.errs
+}
+
 func (f *File) NumErrors() int {
 	return len(f.errs)
 }
 
-func (f *File) PrintError(e Error) {
-	var i, line, column int
-	for i = 0; i < len(f.lines); i++ {
-		if int(e.pos) < f.lines[i]+1 {
-			break
+// Err returns the errors recorded in the file as an ErrorList, or nil if
+// there are none.
+func (f *File) Err() error {
+	if len(f.errs) == 0 {
+		return nil
+	}
+	l := make(ErrorList, len(f.errs))
+	for i, e := range f.errs {
+		l[i] = f.errorString(e)
+	}
+	return l
+}
+
+// Position is a location in a file, in a form suitable for printing.
+type Position struct {
+	Filename string
+	Line     int // starting at 1
+	Column   int // starting at 1, in bytes
+	Offset   int // starting at 0
+}
+
+// IsValid reports whether the position has a line number.
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+// String returns the position as file:line:column, omitting the file name
+// if there is none.
+func (p Position) String() string {
+	if !p.IsValid() {
+		return "-"
+	}
+	s := fmt.Sprintf("%d:%d", p.Line, p.Column)
+	if p.Filename != "" {
+		s = p.Filename + ":" + s
+	}
+	return s
+}
+
+// Position returns the location of p. Lines are only known once the file
+// has been scanned up to p.
+func (f *File) Position(p Pos) Position {
+	off := int(p - f.base)
+	i := 0
+	for i < len(f.lines) && off > f.lines[i] {
+		i++
+	}
+	pos := Position{Filename: f.name, Line: i + 1, Column: off + 1,
+		Offset: off}
+	if i > 0 {
+		pos.Column = off - f.lines[i-1]
+	}
+	return pos
+}
+
+// Line returns the line number of p.
+func (f *File) Line(p Pos) int {
+	return f.Position(p).Line
+}
+
+// LineText returns the text of line n, without its line ending, or "" if
+// there is no such line.
+func (f *File) LineText(n int) string {
+	s := f.src
+	for ; n > 1; n-- {
+		i := strings.IndexByte(s, '\n')
+		if i < 0 {
+			return ""
 		}
+		s = s[i+1:]
 	}
-	line = i + 1
-	if i == 0 {
-		column = int(e.pos)
-	} else {
-		column = int(e.pos) - (f.lines[i-1] + 1)
+	if n < 1 {
+		return ""
+	}
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
 	}
+	return strings.TrimSuffix(s, "\r")
+}
+
+// errorString formats e, preceded by its traceback if it has one
+func (f *File) errorString(e Error) string {
+	s := ""
+	if len(e.trace) > 0 {
+		s = traceback(e.trace)
+	}
+	pos := f.Position(e.pos)
 	if len(f.name) > 0 {
-		fmt.Println(f.name, "- Line:", line, "Column:", column, "-", e.msg)
-	} else {
-		fmt.Println("Line:", line, "Column:", column, "-", e.msg)
+		return s + fmt.Sprintf("%s - Line: %d Column: %d - %s", f.name,
+			pos.Line, pos.Column, e.msg)
 	}
+	return s + fmt.Sprintf("Line: %d Column: %d - %s", pos.Line, pos.Column,
+		e.msg)
+}
+
+func (f *File) PrintError(e Error) {
+	fmt.Println(f.errorString(e))
 }
 
 func (f *File) PrintErrors() {
@@ -101,6 +293,28 @@ func (fs *FileSet) AddFile(name, code string) *File {
 	return f
 }
 
+// File returns the file containing p, or nil if there is none. The end of
+// a file, one past its last character, belongs to it unless another file
+// starts there.
+func (fs *FileSet) File(p Pos) *File {
+	for i := len(fs.files) - 1; i >= 0; i-- {
+		f := fs.files[i]
+		if p >= f.base && p <= f.base+Pos(f.size) {
+			return f
+		}
+	}
+	return nil
+}
+
+// Position returns the location of p in the file containing it, or an
+// invalid Position if no file contains it.
+func (fs *FileSet) Position(p Pos) Position {
+	if f := fs.File(p); f != nil {
+		return f.Position(p)
+	}
+	return Position{}
+}
+
 type Pos int
 
 const NoPos Pos = 0
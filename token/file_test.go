@@ -0,0 +1,61 @@
+package token_test
+
+import (
+	"github.com/rthornton128/gocalc/scanner"
+	"github.com/rthornton128/gocalc/token"
+	"testing"
+)
+
+// scan records the lines of f, as the parser would
+func scan(f *token.File, src string) {
+	var s scanner.Scanner
+	s.Init(f, src)
+	for tok, _, _ := s.Scan(); tok != token.EOF; tok, _, _ = s.Scan() {
+	}
+}
+
+func TestPosition(t *testing.T) {
+	const a, b = "(print 1)\n(print\n 2)", "(set x 3)"
+	fs := token.NewFileSet()
+	fa := fs.AddFile("a.calc", a)
+	fb := fs.AddFile("b.calc", b)
+	scan(fa, a)
+	scan(fb, b)
+	var tests = []struct {
+		pos  token.Pos
+		want string
+		off  int
+	}{
+		{1, "a.calc:1:1", 0},
+		{9, "a.calc:1:9", 8},
+		{10, "a.calc:1:10", 9}, // the newline ends its line
+		{11, "a.calc:2:1", 10},
+		{19, "a.calc:3:2", 18},
+		{fb.Base(), "b.calc:1:1", 0},
+		{fb.Base() + 5, "b.calc:1:6", 5},
+		{fb.Base() + 9, "b.calc:1:10", 9},
+		{fb.Base() + 10, "-", 0},
+		{0, "-", 0},
+	}
+	for i, test := range tests {
+		p := fs.Position(test.pos)
+		if p.String() != test.want || p.Offset != test.off {
+			t.Log(i, "- Expected:", test.want, test.off)
+			t.Fatal(i, "- Got:", p, p.Offset)
+		}
+	}
+	if fs.File(fa.Base()+3) != fa || fs.File(fb.Base()) != fb {
+		t.Fatal("FileSet.File returned the wrong file")
+	}
+}
+
+func TestLineText(t *testing.T) {
+	const src = "(print 1)\r\n\n  (print 2)"
+	f := token.NewFile("", src, 1)
+	for i, want := range []string{"", "(print 1)", "", "  (print 2)", ""} {
+		if got := f.LineText(i); got != want {
+			t.Log(i, "- Expected:", want)
+			t.Fatal(i, "- Got:", got)
+		}
+	}
+}
@@ -7,6 +7,8 @@
 
 package token
 
+import "sort"
+
 type Token int
 
 const (
@@ -27,6 +29,7 @@ const (
 	LT
 	LTE
 	NEQ
+	COLON
 	op_end
 
 	lit_start
@@ -37,27 +40,68 @@ const (
 
 	key_start
 	AND
+	ASSERTEQUAL
+	ASSERTTYPE
+	BOOLP
 	CASE
 	DEFINE
+	DEFTEST
+	FUNCTIONP
 	IF
 	IMPORT
+	LISTP
+	NUMBERP
 	OR
 	PRINT
 	SET
+	STRINGP
 	SWITCH
 	key_end
 )
 
 var tokens = map[string]Token{
-	"and":    AND,
-	"case":   CASE,
-	"define": DEFINE,
-	"if":     IF,
-	"import": IMPORT,
-	"or":     OR,
-	"print":  PRINT,
-	"set":    SET,
-	"switch": SWITCH,
+	"and":          AND,
+	"assert-equal": ASSERTEQUAL,
+	"assert-type":  ASSERTTYPE,
+	"bool?":        BOOLP,
+	"case":         CASE,
+	"define":       DEFINE,
+	"deftest":      DEFTEST,
+	"function?":    FUNCTIONP,
+	"if":           IF,
+	"import":       IMPORT,
+	"list?":        LISTP,
+	"number?":      NUMBERP,
+	"or":           OR,
+	"print":        PRINT,
+	"set":          SET,
+	"string?":      STRINGP,
+	"switch":       SWITCH,
+}
+
+// builtins are the names of builtins which are not keywords. They name the
+// builtin only at the head of an expression and may otherwise be used freely.
+var builtins = []string{"float", "int", "str"}
+
+// Keywords returns the names of all keywords and builtins, in sorted order.
+func Keywords() []string {
+	list := append(make([]string, 0, len(tokens)+len(builtins)), builtins...)
+	for k := range tokens {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// IsBuiltin reports whether ident is the name of a builtin which is not a
+// keyword.
+func IsBuiltin(ident string) bool {
+	for _, b := range builtins {
+		if b == ident {
+			return true
+		}
+	}
+	return false
 }
 
 func Lookup(ident string) Token {
@@ -8,18 +8,42 @@
 package trans
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"strings"
 
 	"github.com/rthornton128/gocalc/ast"
 	"github.com/rthornton128/gocalc/parser"
+	"github.com/rthornton128/gocalc/resolve"
 	"github.com/rthornton128/gocalc/token"
+	"github.com/rthornton128/gocalc/types"
 )
 
 type translator struct {
-	out   io.Writer
-	file  *token.File
-	scope *ast.Scope
+	out      io.Writer
+	file     *token.File
+	info     *types.Info
+	declared map[*ast.Object]bool     // variables already declared in C
+	typing   map[*ast.DefineExpr]bool // functions whose type is being found
+	guessing map[*ast.Object]bool     // arguments whose type is being found
+	stdlib   bool                     // stdlib.h is required
+	str      bool                     // string.h is required
+	helpers  map[string]bool          // runtime helpers which are required
+
+	// calls holds the first call of each function from outside of it
+	calls map[*ast.DefineExpr]*ast.UserExpr
+}
+
+// runtime holds C helper functions, written to the output only if used
+var runtime = []struct{ name, code string }{
+	{"calc_itoa", "char *calc_itoa(int i)\n{\nchar *s = malloc(12);\n" +
+		"sprintf(s, \"%d\", i);\nreturn s;\n}\n"},
+	{"calc_ftoa", "char *calc_ftoa(double f)\n{\nchar *s = malloc(32);\n" +
+		"sprintf(s, \"%g\", f);\nreturn s;\n}\n"},
+	{"calc_concat", "char *calc_concat(char *a, char *b)\n{\n" +
+		"char *s = malloc(strlen(a) + strlen(b) + 1);\n" +
+		"strcpy(s, a);\nstrcat(s, b);\nreturn s;\n}\n"},
 }
 
 /* TransExpr is really only for initial testing and will probably be removed
@@ -31,89 +55,187 @@ func TransExpr(w io.Writer, expr string) {
 func TransFile(w io.Writer, fname, expr string) {
 	f := token.NewFile(fname, expr, 1)
 	n := parser.ParseFile(f, expr)
+	if f.NumErrors() > 0 {
+		f.PrintErrors()
+		return
+	}
+	TransTree(w, f, n)
+}
+
+// TransTree translates n, whose positions lie within f, like TransFile. The
+// tree need not have been parsed, it may have been decoded from JSON.
+func TransTree(w io.Writer, f *token.File, n *ast.File) {
+	if n.Pos() < f.Base() || n.End() > f.Base()+token.Pos(f.Size()) {
+		fmt.Println("Positions of the tree lie outside", f.Name())
+		return
+	}
+	resolve.File(f, n)
+	var info *types.Info
+	if f.NumErrors() == 0 {
+		info = types.Check(f, n)
+	}
 
 	if f.NumErrors() > 0 {
 		f.PrintErrors()
 		return
 	}
 
-	t := &translator{out: w, file: f, scope: n.Scope}
+	/* the program is translated first, as the includes and helpers required
+	 * aren't known until it has been */
+	var body bytes.Buffer
+	t := &translator{out: &body, file: f, info: info,
+		declared: make(map[*ast.Object]bool),
+		typing:   make(map[*ast.DefineExpr]bool),
+		guessing: make(map[*ast.Object]bool),
+		calls:    make(map[*ast.DefineExpr]*ast.UserExpr),
+		helpers:  make(map[string]bool)}
+	ast.Inspect(n, func(n ast.Node) bool {
+		ue, ok := n.(*ast.UserExpr)
+		if !ok || ue.Obj == nil {
+			return true
+		}
+		de, ok := ue.Obj.Decl.(*ast.DefineExpr)
+		if ok && t.calls[de] == nil &&
+			(ue.Pos() < de.Pos() || ue.Pos() > de.End()) {
+			t.calls[de] = ue
+		}
+		return true
+	})
+	t.transFuncSigs(n)
+	t.transpile(n, false)
+
+	t.out = w
 	t.topComment()
 	/* includes will/might eventually reflect the imports from Calc. It's
 	 * possible that stdio might be an auto-include if print remains a
 	 * built-in function, which is likely won't */
 	t.includes() /* temporary */
-	t.transFuncSigs(n)
-	t.transpile(n, false)
+	t.write(body.String())
 
 	if f.NumErrors() > 0 {
 		f.PrintErrors()
 	}
-
-	if t.scope.Lookup("main") == nil {
-		fmt.Println("No function \"main\" found!")
-	}
-	return
 }
 
 func (t *translator) nodeType(n ast.Node) string {
 	switch node := n.(type) {
-	case *ast.CompExpr, *ast.Number, *ast.MathExpr:
+	case nil, *ast.PrintExpr, *ast.SetExpr, *ast.SwitchExpr:
+		return "void"
+	case *ast.CompExpr, *ast.Number, *ast.MathExpr, *ast.PredExpr:
 		return "int"
 	case *ast.String, *ast.ConcatExpr:
 		return "char *"
+	case *ast.AssertExpr:
+		typ, _ := types.Lookup(node.Type)
+		return cType(typ)
+	case *ast.ConvExpr:
+		return cType(types.Conversion(node.ConvLit))
 	case *ast.DefineExpr:
+		if t.typing[node] {
+			return "int" /* recursive, assume the other branch is an int */
+		}
+		t.typing[node] = true
+		defer delete(t.typing, node)
 		return t.nodeType(node.Nodes[len(node.Nodes)-1])
 	case *ast.Identifier:
-		if x := t.scope.Lookup(node.Lit); x != nil {
-			//fmt.Println(x.(ast.Node))
-			return t.nodeType(x.(ast.Node))
-		}
-		return "void *"
+		return t.objType(node.Obj)
 	case *ast.IfExpr:
 		return t.nodeType(node.Nodes[2])
 	case *ast.UserExpr:
-		return t.nodeType(node.Nodes[len(node.Nodes)-1])
+		return t.objType(node.Obj)
 	default:
 		return "void *"
 	}
 }
 
-/* Scope */
-func (t *translator) openScope() {
-	t.scope = ast.NewScope(t.scope)
+// cType returns the C type used to hold values of type typ. Values of an
+// unknown type are assumed to be ints.
+func cType(typ types.Type) string {
+	switch typ {
+	case types.Float:
+		return "double"
+	case types.String:
+		return "char *"
+	}
+	return "int"
 }
 
-func (t *translator) closeScope() {
-	t.scope = t.scope.Parent
+// argType returns the C type of argument i of de. An argument whose type is
+// unknown takes that of the value passed by the first call from outside de,
+// or is assumed to be an int if there is none.
+func (t *translator) argType(de *ast.DefineExpr, i int) string {
+	if typ := t.info.Args[de][i]; typ != types.Unknown {
+		return cType(typ)
+	}
+	if ue := t.calls[de]; ue != nil {
+		return t.nodeType(ue.Nodes[i])
+	}
+	return "int"
+}
+
+func (t *translator) objType(obj *ast.Object) string {
+	if obj == nil {
+		return "void *"
+	}
+	switch obj.Kind {
+	case ast.Arg:
+		if t.guessing[obj] {
+			return "int" /* passed on to itself, assume an int */
+		}
+		t.guessing[obj] = true
+		defer delete(t.guessing, obj)
+		return t.argType(obj.Decl.(*ast.DefineExpr), obj.Index)
+	case ast.Fun:
+		return t.nodeType(obj.Decl)
+	case ast.Var:
+		return t.nodeType(obj.Decl.(*ast.SetExpr).Value)
+	}
+	return "void *"
 }
 
 /* Transpiler */
 func (t *translator) transpile(n ast.Node, semi bool) {
 	switch node := n.(type) {
+	case *ast.AssertExpr:
+		t.transAssertExpr(node)
 	case *ast.CompExpr:
 		t.transCompExpr(node)
+	case *ast.ConcatExpr:
+		t.transConcatExpr(node)
+	case *ast.ConvExpr:
+		t.transConvExpr(node)
 	case *ast.DefineExpr:
 		semi = false
 		t.transDefineExpr(node)
 	case *ast.File:
-		for _, n := range node.Nodes {
-			t.transpile(n, true)
-		}
+		semi = false
+		t.transFile(node)
 	case *ast.Identifier:
-		t.write(node.Lit)
+		t.write(cName(node.Lit))
 	case *ast.IfExpr:
-		t.transIfExpr(node)
+		if semi {
+			semi = false
+			t.transIfExpr(node, false)
+		} else {
+			t.transCondExpr(node)
+		}
 	case *ast.MathExpr:
 		t.transMathExpr(node)
 	case *ast.Number:
 		t.write(node.Lit)
+	case *ast.PredExpr:
+		t.transPredExpr(node)
 	case *ast.PrintExpr:
 		t.transPrintExpr(node)
 	case *ast.SetExpr:
 		t.transSetExpr(node)
 	case *ast.String:
-		t.write(node.Lit)
+		t.write(cString(node.Lit[1 : len(node.Lit)-1]))
+	case *ast.SwitchExpr:
+		semi = false
+		t.transSwitchExpr(node)
+	case *ast.TestExpr:
+		semi = false // tests are only run by the evaluator
 	case *ast.UserExpr:
 		t.transUserExpr(node)
 	}
@@ -122,6 +244,88 @@ func (t *translator) transpile(n ast.Node, semi bool) {
 	}
 }
 
+// cName returns name as a C identifier, in which '-' and '?' may not appear
+func cName(name string) string {
+	return strings.NewReplacer("-", "_", "?", "_p").Replace(name)
+}
+
+// cString returns s, the contents of a Calc string in which there are no
+// escapes, as a C string literal. A '?' following another is escaped too, as
+// the pair would begin a trigraph.
+func cString(s string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			buf.WriteString("\\" + string(c))
+		case c == '\n':
+			buf.WriteString("\\n")
+		case c == '\t':
+			buf.WriteString("\\t")
+		case c == '?' && i > 0 && s[i-1] == '?':
+			buf.WriteString("\\?")
+		case c < ' ' || c == 0x7f:
+			fmt.Fprintf(&buf, "\\%03o", c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+// transFile translates the top level of a file. Unless the file declares
+// main itself, the expressions outside of functions become the body of a
+// main function, and the variables they set become globals.
+func (t *translator) transFile(f *ast.File) {
+	var body []ast.Node
+	for _, n := range f.Nodes {
+		switch n.(type) {
+		case *ast.DefineExpr, *ast.ImportExpr, *ast.TestExpr:
+		default:
+			body = append(body, n)
+		}
+	}
+	main := f.Scope.Lookup("main") != nil
+	if main && len(body) > 0 {
+		t.file.AddError(body[0].Pos(), "Unable to translate expressions "+
+			"outside of functions when main is declared")
+		return
+	}
+	for _, n := range body {
+		ast.Inspect(n, func(n ast.Node) bool {
+			if se, ok := n.(*ast.SetExpr); ok && !t.declared[se.Obj] {
+				t.declared[se.Obj] = true
+				t.write(t.objType(se.Obj) + " " + cName(se.Name) + ";\n")
+			}
+			return true
+		})
+	}
+	for _, n := range f.Nodes {
+		if de, ok := n.(*ast.DefineExpr); ok {
+			t.transpile(de, false)
+		}
+	}
+	if main {
+		return
+	}
+	t.writeln("int main(void)")
+	t.openBlock()
+	for _, n := range body {
+		switch n.(type) {
+		case *ast.IfExpr, *ast.PrintExpr, *ast.SetExpr, *ast.SwitchExpr:
+		default:
+			if t.nodeType(n) != "void" {
+				t.write("(void)") // the value is unused
+			}
+		}
+		t.transpile(n, true)
+	}
+	t.writeln("return 0;")
+	t.closeBlock()
+}
+
 func (t *translator) write(s string) {
 	if _, err := t.out.Write([]byte(s)); err != nil {
 		panic(err)
@@ -140,6 +344,17 @@ func (t *translator) topComment() {
 
 func (t *translator) includes() {
 	t.writeln("#include <stdio.h>")
+	if t.stdlib {
+		t.writeln("#include <stdlib.h>")
+	}
+	if t.str {
+		t.writeln("#include <string.h>")
+	}
+	for _, h := range runtime {
+		if t.helpers[h.name] {
+			t.write(h.code)
+		}
+	}
 }
 
 func (t *translator) openBlock() {
@@ -155,42 +370,117 @@ func (t *translator) returnStatement(n ast.Node) {
 	t.transpile(n, true)
 }
 
+// transAssertExpr can only check an assertion statically, as the type of
+// every C value is known at compile time
+func (t *translator) transAssertExpr(ae *ast.AssertExpr) {
+	typ, _ := types.Lookup(ae.Type)
+	if t.nodeType(ae.Nodes[0]) != cType(typ) {
+		t.file.AddError(ae.Pos(), "Unable to translate assert-type: value "+
+			"is not known to be of type ", typ)
+		return
+	}
+	t.transpile(ae.Nodes[0], false)
+}
+
 func (t *translator) transCompExpr(ce *ast.CompExpr) {
 	t.transpile(ce.Nodes[0], false)
-	if ce.CompLit == "=" {
+	switch ce.CompLit {
+	case "=":
 		t.write(" == ")
-	} else {
+	case "<>":
+		t.write(" != ")
+	default:
 		t.write(" " + ce.CompLit + " ")
 	}
 	t.transpile(ce.Nodes[1], false)
 }
 
+// transConcatExpr concatenates the operands pair by pair, converting those
+// which are numbers to strings
+func (t *translator) transConcatExpr(ce *ast.ConcatExpr) {
+	t.stdlib, t.str = true, true
+	t.helpers["calc_concat"] = true
+	for i := 1; i < len(ce.Nodes); i++ {
+		t.write("calc_concat(")
+	}
+	for i, n := range ce.Nodes {
+		if i > 0 {
+			t.write(", ")
+		}
+		switch t.nodeType(n) {
+		case "int":
+			t.helpers["calc_itoa"] = true
+			t.write("calc_itoa(")
+			t.transpile(n, false)
+			t.write(")")
+		case "double":
+			t.helpers["calc_ftoa"] = true
+			t.write("calc_ftoa(")
+			t.transpile(n, false)
+			t.write(")")
+		default:
+			t.transpile(n, false)
+		}
+		if i > 0 {
+			t.write(")")
+		}
+	}
+}
+
+func (t *translator) transConvExpr(ce *ast.ConvExpr) {
+	from, to := t.nodeType(ce.Nodes[0]), cType(types.Conversion(ce.ConvLit))
+	switch {
+	case from == to:
+		t.transpile(ce.Nodes[0], false)
+		return
+	case from == "char *":
+		t.stdlib = true
+		if to == "double" {
+			t.write("atof(")
+		} else {
+			t.write("atoi(")
+		}
+	case to == "char *":
+		t.stdlib = true
+		h := "calc_itoa"
+		if from == "double" {
+			h = "calc_ftoa"
+		}
+		t.helpers[h] = true
+		t.write(h + "(")
+	default:
+		t.write("(" + to + ")(")
+	}
+	t.transpile(ce.Nodes[0], false)
+	t.write(")")
+}
+
 func (t *translator) transDefineExpr(de *ast.DefineExpr) {
-	t.scope.Insert(de.Name, de)
-	t.openScope()
 	t.transFuncDecl(de)
 	t.openBlock()
 	for i := 0; i < len(de.Nodes)-1; i++ {
 		t.transpile(de.Nodes[i], true)
 	}
 	last := de.Nodes[len(de.Nodes)-1]
-	if n, ok := last.(*ast.IfExpr); ok {
-		t.transpile(n, false)
-	} else {
+	ret := t.nodeType(de) != "void"
+	switch {
+	case isIf(last):
+		t.transIfExpr(last.(*ast.IfExpr), ret)
+	case ret:
 		t.returnStatement(last)
+	default:
+		t.transpile(last, true)
 	}
 	t.closeBlock()
-	t.closeScope()
 	t.write("\n")
 }
 
 func (t *translator) transFuncDecl(de *ast.DefineExpr) {
 	t.write(t.nodeType(de) + " ")
-	t.write(de.Name + "(")
+	t.write(cName(de.Name) + "(")
 	for i, a := range de.Args {
-		t.write("int ") /* again, so bad... */
-		t.write(a)
-		t.scope.Insert(a, 0)
+		t.write(t.argType(de, i) + " ")
+		t.write(cName(a))
 		if i < len(de.Args)-1 {
 			t.write(",")
 		}
@@ -202,46 +492,65 @@ func (t *translator) transFuncDecl(de *ast.DefineExpr) {
 }
 
 func (t *translator) transFuncSigs(n ast.Node) {
-	/* walk the AST and create function signatures for every function found */
-	switch node := n.(type) {
-	case *ast.DefineExpr:
-		t.transFuncDecl(node)
-		t.write(";\n")
-	case *ast.File:
-		for _, v := range node.Nodes {
-			t.transFuncSigs(v)
-		}
-	case *ast.Expression:
-		for _, v := range node.Nodes {
-			t.transFuncSigs(v)
+	/* create function signatures for every function found */
+	ast.Inspect(n, func(n ast.Node) bool {
+		if de, ok := n.(*ast.DefineExpr); ok {
+			t.transFuncDecl(de)
+			t.write(";\n")
 		}
-	}
-	return
+		return true
+	})
+}
+
+func isIf(n ast.Node) bool {
+	_, ok := n.(*ast.IfExpr)
+	return ok
 }
 
-func (t *translator) transIfExpr(ie *ast.IfExpr) {
+// transIfExpr translates an if as a statement, whose branches return their
+// values if ret is set
+func (t *translator) transIfExpr(ie *ast.IfExpr, ret bool) {
 	t.write("if (")
 	t.transpile(ie.Nodes[0], false)
 	t.write(")")
 	t.openBlock()
-	switch ie.Nodes[1].(type) {
-	case *ast.Identifier, *ast.Number, *ast.String, *ast.MathExpr, *ast.UserExpr:
-		t.write("return ")
-	}
-	t.transpile(ie.Nodes[1], true)
+	t.transBranch(ie.Nodes[1], ret)
 	t.closeBlock()
 	if ie.Nodes[2] != nil {
 		t.write("else")
 		t.openBlock()
-		switch ie.Nodes[2].(type) {
-		case *ast.Number, *ast.String, *ast.MathExpr, *ast.UserExpr:
-			t.write("return ")
-		}
-		t.transpile(ie.Nodes[2], true)
+		t.transBranch(ie.Nodes[2], ret)
 		t.closeBlock()
 	}
 }
 
+func (t *translator) transBranch(n ast.Node, ret bool) {
+	switch {
+	case isIf(n):
+		t.transIfExpr(n.(*ast.IfExpr), ret)
+	case ret && t.nodeType(n) != "void":
+		t.returnStatement(n)
+	default:
+		t.transpile(n, true)
+	}
+}
+
+// transCondExpr translates an if whose value is used
+func (t *translator) transCondExpr(ie *ast.IfExpr) {
+	if ie.Nodes[2] == nil {
+		t.file.AddError(ie.Pos(), "Unable to translate the value of an if "+
+			"without an else")
+		return
+	}
+	t.write("(")
+	t.transpile(ie.Nodes[0], false)
+	t.write(" ? ")
+	t.transpile(ie.Nodes[1], false)
+	t.write(" : ")
+	t.transpile(ie.Nodes[2], false)
+	t.write(")")
+}
+
 func (t *translator) transMathExpr(me *ast.MathExpr) {
 	t.write("(")
 	for i, n := range me.Nodes {
@@ -260,6 +569,45 @@ func (t *translator) transMathExpr(me *ast.MathExpr) {
 	t.write(")")
 }
 
+// transPredExpr lowers a type predicate to a constant, as the type of every C
+// value is known at compile time. The argument is still evaluated in case it
+// has side effects.
+func (t *translator) transPredExpr(pe *ast.PredExpr) {
+	arg := pe.Nodes[0]
+	res := "0"
+	if i, ok := arg.(*ast.Identifier); ok && i.Obj != nil &&
+		i.Obj.Kind == ast.Fun {
+		if pe.PredLit == "function?" {
+			res = "1"
+		}
+		t.write(res)
+		return
+	}
+	typ := t.nodeType(arg)
+	switch pe.PredLit {
+	case "number?":
+		if typ == "int" || typ == "double" {
+			res = "1"
+		}
+	case "string?":
+		if typ == "char *" {
+			res = "1"
+		}
+	case "bool?":
+		if t.info.TypeOf(arg) == types.Bool {
+			res = "1"
+		}
+	}
+	switch arg.(type) {
+	case *ast.Identifier, *ast.Number, *ast.String:
+		t.write(res)
+	default:
+		t.write("((void)(")
+		t.transpile(arg, false)
+		t.write("), " + res + ")")
+	}
+}
+
 func (t *translator) transPrintExpr(pe *ast.PrintExpr) {
 	t.write("printf(\"")
 	for i, n := range pe.Nodes {
@@ -268,33 +616,70 @@ func (t *translator) transPrintExpr(pe *ast.PrintExpr) {
 			t.write("%d")
 		case "char *":
 			t.write("%s")
+		case "double":
+			t.write("%g")
 		case "void *":
 			t.write("%p")
+		case "void":
+			t.file.AddError(n.Pos(), "Unable to translate the printing of "+
+				"an expression without a value")
 		}
 		if i < len(pe.Nodes)-1 {
 			t.write(" ")
 		}
 	}
-	if len(pe.Nodes) > 0 {
-		t.write("\\n\",")
-		for _, n := range pe.Nodes {
-			t.transpile(n, false)
-		}
-	} else {
-		t.write("\"")
+	t.write("\\n\"")
+	for _, n := range pe.Nodes {
+		t.write(",")
+		t.transpile(n, false)
 	}
 	t.write(")")
 }
 
 func (t *translator) transSetExpr(se *ast.SetExpr) {
-	t.scope.Insert(se.Name, se.Value)
-	t.write(t.nodeType(se.Value) + " ")
-	t.write(se.Name + " = ")
+	if !t.declared[se.Obj] {
+		t.declared[se.Obj] = true
+		t.write(t.objType(se.Obj) + " ")
+	}
+	t.write(cName(se.Name) + " = ")
 	t.transpile(se.Value, false)
 }
 
+// transSwitchExpr translates a switch to a chain of ifs, so that only the
+// first case which matches is run
+func (t *translator) transSwitchExpr(se *ast.SwitchExpr) {
+	for i, n := range se.Nodes {
+		ce := n.(*ast.CaseExpr)
+		if i > 0 {
+			t.write("else ")
+		}
+		t.write("if (")
+		switch {
+		case se.Pred == nil:
+			t.transpile(ce.Nodes[0], false)
+		case t.nodeType(se.Pred) == "char *":
+			t.str = true
+			t.write("strcmp(")
+			t.transpile(se.Pred, false)
+			t.write(", ")
+			t.transpile(ce.Nodes[0], false)
+			t.write(") == 0")
+		default:
+			t.transpile(se.Pred, false)
+			t.write(" == ")
+			t.transpile(ce.Nodes[0], false)
+		}
+		t.write(")")
+		t.openBlock()
+		for _, b := range ce.Nodes[1:] {
+			t.transpile(b, true)
+		}
+		t.closeBlock()
+	}
+}
+
 func (t *translator) transUserExpr(ue *ast.UserExpr) {
-	t.write(ue.Name + "(")
+	t.write(cName(ue.Name) + "(")
 	for i, v := range ue.Nodes {
 		t.transpile(v, false)
 		if i < len(ue.Nodes)-1 {
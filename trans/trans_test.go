@@ -0,0 +1,109 @@
+package trans_test
+
+import (
+	"bytes"
+	"github.com/rthornton128/gocalc/parser"
+	"github.com/rthornton128/gocalc/token"
+	"github.com/rthornton128/gocalc/trans"
+	"strings"
+	"testing"
+)
+
+const header = "/* This program was created by Translitorator 2000 v0.1 */\n" +
+	"#include <stdio.h>\n"
+
+// translate returns src translated to C, less the header common to every
+// translation, and the errors found
+func translate(t *testing.T, src string) (string, error) {
+	f := token.NewFile("", src, 1)
+	n := parser.ParseFile(f, src)
+	if f.NumErrors() > 0 {
+		t.Fatal("Unexpected parse errors:", f.Err())
+	}
+	var buf bytes.Buffer
+	trans.TransTree(&buf, f, n)
+	return strings.TrimPrefix(buf.String(), header), f.Err()
+}
+
+func TestTransFile(t *testing.T) {
+	var tests = []struct {
+		src string
+		out string
+	}{
+		// top level expressions make up main, and set globals
+		{"(set a 1)\n(print a)",
+			"int a;\nint main(void)\n{\na = 1;\nprintf(\"%d\\n\",a);\n" +
+				"return 0;\n}\n"},
+		{"(define (f) (print 1)) (f)",
+			"void f(void);\nvoid f(void){\nprintf(\"%d\\n\",1);\n}\n\n" +
+				"int main(void)\n{\nf();\nreturn 0;\n}\n"},
+		{"(define (main) 0)",
+			"int main(void);\nint main(void){\nreturn 0;\n}\n\n"},
+		// names which aren't valid in C
+		{"(define (is-odd? n) (% n 2)) (print (is-odd? 3))",
+			"int is_odd_p(int n);\nint is_odd_p(int n){\nreturn (n%2);\n}\n\n" +
+				"int main(void)\n{\nprintf(\"%d\\n\",is_odd_p(3));\n" +
+				"return 0;\n}\n"},
+		{"(print (if (< 1 2) 1 2))",
+			"int main(void)\n{\nprintf(\"%d\\n\",(1 < 2 ? 1 : 2));\n" +
+				"return 0;\n}\n"},
+		// strings have no escapes in Calc, but may span lines
+		{"(print \"a\\nb\" \"c\nd\" \"e??=\")",
+			"int main(void)\n{\nprintf(\"%s %s %s\\n\",\"a\\\\nb\"," +
+				"\"c\\nd\",\"e?\\?=\");\nreturn 0;\n}\n"},
+		{"(set b (< 1 2)) (print (bool? b) (list? b))",
+			"int b;\nint main(void)\n{\nb = 1 < 2;\n" +
+				"printf(\"%d %d\\n\",1,0);\nreturn 0;\n}\n"},
+		{"(print (<> 1 2))",
+			"int main(void)\n{\nprintf(\"%d\\n\",1 != 2);\nreturn 0;\n}\n"},
+		{"(set x 2) (switch x (case 1 (print \"one\")) (case 2 (print 2)))",
+			"int x;\nint main(void)\n{\nx = 2;\nif (x == 1){\n" +
+				"printf(\"%s\\n\",\"one\");\n}\nelse if (x == 2){\n" +
+				"printf(\"%d\\n\",2);\n}\nreturn 0;\n}\n"},
+	}
+	for i, test := range tests {
+		out, err := translate(t, test.src)
+		if err != nil {
+			t.Fatal(i, "- Unexpected errors:", err)
+		}
+		if out != test.out {
+			t.Log(i, "- Expected:", test.out)
+			t.Fatal(i, "- Got:", out)
+		}
+	}
+}
+
+func TestTransArgTypes(t *testing.T) {
+	// the type of s is unknown, so is taken from the first call of greet
+	src := "(define (greet s) (+ \"hi \" s)) (print (greet \"bob\"))"
+	out, err := translate(t, src)
+	if err != nil {
+		t.Fatal("Unexpected errors:", err)
+	}
+	for _, want := range []string{"char * greet(char * s){\n",
+		"return calc_concat(\"hi \", s);\n", "#include <string.h>\n"} {
+		if !strings.Contains(out, want) {
+			t.Log("Expected:", want)
+			t.Fatal("Got:", out)
+		}
+	}
+}
+
+func TestTransErrors(t *testing.T) {
+	var tests = []struct {
+		src string
+		err string
+	}{
+		{"(define (main) 0) (print 1)", "Line: 1 Column: 19 - Unable to " +
+			"translate expressions outside of functions when main is declared"},
+		{"(print (print 1))", "Line: 1 Column: 8 - Unable to translate the " +
+			"printing of an expression without a value"},
+	}
+	for i, test := range tests {
+		_, err := translate(t, test.src)
+		if err == nil || err.Error() != test.err {
+			t.Log(i, "- Expected:", test.err)
+			t.Fatal(i, "- Got:", err)
+		}
+	}
+}
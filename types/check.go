@@ -0,0 +1,325 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+package types
+
+import (
+	"github.com/rthornton128/gocalc/ast"
+	"github.com/rthornton128/gocalc/token"
+)
+
+// Check type checks a file which has been resolved by resolve.File. Type
+// errors are recorded in f.
+func Check(f *token.File, n *ast.File) *Info {
+	info := NewInfo()
+	info.CheckFile(f, n)
+	return info
+}
+
+// NewInfo returns an Info with nothing recorded.
+func NewInfo() *Info {
+	return &Info{Types: make(map[ast.Node]Type),
+		Objects: make(map[*ast.Object]Type),
+		Args:    make(map[*ast.DefineExpr][]Type)}
+}
+
+// Copy returns a copy of info, with which a file may be checked without
+// changing info.
+func (info *Info) Copy() *Info {
+	c := NewInfo()
+	for k, v := range info.Types {
+		c.Types[k] = v
+	}
+	for k, v := range info.Objects {
+		c.Objects[k] = v
+	}
+	for k, v := range info.Args {
+		c.Args[k] = v
+	}
+	return c
+}
+
+// CheckFile type checks n like Check, adding the results to info. Names
+// declared in the files previously checked with info may be used by n.
+func (info *Info) CheckFile(f *token.File, n *ast.File) {
+	c := &checker{file: f, info: info}
+	for _, node := range n.Nodes {
+		c.check(node)
+	}
+	// argument types may have been inferred after some of their uses
+	for _, i := range c.argIdents {
+		t := c.info.Args[i.Obj.Decl.(*ast.DefineExpr)][i.Obj.Index]
+		c.info.Types[i] = t
+		c.info.Objects[i.Obj] = t
+	}
+}
+
+type checker struct {
+	file      *token.File
+	info      *Info
+	argIdents []*ast.Identifier // uses of arguments
+}
+
+func (c *checker) error(p token.Pos, args ...interface{}) {
+	c.file.AddError(p, args...)
+}
+
+// annotation returns the type named by an annotation, reporting an error if
+// there is no such type
+func (c *checker) annotation(p token.Pos, name string) Type {
+	if name == "" {
+		return Unknown
+	}
+	t, ok := Lookup(name)
+	if !ok {
+		c.error(p, "Unknown type: ", name)
+	}
+	return t
+}
+
+func (c *checker) check(n ast.Node) Type {
+	if n == nil {
+		return Nil
+	}
+	var t Type
+	switch node := n.(type) {
+	case *ast.AssertEqualExpr:
+		c.checkAssertEqualExpr(node)
+		t = Nil
+	case *ast.AssertExpr:
+		t = c.checkAssertExpr(node)
+	case *ast.CompExpr:
+		c.expect(node.Nodes[0], Int, node.CompLit)
+		c.expect(node.Nodes[1], Int, node.CompLit)
+		t = Bool
+	case *ast.ConcatExpr:
+		for _, v := range node.Nodes {
+			c.check(v)
+		}
+		t = String
+	case *ast.ConvExpr:
+		t = Conversion(node.ConvLit)
+		if c.check(node.Nodes[0]) == Nil {
+			c.error(node.Nodes[0].Pos(), "Cannot convert nil to ", t)
+		}
+	case *ast.DefineExpr:
+		c.checkDefineExpr(node)
+		t = Nil
+	case *ast.Identifier:
+		t = c.objType(node)
+	case *ast.IfExpr:
+		c.expect(node.Nodes[0], Int, "if")
+		t = join(c.check(node.Nodes[1]), c.check(node.Nodes[2]))
+	case *ast.MathExpr:
+		for _, v := range node.Nodes {
+			c.expect(v, Int, node.OpLit)
+		}
+		t = Int
+		if node.OpLit == "and" || node.OpLit == "or" {
+			t = Bool
+		}
+	case *ast.Number:
+		t = Int
+	case *ast.PredExpr:
+		c.check(node.Nodes[0])
+		t = Bool
+	case *ast.PrintExpr:
+		for _, v := range node.Nodes {
+			c.check(v)
+		}
+		t = Nil
+	case *ast.SetExpr:
+		c.checkSetExpr(node)
+		t = Nil
+	case *ast.String:
+		t = String
+	case *ast.SwitchExpr:
+		c.checkSwitchExpr(node)
+		t = Nil
+	case *ast.TestExpr:
+		for _, v := range node.Nodes {
+			c.check(v)
+		}
+		t = Nil
+	case *ast.UserExpr:
+		t = c.checkUserExpr(node)
+	}
+	c.info.Types[n] = t
+	return t
+}
+
+// expect checks that n is of type want. An argument of unknown type is
+// inferred to be of type want.
+func (c *checker) expect(n ast.Node, want Type, context string) {
+	t := c.check(n)
+	if i, ok := n.(*ast.Identifier); ok && t == Unknown && i.Obj != nil &&
+		i.Obj.Kind == ast.Arg {
+		c.info.Args[i.Obj.Decl.(*ast.DefineExpr)][i.Obj.Index] = want
+		return
+	}
+	if !assignable(t, want) {
+		c.error(n.Pos(), "Operand of '", context, "' must be ", want,
+			", got ", t)
+	}
+}
+
+func (c *checker) objType(i *ast.Identifier) Type {
+	obj := i.Obj
+	if obj == nil {
+		return Unknown
+	}
+	switch obj.Kind {
+	case ast.Arg:
+		c.argIdents = append(c.argIdents, i)
+		return c.info.Args[obj.Decl.(*ast.DefineExpr)][obj.Index]
+	case ast.Fun:
+		return Nil
+	}
+	return c.info.Objects[obj]
+}
+
+// checkAssertExpr reports assertions which can never succeed. The value of
+// an assertion is known to be of the asserted type.
+func (c *checker) checkAssertExpr(a *ast.AssertExpr) Type {
+	v := c.check(a.Nodes[0])
+	t := c.annotation(a.Pos(), a.Type)
+	if t != Unknown && !assignable(v, t) {
+		c.error(a.Pos(), "Type assertion can never succeed: expected ", t,
+			", got ", v)
+	}
+	return t
+}
+
+// checkAssertEqualExpr reports assertions which can never succeed, the
+// values compared being of different types.
+func (c *checker) checkAssertEqualExpr(a *ast.AssertEqualExpr) {
+	want, got := c.check(a.Nodes[0]), c.check(a.Nodes[1])
+	if !assignable(got, want) {
+		c.error(a.Pos(), "Assertion can never succeed: expected ", want,
+			", got ", got)
+	}
+}
+
+func (c *checker) checkDefineExpr(d *ast.DefineExpr) {
+	ret := c.annotation(d.Pos(), d.Type)
+	args := make([]Type, len(d.Args))
+	for i := range args {
+		if i < len(d.ArgTypes) {
+			args[i] = c.annotation(d.Pos(), d.ArgTypes[i])
+		}
+	}
+	c.info.Args[d] = args
+	if d.Obj != nil {
+		c.info.Objects[d.Obj] = ret // Unknown while checking the body
+	}
+
+	// The result of a function is the first value which is not nil
+	res := Nil
+	for _, n := range d.Nodes {
+		t := c.check(n)
+		if t == Nil {
+			continue
+		}
+		if d.Type != "" && !assignable(t, ret) {
+			c.error(n.Pos(), "Function ", d.Name, " returns ", ret,
+				", got ", t)
+		}
+		if res == Nil {
+			res = t
+		} else {
+			res = join(res, t)
+		}
+	}
+	if d.Type != "" {
+		if res == Nil {
+			c.error(d.Pos(), "Function ", d.Name, " returns ", ret,
+				" but has no result")
+		}
+		res = ret
+	}
+	if d.Obj != nil {
+		c.info.Objects[d.Obj] = res
+	}
+}
+
+func (c *checker) checkSetExpr(s *ast.SetExpr) {
+	v := c.check(s.Value)
+	if s.Obj == nil {
+		return
+	}
+	t, ok := c.info.Objects[s.Obj]
+	if s.Type != "" {
+		a := c.annotation(s.Pos(), s.Type)
+		if ok && t != Unknown && join(t, a) != a {
+			c.error(s.Pos(), "Variable ", s.Name, " is of type ", t,
+				", not ", a)
+		}
+		t, ok = a, true
+	}
+	if !ok {
+		// the first value set determines the type of the variable
+		if v == Nil {
+			v = Unknown
+		}
+		c.info.Objects[s.Obj] = v
+		return
+	}
+	if !assignable(v, t) {
+		c.error(s.Pos(), "Cannot set ", s.Name, " of type ", t,
+			" to a value of type ", v)
+	}
+	if t == Bool {
+		// a variable once set to anything else may no longer hold a bool
+		t = join(t, v)
+	}
+	c.info.Objects[s.Obj] = t
+}
+
+func (c *checker) checkSwitchExpr(s *ast.SwitchExpr) {
+	pred := Unknown
+	if s.Pred != nil {
+		pred = c.check(s.Pred)
+	}
+	for _, n := range s.Nodes {
+		ce, ok := n.(*ast.CaseExpr)
+		if !ok {
+			c.check(n)
+			continue
+		}
+		if s.Pred != nil {
+			if t := c.check(ce.Nodes[0]); !assignable(t, pred) {
+				c.error(ce.Nodes[0].Pos(), "Case of type ", t,
+					" can never match a predicate of type ", pred)
+			}
+		} else {
+			c.expect(ce.Nodes[0], Int, "case")
+		}
+		for _, v := range ce.Nodes[1:] {
+			c.check(v)
+		}
+		c.info.Types[ce] = Nil
+	}
+}
+
+func (c *checker) checkUserExpr(u *ast.UserExpr) Type {
+	if u.Obj == nil {
+		return Unknown
+	}
+	d, ok := u.Obj.Decl.(*ast.DefineExpr)
+	if !ok {
+		return Unknown
+	}
+	args := c.info.Args[d]
+	for i, n := range u.Nodes {
+		t := c.check(n)
+		if i < len(args) && !assignable(t, args[i]) {
+			c.error(n.Pos(), "Argument ", i+1, " of ", u.Name, " must be ",
+				args[i], ", got ", t)
+		}
+	}
+	return c.info.Objects[u.Obj]
+}
@@ -0,0 +1,82 @@
+package types_test
+
+import (
+	"github.com/rthornton128/gocalc/ast"
+	"github.com/rthornton128/gocalc/parser"
+	"github.com/rthornton128/gocalc/resolve"
+	"github.com/rthornton128/gocalc/token"
+	"github.com/rthornton128/gocalc/types"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	var tests = []struct {
+		expr string
+		err  string
+	}{
+		{"(set a 1) (+ 2 a)", ""},
+		{"(set a \"foo\") (+ 2 a)",
+			"Line: 1 Column: 20 - Operand of '+' must be int, got string"},
+		{"(set a 1) (set a \"foo\")",
+			"Line: 1 Column: 11 - Cannot set a of type int to a value of type string"},
+		{"(set a:int \"foo\")",
+			"Line: 1 Column: 1 - Cannot set a of type int to a value of type string"},
+		{"(set a:bool 1)", "Line: 1 Column: 1 - Unknown type: bool"},
+		{"(set a (float 1)) (+ a 1)",
+			"Line: 1 Column: 22 - Operand of '+' must be int, got float"},
+		{"(define (f) (print)) (str (f))",
+			"Line: 1 Column: 27 - Cannot convert nil to string"},
+		{"(set a 1) (set a:string \"b\")",
+			"Line: 1 Column: 11 - Variable a is of type int, not string"},
+		{"(define (sq x) (* x x)) (sq 2)", ""},
+		{"(define (sq x) (* x x)) (sq \"a\")",
+			"Line: 1 Column: 29 - Argument 1 of sq must be int, got string"},
+		{"(define (f:int s:string) (+ \"n\" s)) (f \"a\")",
+			"Line: 1 Column: 26 - Function f returns int, got string"},
+		{"(define (f:string x:int) (print x))",
+			"Line: 1 Column: 1 - Function f returns string but has no result"},
+		{"(define (f x) x) (+ 2 (f \"foo\"))", ""},
+		{"(define (f s:string) s) (+ 1 (f \"a\"))",
+			"Line: 1 Column: 30 - Operand of '+' must be int, got string"},
+		{"(set a 1) (switch a (case \"x\" (print)))",
+			"Line: 1 Column: 27 - Case of type string can never match a predicate of type int"},
+		{"(deftest t (set a 1) (assert-equal a 1))", ""},
+		{"(deftest t (assert-equal 1 \"a\"))",
+			"Line: 1 Column: 12 - Assertion can never succeed: expected int, got string"},
+	}
+	for i, test := range tests {
+		f := token.NewFile("", test.expr, 1)
+		n := parser.ParseFile(f, test.expr)
+		if f.NumErrors() > 0 {
+			t.Fatal(i, "- Parse error:", f.Err())
+		}
+		resolve.File(f, n)
+		types.Check(f, n)
+		var err string
+		if e := f.Err(); e != nil {
+			err = e.Error()
+		}
+		if err != test.err {
+			t.Log(i, "- Expected:", test.err)
+			t.Fatal(i, "- Got:", err)
+		}
+	}
+}
+
+func TestCheckInfer(t *testing.T) {
+	expr := "(define (f x y) (if (> x 0) y 0)) (set s (f 1 \"a\"))"
+	f := token.NewFile("", expr, 1)
+	n := parser.ParseFile(f, expr)
+	resolve.File(f, n)
+	info := types.Check(f, n)
+	if f.NumErrors() > 0 {
+		t.Fatal(f.Err())
+	}
+	d := n.Nodes[0].(*ast.DefineExpr)
+	if args := info.Args[d]; args[0] != types.Int || args[1] != types.Unknown {
+		t.Fatal("Expected arguments int and unknown, got:", args)
+	}
+	if typ := info.Objects[d.Obj]; typ != types.Unknown {
+		t.Fatal("Expected f to return unknown, got:", typ)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+// Package types implements a static type checker for Calc.
+//
+// Arguments, return values and variables may be annotated with a type:
+//
+//	(define (func-name:int arg1 arg2:int arg3:string) (...))
+//	(set a:int 1)
+//
+// Where there is no annotation the type is inferred if possible. A variable
+// takes the type of the first value it is set to and an argument takes the
+// type required of it by its first use within the function. Anything which
+// cannot be inferred is Unknown and is checked only at run time.
+package types
+
+import (
+	"fmt"
+	"github.com/rthornton128/gocalc/ast"
+	"strconv"
+	"strings"
+)
+
+type Type int
+
+const (
+	Unknown Type = iota // may be any type, checked at run time
+	Nil                 // no value, the result of print, set and friends
+	Int
+	Float
+	String
+	Bool // an int produced by a comparison, logical operator or predicate
+)
+
+var typeNames = [...]string{
+	Unknown: "unknown",
+	Nil:     "nil",
+	Int:     "int",
+	Float:   "float",
+	String:  "string",
+	Bool:    "bool",
+}
+
+func (t Type) String() string {
+	return typeNames[t]
+}
+
+// Lookup returns the type named by an annotation.
+func Lookup(name string) (Type, bool) {
+	switch name {
+	case "int":
+		return Int, true
+	case "float":
+		return Float, true
+	case "string":
+		return String, true
+	}
+	return Unknown, false
+}
+
+// Conversion returns the type produced by the conversion builtin named name.
+func Conversion(name string) Type {
+	switch name {
+	case "int":
+		return Int
+	case "float":
+		return Float
+	case "str":
+		return String
+	}
+	return Unknown
+}
+
+// ValueType returns the type of a value produced at run time.
+func ValueType(v interface{}) Type {
+	switch v.(type) {
+	case nil:
+		return Nil
+	case int:
+		return Int
+	case float64:
+		return Float
+	case string:
+		return String
+	}
+	return Unknown
+}
+
+// Convert converts a value produced at run time to type t, as done by the
+// int, float and str builtins. Floats are truncated when converted to ints.
+func Convert(v interface{}, t Type) (interface{}, error) {
+	var err error
+	switch x := v.(type) {
+	case int:
+		switch t {
+		case Int:
+			return x, nil
+		case Float:
+			return float64(x), nil
+		case String:
+			return strconv.Itoa(x), nil
+		}
+	case float64:
+		switch t {
+		case Int:
+			return int(x), nil
+		case Float:
+			return x, nil
+		case String:
+			return FormatFloat(x), nil
+		}
+	case string:
+		s := strings.TrimSpace(x)
+		switch t {
+		case Int:
+			var i int
+			if i, err = strconv.Atoi(s); err == nil {
+				return i, nil
+			}
+		case Float:
+			var f float64
+			if f, err = strconv.ParseFloat(s, 64); err == nil {
+				return f, nil
+			}
+		case String:
+			return x, nil
+		}
+		return nil, fmt.Errorf("Cannot convert %q to %s", x, t)
+	}
+	return nil, fmt.Errorf("Cannot convert %s to %s", ValueType(v), t)
+}
+
+// FormatFloat formats a float the way print does.
+func FormatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Info holds the results of type checking a file.
+type Info struct {
+	Types   map[ast.Node]Type          // type of each expression
+	Objects map[*ast.Object]Type       // type of each name, functions by result
+	Args    map[*ast.DefineExpr][]Type // argument types of each function
+}
+
+// TypeOf returns the type of n, or Unknown if it is not recorded.
+func (info *Info) TypeOf(n ast.Node) Type {
+	return info.Types[n]
+}
+
+// join returns the type of a value which may be either a or b
+func join(a, b Type) Type {
+	switch {
+	case a == b:
+		return a
+	case integral(a) && integral(b):
+		return Int
+	}
+	return Unknown
+}
+
+// integral reports whether a value of type t is an int at run time
+func integral(t Type) bool {
+	return t == Int || t == Bool
+}
+
+// assignable reports whether a value of type v may be used where type t is
+// required
+func assignable(v, t Type) bool {
+	return v == Unknown || t == Unknown || v == t ||
+		integral(v) && integral(t)
+}
@@ -0,0 +1,758 @@
+// Copyright (c) 2013, Rob Thornton
+// All rights reserved.
+// This software is governed by a Simplied BSD-License. Please see the
+// LICENSE included in this distribution for a copy of the full license
+// or, if one is not included, you may also find a copy at
+// http://opensource.org/licenses/BSD-2-Clause
+
+// Package vm executes programs produced by the compile package on a stack
+// based virtual machine.
+//
+// A compiled program runs the bundled scripts more than ten times as fast as
+// the eval package evaluates them, as the benchmarks show. Both are timed
+// from a parsed file, since parsing is shared by the two and would
+// otherwise take most of the VM's time.
+//
+// The VM honours the limits and the sandbox of the eval package but has
+// none of its hooks, so a script run by it can't be traced, profiled,
+// debugged or measured for coverage.
+package vm
+
+import (
+	"context"
+	"fmt"
+	"github.com/rthornton128/gocalc/ast"
+	"github.com/rthornton128/gocalc/compile"
+	"github.com/rthornton128/gocalc/parser"
+	"github.com/rthornton128/gocalc/token"
+	"github.com/rthornton128/gocalc/types"
+	"io"
+	"math"
+	"os"
+	"strconv"
+)
+
+// DefaultMaxDepth is the call depth limit of a new VM.
+const DefaultMaxDepth = 10000
+
+// checkInterval is the number of instructions executed between checks for
+// cancellation of the context.
+const checkInterval = 1024
+
+// Options are the limits and restrictions under which EvalFileContext runs a
+// script. They are those of eval.Options which the VM supports.
+type Options struct {
+	MaxSteps int // maximum number of instructions executed
+	MaxDepth int // maximum depth of nested user function calls
+	MaxSize  int // maximum length, in bytes, of a string value
+
+	// Sandbox restricts builtins to those whose capabilities are listed in
+	// Allow. Scripts using any other builtin are rejected by the parser.
+	Sandbox bool
+	Allow   []string
+
+	// Stdout is where print writes, os.Stdout if nil.
+	Stdout io.Writer
+}
+
+func EvalExpr(expr string) interface{} {
+	return EvalFile("", expr)
+}
+
+// EvalFile compiles and runs expr, printing any errors. It is the bytecode
+// counterpart to eval.EvalFile.
+func EvalFile(fname, expr string) interface{} {
+	opt := Options{MaxDepth: DefaultMaxDepth}
+	res, err := EvalFileContext(context.Background(), fname, expr, opt)
+	if err != nil {
+		PrintError(err)
+		return nil
+	}
+	return res
+}
+
+// PrintError prints err to standard out, one line per error if err is a
+// token.ErrorList.
+func PrintError(err error) {
+	if l, ok := err.(token.ErrorList); ok {
+		for _, s := range l {
+			fmt.Println(s)
+		}
+		return
+	}
+	fmt.Println(err)
+}
+
+// EvalFileContext compiles expr and runs it within the limits set by opt.
+// Execution stops as soon as ctx is cancelled or a limit is exceeded. Any
+// compile or runtime errors are returned as a token.ErrorList.
+func EvalFileContext(ctx context.Context, fname, expr string,
+	opt Options) (interface{}, error) {
+	var n *ast.File
+	f := token.NewFile(fname, expr, 1)
+	if opt.Sandbox {
+		for _, c := range opt.Allow {
+			if !parser.IsCapability(c) {
+				return nil, fmt.Errorf("unknown capability: %s", c)
+			}
+		}
+		n = parser.ParseFileSandbox(f, expr, opt.Allow)
+	} else {
+		n = parser.ParseFile(f, expr)
+	}
+	if f.NumErrors() > 0 {
+		return nil, f.Err()
+	}
+	prog, err := compile.Compile(f, n)
+	if err != nil {
+		return nil, err
+	}
+	vm := New(prog)
+	vm.MaxSteps, vm.MaxDepth, vm.MaxSize = opt.MaxSteps, opt.MaxDepth,
+		opt.MaxSize
+	if opt.Stdout != nil {
+		vm.Out = opt.Stdout
+	}
+	return vm.RunContext(ctx)
+}
+
+type kind uint8
+
+const (
+	nilKind kind = iota
+	intKind
+	floatKind
+	strKind
+)
+
+// value avoids boxing numbers in an interface on every operation
+type value struct {
+	kind kind
+	num  int // the bits of a float for floatKind
+	str  string
+}
+
+func toValue(x interface{}) value {
+	switch t := x.(type) {
+	case int:
+		return value{kind: intKind, num: t}
+	case float64:
+		return value{kind: floatKind, num: int(math.Float64bits(t))}
+	case string:
+		return value{kind: strKind, str: t}
+	}
+	return value{}
+}
+
+func (v value) iface() interface{} {
+	switch v.kind {
+	case intKind:
+		return v.num
+	case floatKind:
+		return math.Float64frombits(uint64(v.num))
+	case strKind:
+		return v.str
+	}
+	return nil
+}
+
+func (v value) isTrue() bool {
+	return v.kind == intKind && v.num >= 1
+}
+
+func intValue(i int) value {
+	return value{kind: intKind, num: i}
+}
+
+func boolValue(b bool) value {
+	if b {
+		return value{kind: intKind, num: 1}
+	}
+	return value{kind: intKind}
+}
+
+// frame holds no pointers so that pushing one is cheap
+type frame struct {
+	fn   int // index into VM.fns
+	ip   int // offset of the next instruction
+	base int // stack offset of the first local
+	link int // index of the frame of the lexically enclosing function
+}
+
+// function is a compile.Function prepared to be run. Its operands are
+// decoded, in place, so that each is read with a single load, and a jump to
+// a return is replaced by the return.
+type function struct {
+	code      []int32 // opcodes, each followed by its decoded operands
+	consts    []value
+	pos       []token.Pos
+	name      string
+	numArgs   int
+	numLocals int
+	maxStack  int // most stack slots used at once, from the first local
+}
+
+// VM runs a single compiled program.
+type VM struct {
+	Out      io.Writer // destination of print, os.Stdout by default
+	MaxSteps int       // maximum instructions executed, 0 for no limit
+	MaxDepth int       // maximum call depth, 0 for no limit
+	MaxSize  int       // maximum length of a string, 0 for no limit
+
+	prog    *compile.Program
+	fns     []function // prog.Functions followed by prog.Main
+	globals []value
+	stack   []value
+	frames  []frame
+	steps   int    // instructions allowed to run so far
+	buf     []byte // output of print
+}
+
+func New(prog *compile.Program) *VM {
+	vm := &VM{Out: os.Stdout, MaxDepth: DefaultMaxDepth, prog: prog}
+	fns := append(append([]*compile.Function(nil), prog.Functions...),
+		prog.Main)
+	vm.fns = make([]function, len(fns))
+	for i, fn := range fns {
+		vm.fns[i] = prepare(fn, fns)
+	}
+	return vm
+}
+
+func prepare(fn *compile.Function, fns []*compile.Function) function {
+	f := function{code: make([]int32, len(fn.Code)),
+		consts: make([]value, len(fn.Consts)), pos: fn.Pos, name: fn.Name,
+		numArgs: fn.NumArgs, numLocals: fn.NumLocals}
+	for off := 0; off < len(fn.Code); {
+		op := compile.Opcode(fn.Code[off])
+		f.code[off] = int32(op)
+		if op == compile.OpJump &&
+			compile.Opcode(fn.Code[operand(fn.Code, off+1)]) == compile.OpReturn {
+			f.code[off] = int32(compile.OpReturn) // jump straight out
+		}
+		off++
+		for i := 0; i < op.Operands(); i++ {
+			f.code[off] = int32(operand(fn.Code, off))
+			off += 2
+		}
+	}
+	for i, k := range fn.Consts {
+		f.consts[i] = toValue(k)
+	}
+	f.maxStack = maxStack(fn, fns)
+	return f
+}
+
+// maxStack returns the most stack slots fn uses at once, counting from its
+// first local, so that the stack need only be checked for room on a call.
+// Jumps only go forward, so a single pass finds the depth at each offset.
+func maxStack(fn *compile.Function, fns []*compile.Function) int {
+	depth := make([]int, len(fn.Code)+1) // depth+1 on reaching an offset
+	d, max := fn.NumLocals, fn.NumLocals
+	live := true
+	for off := 0; off < len(fn.Code); {
+		op := compile.Opcode(fn.Code[off])
+		if j := depth[off] - 1; j >= 0 && (!live || j > d) {
+			d, live = j, true
+		}
+		next := off + 1 + 2*op.Operands()
+		if !live {
+			off = next
+			continue
+		}
+		a := 0
+		if op.Operands() > 0 {
+			a = operand(fn.Code, off+1)
+		}
+		switch op {
+		case compile.OpNil, compile.OpConst, compile.OpDup,
+			compile.OpGetGlobal, compile.OpGetLocal, compile.OpGetOuter,
+			compile.OpAddLK, compile.OpSubLK, compile.OpEqLK, compile.OpNeqLK,
+			compile.OpLtLK, compile.OpLteLK, compile.OpGtLK, compile.OpGteLK:
+			d++
+		case compile.OpPop, compile.OpSetGlobal, compile.OpSetLocal,
+			compile.OpEq, compile.OpNeq, compile.OpLt, compile.OpLte,
+			compile.OpGt, compile.OpGte, compile.OpSame,
+			compile.OpAssertEqual, compile.OpReturnValue:
+			d--
+		case compile.OpAdd, compile.OpSub, compile.OpMul, compile.OpDiv,
+			compile.OpMod, compile.OpAnd, compile.OpOr, compile.OpConcat,
+			compile.OpPrint:
+			d += 1 - a
+		case compile.OpCall:
+			d += 1 - fns[a].NumArgs
+		case compile.OpJump:
+			depth[a] = d + 1
+			live = false
+		case compile.OpJumpFalse:
+			d--
+			depth[a] = d + 1
+		case compile.OpReturn:
+			live = false
+		}
+		if d > max {
+			max = d
+		}
+		off = next
+	}
+	return max
+}
+
+// runtimeError unwinds the VM after an error has been recorded in the file
+type runtimeError struct{}
+
+func (vm *VM) error(p token.Pos, args ...interface{}) {
+	if p.IsValid() {
+		vm.prog.File.AddError(p, args...)
+	} else {
+		vm.prog.File.AddError(vm.prog.File.Base(), args...)
+	}
+	panic(runtimeError{})
+}
+
+func (vm *VM) Run() (interface{}, error) {
+	return vm.RunContext(context.Background())
+}
+
+// RunContext runs the program from the start, stopping early if ctx is
+// cancelled. Runtime errors are recorded in the program's file and returned
+// as a token.ErrorList.
+func (vm *VM) RunContext(ctx context.Context) (res interface{}, err error) {
+	if vm.globals == nil {
+		vm.globals = make([]value, len(vm.prog.Globals))
+	} else {
+		for i := range vm.globals {
+			vm.globals[i] = value{}
+		}
+	}
+	vm.frames = vm.frames[:0]
+	vm.steps = 0
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtimeError); !ok {
+				panic(r)
+			}
+			res, err = nil, vm.prog.File.Err()
+		}
+	}()
+	return vm.run(ctx).iface(), nil
+}
+
+// grow returns the stack with room for at least n values
+func (vm *VM) grow(n int) []value {
+	if n >= len(vm.stack) {
+		size := 2 * len(vm.stack)
+		if size <= n {
+			size = n + 1
+		}
+		vm.stack = append(vm.stack, make([]value, size-len(vm.stack))...)
+	}
+	return vm.stack
+}
+
+// run executes the main function. The stack and the current function are
+// kept in local variables, and only written back to the VM when calling
+// out, as doing so is considerably faster. Each function has room on the
+// stack for the most values it uses at once, reserved when it is called.
+// ip is left at the start of an instruction until it has run, so that any
+// error it raises is reported at its position.
+func (vm *VM) run(ctx context.Context) value {
+	main := len(vm.fns) - 1
+	vm.frames = append(vm.frames, frame{fn: main, link: -1})
+	fn := &vm.fns[main]
+	code, ip, base := fn.code, 0, 0
+	stack, sp := vm.grow(fn.maxStack), fn.numLocals
+	for i := 0; i < sp; i++ {
+		stack[i] = value{}
+	}
+	count := 0 // instructions which may run before the next check
+	for {
+		if count == 0 {
+			count = vm.check(ctx, fn.pos[ip])
+		}
+		count--
+
+		switch op := compile.Opcode(code[ip]); op {
+		case compile.OpNil:
+			stack[sp] = value{}
+			sp++
+			ip++
+		case compile.OpConst:
+			stack[sp] = fn.consts[code[ip+1]]
+			sp++
+			ip += 3
+		case compile.OpPop:
+			sp--
+			ip++
+		case compile.OpDup:
+			stack[sp] = stack[sp-1]
+			sp++
+			ip++
+		case compile.OpGetGlobal:
+			stack[sp] = vm.globals[code[ip+1]]
+			sp++
+			ip += 3
+		case compile.OpSetGlobal:
+			sp--
+			vm.globals[code[ip+1]] = stack[sp]
+			ip += 3
+		case compile.OpGetLocal:
+			stack[sp] = stack[base+int(code[ip+1])]
+			sp++
+			ip += 3
+		case compile.OpSetLocal:
+			sp--
+			stack[base+int(code[ip+1])] = stack[sp]
+			ip += 3
+		case compile.OpGetOuter:
+			fi := len(vm.frames) - 1
+			for hops := code[ip+1]; hops > 0; hops-- {
+				fi = vm.frames[fi].link
+			}
+			stack[sp] = stack[vm.frames[fi].base+int(code[ip+3])]
+			sp++
+			ip += 5
+		case compile.OpAdd, compile.OpSub, compile.OpMul, compile.OpDiv,
+			compile.OpMod, compile.OpAnd, compile.OpOr:
+			n := int(code[ip+1])
+			if n == 2 && op != compile.OpDiv && op != compile.OpMod {
+				// fast path for the common case of two numbers
+				x, y := &stack[sp-2], &stack[sp-1]
+				if x.kind == intKind && y.kind == intKind {
+					switch op {
+					case compile.OpAdd:
+						x.num += y.num
+					case compile.OpSub:
+						x.num -= y.num
+					case compile.OpMul:
+						x.num *= y.num
+					case compile.OpAnd:
+						x.num = btoi(x.num != 0 && y.num != 0)
+					case compile.OpOr:
+						x.num = btoi(x.num != 0 || y.num != 0)
+					}
+					sp--
+					ip += 3
+					break
+				}
+			}
+			sp -= n
+			stack[sp] = vm.math(op, stack[sp:sp+n], fn.pos[ip])
+			sp++
+			ip += 3
+		case compile.OpConcat:
+			n := int(code[ip+1])
+			sp -= n
+			stack[sp] = concat(stack[sp : sp+n])
+			vm.checkSize(fn.pos[ip], stack[sp])
+			sp++
+			ip += 3
+		case compile.OpEq:
+			sp--
+			stack[sp-1] = boolValue(ints(stack[sp-1], stack[sp]) &&
+				stack[sp-1].num == stack[sp].num)
+			ip++
+		case compile.OpNeq:
+			sp--
+			stack[sp-1] = boolValue(ints(stack[sp-1], stack[sp]) &&
+				stack[sp-1].num != stack[sp].num)
+			ip++
+		case compile.OpLt:
+			sp--
+			stack[sp-1] = boolValue(ints(stack[sp-1], stack[sp]) &&
+				stack[sp-1].num < stack[sp].num)
+			ip++
+		case compile.OpLte:
+			sp--
+			stack[sp-1] = boolValue(ints(stack[sp-1], stack[sp]) &&
+				stack[sp-1].num <= stack[sp].num)
+			ip++
+		case compile.OpGt:
+			sp--
+			stack[sp-1] = boolValue(ints(stack[sp-1], stack[sp]) &&
+				stack[sp-1].num > stack[sp].num)
+			ip++
+		case compile.OpGte:
+			sp--
+			stack[sp-1] = boolValue(ints(stack[sp-1], stack[sp]) &&
+				stack[sp-1].num >= stack[sp].num)
+			ip++
+		case compile.OpSame:
+			sp--
+			stack[sp-1] = boolValue(stack[sp-1] == stack[sp])
+			ip++
+		case compile.OpJump:
+			ip = int(code[ip+1])
+		case compile.OpJumpFalse:
+			sp--
+			if !stack[sp].isTrue() {
+				ip = int(code[ip+1])
+			} else {
+				ip += 3
+			}
+		case compile.OpCall:
+			a, hops := int(code[ip+1]), code[ip+3]
+			callee := &vm.fns[a]
+			if vm.MaxDepth > 0 && len(vm.frames) > vm.MaxDepth {
+				vm.error(fn.pos[ip], "Maximum call depth of ",
+					vm.MaxDepth, " exceeded in call to ", callee.name)
+			}
+			link := len(vm.frames) - 1
+			for ; hops > 0; hops-- {
+				link = vm.frames[link].link
+			}
+			base = sp - callee.numArgs
+			if base+callee.maxStack >= len(stack) {
+				stack = vm.grow(base + callee.maxStack)
+			}
+			for sp < base+callee.numLocals {
+				stack[sp] = value{}
+				sp++
+			}
+			vm.frames[len(vm.frames)-1].ip = ip + 5
+			vm.frames = append(vm.frames, frame{fn: a, base: base, link: link})
+			fn = callee
+			code, ip = fn.code, 0
+		case compile.OpReturnValue:
+			if stack[sp-1].kind == nilKind {
+				sp--
+				ip++
+				break
+			}
+			fallthrough
+		case compile.OpReturn:
+			n := len(vm.frames) - 1
+			if n == 0 {
+				return stack[sp-1]
+			}
+			stack[base] = stack[sp-1]
+			sp = base + 1
+			vm.frames = vm.frames[:n]
+			f := &vm.frames[n-1]
+			fn = &vm.fns[f.fn]
+			code, ip, base = fn.code, f.ip, f.base
+		case compile.OpPrint:
+			n := int(code[ip+1])
+			sp -= n
+			vm.print(stack[sp : sp+n])
+			stack[sp] = value{}
+			sp++
+			ip += 3
+		case compile.OpIs:
+			stack[sp-1] = boolValue(is(int(code[ip+1]), stack[sp-1]))
+			ip += 3
+		case compile.OpConv:
+			x, err := types.Convert(stack[sp-1].iface(), types.Type(code[ip+1]))
+			if err != nil {
+				vm.error(fn.pos[ip], err)
+			}
+			stack[sp-1] = toValue(x)
+			vm.checkSize(fn.pos[ip], stack[sp-1])
+			ip += 3
+		case compile.OpAssert:
+			t := types.Type(code[ip+1])
+			if vt := types.ValueType(stack[sp-1].iface()); vt != t {
+				vm.error(fn.pos[ip], "Type assertion failed: expected ", t,
+					", got ", vt)
+			}
+			ip += 3
+		case compile.OpAssertEqual:
+			want, got := stack[sp-2].iface(), stack[sp-1].iface()
+			if want != got {
+				vm.error(fn.pos[ip], "Assertion failed: expected ",
+					format(want), ", got ", format(got))
+			}
+			sp--
+			stack[sp-1] = value{}
+			ip++
+		case compile.OpAddLK:
+			if x := &stack[base+int(code[ip+1])]; x.kind == intKind {
+				stack[sp] = intValue(x.num + int(code[ip+3]))
+			} else {
+				stack[sp] = intValue(0)
+			}
+			sp++
+			ip += 5
+		case compile.OpSubLK:
+			if x := &stack[base+int(code[ip+1])]; x.kind == intKind {
+				stack[sp] = intValue(x.num - int(code[ip+3]))
+			} else {
+				stack[sp] = intValue(0)
+			}
+			sp++
+			ip += 5
+		case compile.OpEqLK:
+			x := &stack[base+int(code[ip+1])]
+			stack[sp] = boolValue(x.kind == intKind &&
+				x.num == int(code[ip+3]))
+			sp++
+			ip += 5
+		case compile.OpNeqLK:
+			x := &stack[base+int(code[ip+1])]
+			stack[sp] = boolValue(x.kind == intKind &&
+				x.num != int(code[ip+3]))
+			sp++
+			ip += 5
+		case compile.OpLtLK:
+			x := &stack[base+int(code[ip+1])]
+			stack[sp] = boolValue(x.kind == intKind &&
+				x.num < int(code[ip+3]))
+			sp++
+			ip += 5
+		case compile.OpLteLK:
+			x := &stack[base+int(code[ip+1])]
+			stack[sp] = boolValue(x.kind == intKind &&
+				x.num <= int(code[ip+3]))
+			sp++
+			ip += 5
+		case compile.OpGtLK:
+			x := &stack[base+int(code[ip+1])]
+			stack[sp] = boolValue(x.kind == intKind &&
+				x.num > int(code[ip+3]))
+			sp++
+			ip += 5
+		case compile.OpGteLK:
+			x := &stack[base+int(code[ip+1])]
+			stack[sp] = boolValue(x.kind == intKind &&
+				x.num >= int(code[ip+3]))
+			sp++
+			ip += 5
+		default:
+			vm.error(fn.pos[ip], "Invalid opcode: ", op)
+		}
+	}
+}
+
+// print writes args as fmt.Println would, without boxing each in an
+// interface
+func (vm *VM) print(args []value) {
+	b := vm.buf[:0]
+	for i, v := range args {
+		if i > 0 {
+			b = append(b, ' ')
+		}
+		switch v.kind {
+		case nilKind:
+			b = append(b, "<nil>"...)
+		case intKind:
+			b = strconv.AppendInt(b, int64(v.num), 10)
+		case floatKind:
+			b = strconv.AppendFloat(b, v.iface().(float64), 'g', -1, 64)
+		case strKind:
+			b = append(b, v.str...)
+		}
+	}
+	vm.buf = append(b, '\n')
+	vm.Out.Write(vm.buf)
+}
+
+// check stops the VM if ctx is cancelled or the step limit is reached. It
+// returns the number of instructions which may run before it is next called.
+func (vm *VM) check(ctx context.Context, p token.Pos) int {
+	select {
+	case <-ctx.Done():
+		vm.error(p, "Execution stopped: ", ctx.Err())
+	default:
+	}
+	n := checkInterval
+	if vm.MaxSteps > 0 {
+		if vm.steps >= vm.MaxSteps {
+			vm.error(p, "Execution step limit of ", vm.MaxSteps, " exceeded")
+		}
+		if left := vm.MaxSteps - vm.steps; left < n {
+			n = left
+		}
+	}
+	vm.steps += n
+	return n
+}
+
+func (vm *VM) checkSize(p token.Pos, v value) {
+	if vm.MaxSize > 0 && v.kind == strKind && len(v.str) > vm.MaxSize {
+		vm.error(p, "String length limit of ", vm.MaxSize, " exceeded")
+	}
+}
+
+// format returns v as it is shown in an error, quoting strings
+func format(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return strconv.Quote(s)
+	}
+	return fmt.Sprint(v)
+}
+
+func operand(code []byte, ip int) int {
+	return int(code[ip])<<8 | int(code[ip+1])
+}
+
+func (vm *VM) math(op compile.Opcode, args []value, p token.Pos) value {
+	for _, v := range args {
+		if v.kind != intKind {
+			return intValue(0)
+		}
+	}
+	r := args[0].num
+	for _, v := range args[1:] {
+		switch op {
+		case compile.OpAdd:
+			r += v.num
+		case compile.OpSub:
+			r -= v.num
+		case compile.OpMul:
+			r *= v.num
+		case compile.OpDiv, compile.OpMod:
+			if v.num == 0 {
+				vm.error(p, "Division by zero")
+			}
+			if op == compile.OpDiv {
+				r /= v.num
+			} else {
+				r %= v.num
+			}
+		case compile.OpAnd:
+			r = btoi(r != 0 && v.num != 0)
+		case compile.OpOr:
+			r = btoi(r != 0 || v.num != 0)
+		}
+	}
+	return intValue(r)
+}
+
+func concat(args []value) value {
+	s := ""
+	for _, v := range args {
+		switch v.kind {
+		case intKind:
+			s += strconv.Itoa(v.num)
+		case floatKind:
+			s += types.FormatFloat(v.iface().(float64))
+		case strKind:
+			s += v.str
+		}
+	}
+	return value{kind: strKind, str: s}
+}
+
+// ints reports whether x and y are both ints, as the operands of a
+// comparison must be for it to hold
+func ints(x, y value) bool {
+	return x.kind == intKind && y.kind == intKind
+}
+
+// is reports whether v passes one of the type tests of OpIs
+func is(test int, v value) bool {
+	switch test {
+	case compile.IsNumber:
+		return v.kind == intKind || v.kind == floatKind
+	case compile.IsString:
+		return v.kind == strKind
+	}
+	return false // there are no list or function values
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,262 @@
+package vm_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/rthornton128/gocalc/ast"
+	"github.com/rthornton128/gocalc/compile"
+	"github.com/rthornton128/gocalc/eval"
+	"github.com/rthornton128/gocalc/internal/testutil"
+	"github.com/rthornton128/gocalc/parser"
+	"github.com/rthornton128/gocalc/token"
+	"github.com/rthornton128/gocalc/vm"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func compileString(t testing.TB, fname, expr string) *compile.Program {
+	f := token.NewFile(fname, expr, 1)
+	n := parser.ParseFile(f, expr)
+	if f.NumErrors() > 0 {
+		t.Fatal(f.Err())
+	}
+	prog, err := compile.Compile(f, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prog
+}
+
+func TestVMExpressions(t *testing.T) {
+	var tests = []struct {
+		expr string
+		res  interface{}
+	}{
+		{"(+ 1 2)", 3},
+		{"(+ 1 2 3)", 6},
+		{"(+ 1 2 -3)", 0},
+		{"(+ 1 (+ 2 3))", 6},
+		{"(+ (+ 1 2) (+ 3 4))", 10},
+		{"(- (- 8 2) (- 3 4))", 7},
+		{"(* (* 2 3) (* 3 3))", 54},
+		{"(/ 8 (/ 4 2))", 4},
+		{"(% 7 4)", 3},
+		{"(and 1 0)", 0},
+		{"(or 1 0)", 1},
+		{"(<> 3 3)", 0},
+		{"(>= 3 3)", 1},
+		{"(if (> 2 1) (+ 2 3) (- 3 2))", 5},
+		{"(if (< 2 1) 1)", nil},
+		{"(+ \"a\" 1 \"b\")", "a1b"},
+		{"(set a 3) (set a (+ a 1)) (+ a 0)", 4},
+		{"(define (sq x) (* x x)) (sq 9)", 81},
+		{"(define (f x) (define (g y) (+ x y)) (g 2)) (f 40)", 42},
+		{"(define (f x) (set y 1) (+ x y)) (f 1)", 2},
+		{"(define (f x) x) (+ 2 (f \"foo\"))", 0},
+		{"(define (f n) (if (< n 2) n (+ (f (- n 1)) (f (- n 2))))) (f 10)",
+			55},
+		{"(define (f n) (+ n 70000)) (f 1)", 70001},
+		{"(define (f x) (number? x)) (+ (f 1) (f \"a\"))", 1},
+		{"(define (f) 1) (function? f)", 1},
+		{"(set b (= 1 1)) (+ (bool? b) (bool? 1) (list? b))", 1},
+		{"(define (int x) x) (int \"2\")", "2"},
+		{"(int (float \"2.75\"))", 2},
+		{"(+ \"n=\" (float 3) (str 4))", "n=34"},
+		{"(assert-equal 3 (+ 1 2))", nil},
+	}
+	for x, test := range tests {
+		res := vm.EvalExpr(test.expr)
+		if res != test.res {
+			t.Log(x, "- Expected:", test.res)
+			t.Fatal(x, "- Got:", res)
+		}
+	}
+}
+
+func TestVMErrors(t *testing.T) {
+	var tests = []struct {
+		expr string
+		err  string
+	}{
+		{"(define (f x) (f x)) (f 1)",
+			"Line: 1 Column: 15 - Maximum call depth of 100 exceeded in call to f"},
+		{"(/ 1 0)", "Line: 1 Column: 1 - Division by zero"},
+		{"(int \"abc\")", "Line: 1 Column: 1 - Cannot convert \"abc\" to int"},
+		{"(define (f x) (assert-type x int)) (f \"a\")",
+			"Line: 1 Column: 15 - Type assertion failed: expected int, got string"},
+		{"(assert-equal \"a\" (+ \"b\" 1))",
+			"Line: 1 Column: 1 - Assertion failed: expected \"a\", got \"b1\""},
+		{"(set a 1) (set a \"s\")", "Line: 1 Column: 11 - Cannot set a of " +
+			"type int to a value of type string"},
+	}
+	for x, test := range tests {
+		// the interpreter must reject the same programs, in the same way,
+		// though it also prints a traceback
+		_, err := eval.EvalFileContext(context.Background(), "", test.expr,
+			eval.Options{MaxDepth: 100, Stdout: ioutil.Discard})
+		if err == nil || !strings.HasSuffix(err.Error(), test.err) {
+			t.Log(x, "- Expected:", test.err)
+			t.Fatal(x, "- Interpreter got:", err)
+		}
+		f := token.NewFile("", test.expr, 1)
+		prog, err := compile.Compile(f, parser.ParseFile(f, test.expr))
+		if err == nil {
+			v := vm.New(prog)
+			v.MaxDepth = 100
+			_, err = v.Run()
+		}
+		if err == nil || err.Error() != test.err {
+			t.Log(x, "- Expected:", test.err)
+			t.Fatal(x, "- Got:", err)
+		}
+	}
+}
+
+func TestVMLimits(t *testing.T) {
+	var tests = []struct {
+		expr string
+		opt  vm.Options
+		err  string
+	}{
+		{"(define (f x) (f x)) (f 1)", vm.Options{MaxDepth: 100},
+			"Line: 1 Column: 15 - Maximum call depth of 100 exceeded in call to f"},
+		{"(+ 1 (+ 2 3))", vm.Options{MaxSteps: 3},
+			"Line: 1 Column: 6 - Execution step limit of 3 exceeded"},
+		{"(+ 1 (+ 2 3))", vm.Options{MaxSteps: 6}, ""},
+		{"(define (f s) (f (+ \"ab\" s))) (f \"\")", vm.Options{MaxSize: 8},
+			"Line: 1 Column: 18 - String length limit of 8 exceeded"},
+		{"(str 123456789)", vm.Options{MaxSize: 8},
+			"Line: 1 Column: 1 - String length limit of 8 exceeded"},
+		{"(print 1)", vm.Options{Sandbox: true},
+			"Line: 1 Column: 1 - 'print' is not permitted: requires capability io"},
+		{"(print 1)", vm.Options{Sandbox: true, Allow: []string{"io"}}, ""},
+		{"(+ 1 2)", vm.Options{Sandbox: true, Allow: []string{"net"}},
+			"unknown capability: net"},
+	}
+	for x, test := range tests {
+		test.opt.Stdout = ioutil.Discard
+		_, err := vm.EvalFileContext(context.Background(), "", test.expr,
+			test.opt)
+		if test.err == "" {
+			if err != nil {
+				t.Fatal(x, "- Unexpected error:", err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.err {
+			t.Log(x, "- Expected:", test.err)
+			t.Fatal(x, "- Got:", err)
+		}
+	}
+}
+
+func TestVMCancel(t *testing.T) {
+	expr := "(define (f x) (if (= x 0) 0 (+ (f (- x 1)) (f (- x 1))))) (f 40)"
+	ctx, cancel := context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer cancel()
+	_, err := vm.New(compileString(t, "", expr)).RunContext(ctx)
+	if err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Fatal("Expected deadline to stop execution, got:", err)
+	}
+}
+
+func scripts(t testing.TB) map[string]string {
+	names, err := filepath.Glob(filepath.Join("..", "scripts", "*.calc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]string)
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m[name] = string(data)
+	}
+	return m
+}
+
+func TestVMScripts(t *testing.T) {
+	for name, src := range scripts(t) {
+		want := testutil.CaptureStdout(t, func() { eval.EvalFile(name, src) })
+		var buf bytes.Buffer
+		v := vm.New(compileString(t, name, src))
+		v.Out = &buf
+		if _, err := v.Run(); err != nil {
+			t.Fatal(name, err)
+		}
+		if buf.String() != want {
+			t.Log(name, "- Expected:\n", want)
+			t.Fatal(name, "- Got:\n", buf.String())
+		}
+	}
+}
+
+// The benchmarks measure running a script which has already been parsed,
+// with its output discarded. The evaluator resolves and checks a tree each
+// time it is run, whereas a compiled program may be run again as it is.
+func parseSource(b *testing.B, name, src string) (*token.File, *ast.File) {
+	f := token.NewFile(name, src, 1)
+	n := parser.ParseFile(f, src)
+	if f.NumErrors() > 0 {
+		b.Fatal(f.Err())
+	}
+	return f, n
+}
+
+func benchmarkEval(b *testing.B, name string) {
+	benchmarkEvalSource(b, name, scripts(b)[filepath.Join("..", "scripts",
+		name)])
+}
+
+func benchmarkEvalSource(b *testing.B, name, src string) {
+	f, n := parseSource(b, name, src)
+	opt := eval.Options{Stdout: ioutil.Discard}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := eval.EvalTree(context.Background(), f, n,
+			opt); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkVM(b *testing.B, name string) {
+	benchmarkVMSource(b, name, scripts(b)[filepath.Join("..", "scripts",
+		name)])
+}
+
+func benchmarkVMSource(b *testing.B, name, src string) {
+	f, n := parseSource(b, name, src)
+	prog, err := compile.Compile(f, n)
+	if err != nil {
+		b.Fatal(err)
+	}
+	v := vm.New(prog)
+	v.Out = ioutil.Discard
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := v.Run(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEvalFact(b *testing.B) { benchmarkEval(b, "fact.calc") }
+func BenchmarkVMFact(b *testing.B)   { benchmarkVM(b, "fact.calc") }
+func BenchmarkEvalFib(b *testing.B)  { benchmarkEval(b, "fib.calc") }
+func BenchmarkVMFib(b *testing.B)    { benchmarkVM(b, "fib.calc") }
+func BenchmarkEvalTest(b *testing.B) { benchmarkEval(b, "test.calc") }
+func BenchmarkVMTest(b *testing.B)   { benchmarkVM(b, "test.calc") }
+
+// fib is dominated by calls, unlike the scripts
+const fib = `(define (fib n)
+	(if (< n 2) n (+ (fib (- n 1)) (fib (- n 2)))))
+(fib 20)`
+
+func BenchmarkEvalCalls(b *testing.B) { benchmarkEvalSource(b, "fib", fib) }
+func BenchmarkVMCalls(b *testing.B)   { benchmarkVMSource(b, "fib", fib) }